@@ -0,0 +1,84 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+)
+
+// asciiSocket translates line endings for transfers in ASCII mode (TYPE A):
+// written data has its LF line endings sent as CRLF, and CRLF line endings
+// read from the client are stored as LF. Existing CRLF line endings are
+// written unchanged and lone CRs are kept.
+type asciiSocket struct {
+	DataSocket
+	reader *bufio.Reader
+	lastCR bool // the last byte written was a CR
+}
+
+func newASCIISocket(socket DataSocket) *asciiSocket {
+	return &asciiSocket{DataSocket: socket, reader: bufio.NewReader(socket)}
+}
+
+func (socket *asciiSocket) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		// return what we have rather than block for more
+		if n > 0 && socket.reader.Buffered() == 0 {
+			break
+		}
+		var c byte
+		c, err = socket.reader.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if c == '\r' {
+			if n > 0 && socket.reader.Buffered() == 0 {
+				// decide on the CR once the next byte is there
+				socket.reader.UnreadByte()
+				break
+			}
+			if next, err := socket.reader.Peek(1); err == nil && next[0] == '\n' {
+				continue
+			}
+		}
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
+
+func (socket *asciiSocket) Write(p []byte) (n int, err error) {
+	out := make([]byte, 0, len(p)+len(p)/8)
+	lastCR := socket.lastCR
+	for _, c := range p {
+		if c == '\n' && !lastCR {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+		lastCR = c == '\r'
+	}
+	written, err := socket.DataSocket.Write(out)
+	if err == nil {
+		socket.lastCR = lastCR
+		return len(p), nil
+	}
+
+	// count the bytes of p whose translation was written entirely
+	lastCR = socket.lastCR
+	for _, c := range p {
+		size := 1
+		if c == '\n' && !lastCR {
+			size = 2
+		}
+		if written < size {
+			break
+		}
+		written -= size
+		lastCR = c == '\r'
+		n++
+	}
+	socket.lastCR = lastCR
+	return n, err
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// oneByteSocket is a DataSocket whose reads return a single byte, to split
+// line endings across reads.
+type oneByteSocket struct {
+	bufferSocket
+}
+
+func (socket *oneByteSocket) Read(p []byte) (int, error) {
+	return iotest.OneByteReader(&socket.bufferSocket).Read(p)
+}
+
+var asciiTests = []struct {
+	lf, crlf string
+}{
+	{"", ""},
+	{"a\nb\n", "a\r\nb\r\n"},
+	{"\n\n", "\r\n\r\n"},
+	{"no newline", "no newline"},
+	{"lone\rcr\n", "lone\rcr\r\n"},
+	{"trailing cr\r", "trailing cr\r"},
+	{"\x00\xff\n\x01", "\x00\xff\r\n\x01"},
+}
+
+func TestASCIISocketWrite(t *testing.T) {
+	for _, tt := range asciiTests {
+		// written in one go and byte by byte, so CRLF spans writes
+		for _, chunk := range []int{len(tt.lf) + 1, 1} {
+			buf := new(bufferSocket)
+			socket := newASCIISocket(buf)
+			for s := tt.lf; s != ""; {
+				size := chunk
+				if size > len(s) {
+					size = len(s)
+				}
+				if n, err := socket.Write([]byte(s[:size])); n != size || err != nil {
+					t.Fatalf("Write: got %d, %v", n, err)
+				}
+				s = s[size:]
+			}
+			if got := buf.String(); got != tt.crlf {
+				t.Errorf("%q in chunks of %d: got %q, want %q", tt.lf, chunk, got, tt.crlf)
+			}
+		}
+	}
+
+	// CRLF line endings are kept, even split across writes.
+	buf := new(bufferSocket)
+	socket := newASCIISocket(buf)
+	io.WriteString(socket, "dos\r")
+	io.WriteString(socket, "\nunix\n")
+	if got := buf.String(); got != "dos\r\nunix\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestASCIISocketRead(t *testing.T) {
+	for _, tt := range asciiTests {
+		buf := new(bufferSocket)
+		buf.WriteString(tt.crlf)
+		if got, err := ioutil.ReadAll(newASCIISocket(buf)); err != nil || string(got) != tt.lf {
+			t.Errorf("%q: got %q, %v, want %q", tt.crlf, got, err, tt.lf)
+		}
+
+		slow := new(oneByteSocket)
+		slow.WriteString(tt.crlf)
+		if got, err := ioutil.ReadAll(newASCIISocket(slow)); err != nil || string(got) != tt.lf {
+			t.Errorf("%q byte by byte: got %q, %v, want %q", tt.crlf, got, err, tt.lf)
+		}
+	}
+
+	// Bare LF from Unix clients is kept.
+	buf := new(bufferSocket)
+	buf.WriteString(strings.Repeat("unix\n", 3))
+	if got, _ := ioutil.ReadAll(newASCIISocket(buf)); string(got) != strings.Repeat("unix\n", 3) {
+		t.Errorf("got %q", got)
+	}
+}
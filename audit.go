@@ -0,0 +1,123 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditAction is the kind of action recorded by an AuditEvent.
+type AuditAction string
+
+// The actions reported to an Auditor.
+const (
+	AuditLogin     AuditAction = "login"
+	AuditUpload    AuditAction = "upload" // STOR, APPE and STOU
+	AuditDelete    AuditAction = "delete"
+	AuditMakeDir   AuditAction = "mkdir"
+	AuditRemoveDir AuditAction = "rmdir"
+	AuditRename    AuditAction = "rename"
+	AuditChmod     AuditAction = "chmod"
+	AuditClearTLS  AuditAction = "clear_tls" // CCC
+)
+
+var (
+	errAuditPassword = errors.New("ftp: incorrect password")
+	errAuditLocked   = errors.New("ftp: too many failed logins")
+	errAuditCCC      = errors.New("ftp: CCC denied by policy")
+)
+
+// AuditEvent describes a security-relevant action of a session.
+type AuditEvent struct {
+	Time       time.Time
+	SessionID  string
+	RemoteAddr string
+	// The user acting, or the one trying to log in for AuditLogin
+	User   string
+	Action AuditAction
+	// The path acted on, as passed to the Driver. For AuditRename it is the
+	// old path and To the new one.
+	Target string
+	To     string
+	// The error the action failed with, nil if it succeeded
+	Err error
+}
+
+// Auditor records the AuditEvents of sessions, as an audit trail separate
+// from the Logger. Its method may be called concurrently by different
+// connections.
+type Auditor interface {
+	Audit(event AuditEvent)
+}
+
+// nopAuditor is used when no Auditor is configured.
+type nopAuditor struct{}
+
+func (nopAuditor) Audit(AuditEvent) {}
+
+// audit reports event to the Auditor of the server, completing it with the
+// time and the details of the session.
+func (conn *Conn) audit(event AuditEvent) {
+	event.Time = time.Now()
+	event.SessionID = conn.sessionID
+	event.RemoteAddr = conn.conn.RemoteAddr().String()
+	if event.User == "" {
+		event.User = conn.user
+	}
+	conn.server.Auditor.Audit(event)
+}
+
+// JSONAuditor writes one JSON object per line for each event, with the
+// fields time, session, remote, user, action, target, to, result and error.
+// It is safe for concurrent use.
+type JSONAuditor struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+// NewJSONAuditor returns a JSONAuditor writing to out.
+func NewJSONAuditor(out io.Writer) *JSONAuditor {
+	return &JSONAuditor{out: out}
+}
+
+type jsonAuditEvent struct {
+	Time    string      `json:"time"`
+	Session string      `json:"session"`
+	Remote  string      `json:"remote"`
+	User    string      `json:"user"`
+	Action  AuditAction `json:"action"`
+	Target  string      `json:"target,omitempty"`
+	To      string      `json:"to,omitempty"`
+	Result  string      `json:"result"` // "success" or "failure"
+	Error   string      `json:"error,omitempty"`
+}
+
+// Audit writes event.
+func (auditor *JSONAuditor) Audit(event AuditEvent) {
+	entry := jsonAuditEvent{
+		Time:    event.Time.UTC().Format(time.RFC3339Nano),
+		Session: event.SessionID,
+		Remote:  event.RemoteAddr,
+		User:    event.User,
+		Action:  event.Action,
+		Target:  event.Target,
+		To:      event.To,
+		Result:  "success",
+	}
+	if event.Err != nil {
+		entry.Result = "failure"
+		entry.Error = event.Err.Error()
+	}
+	line, _ := json.Marshal(entry)
+	line = append(line, '\n')
+
+	auditor.lock.Lock()
+	defer auditor.lock.Unlock()
+	auditor.out.Write(line)
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingAuditor keeps the events it receives.
+type recordingAuditor struct {
+	lock   sync.Mutex
+	events []AuditEvent
+}
+
+func (auditor *recordingAuditor) Audit(event AuditEvent) {
+	auditor.lock.Lock()
+	defer auditor.lock.Unlock()
+	auditor.events = append(auditor.events, event)
+}
+
+func (auditor *recordingAuditor) recorded() []AuditEvent {
+	auditor.lock.Lock()
+	defer auditor.lock.Unlock()
+	return append([]AuditEvent{}, auditor.events...)
+}
+
+func TestAuditor(t *testing.T) {
+	auditor := new(recordingAuditor)
+	s, _ := newTestServer(t, &ServerOpts{Auditor: auditor})
+	c := dialTestServer(t, s)
+	expect(t, c, 331, "USER admin")
+	expect(t, c, 530, "PASS wrong")
+	login(t, c)
+	expect(t, c, 257, "MKD /dir")
+	upload(t, c, "/dir/a.txt", "hello")
+	expect(t, c, 350, "RNFR /dir/a.txt")
+	expect(t, c, 250, "RNTO /dir/b.txt")
+	expect(t, c, 200, "SITE CHMOD 600 /dir/b.txt")
+	expect(t, c, 250, "DELE /dir/b.txt")
+	expect(t, c, 550, "DELE /dir/b.txt")
+	expect(t, c, 250, "RMD /dir")
+	expect(t, c, 534, "CCC")
+
+	want := []struct {
+		action     AuditAction
+		target, to string
+		failed     bool
+	}{
+		{AuditLogin, "", "", true},
+		{AuditLogin, "", "", false},
+		{AuditMakeDir, "/dir", "", false},
+		{AuditUpload, "/dir/a.txt", "", false},
+		{AuditRename, "/dir/a.txt", "/dir/b.txt", false},
+		{AuditChmod, "/dir/b.txt", "", false},
+		{AuditDelete, "/dir/b.txt", "", false},
+		{AuditDelete, "/dir/b.txt", "", true},
+		{AuditRemoveDir, "/dir", "", false},
+		{AuditClearTLS, "", "", true},
+	}
+	events := auditor.recorded()
+	if len(events) != len(want) {
+		t.Fatalf("got %d events %+v, want %d", len(events), events, len(want))
+	}
+	sessionID := s.ActiveConns()[0].SessionID
+	for i, event := range events {
+		w := want[i]
+		if event.Action != w.action || event.Target != w.target || event.To != w.to || (event.Err != nil) != w.failed {
+			t.Errorf("event %d: got %s %q %q %v, want %s %q %q failed %v", i, event.Action, event.Target, event.To, event.Err, w.action, w.target, w.to, w.failed)
+		}
+		if event.User != "admin" || event.SessionID != sessionID || event.RemoteAddr == "" || event.Time.IsZero() {
+			t.Errorf("event %d: got %+v", i, event)
+		}
+	}
+}
+
+func TestJSONAuditor(t *testing.T) {
+	var buf bytes.Buffer
+	auditor := NewJSONAuditor(&buf)
+	at := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	auditor.Audit(AuditEvent{Time: at, SessionID: "s1", RemoteAddr: "192.0.2.1:1234", User: "admin", Action: AuditRename, Target: "/a", To: "/b"})
+	auditor.Audit(AuditEvent{Time: at, SessionID: "s1", RemoteAddr: "192.0.2.1:1234", User: "admin", Action: AuditLogin, Err: errors.New("denied")})
+
+	want := `{"time":"2018-01-02T03:04:05Z","session":"s1","remote":"192.0.2.1:1234","user":"admin","action":"rename","target":"/a","to":"/b","result":"success"}
+{"time":"2018-01-02T03:04:05Z","session":"s1","remote":"192.0.2.1:1234","user":"admin","action":"login","result":"failure","error":"denied"}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+// noRootCertAuth is a certAuth failing to find the root of users.
+type noRootCertAuth struct {
+	*certAuth
+}
+
+func (a noRootCertAuth) Root(string) (string, error) {
+	return "", errors.New("ftp: no root")
+}
+
+func TestAuditorCertLogin(t *testing.T) {
+	alice, aliceLeaf := testClientCert(t)
+	config := testTLSConfig(t)
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	config.ClientCAs = x509.NewCertPool()
+	config.ClientCAs.AddCert(aliceLeaf)
+	auth := &certAuth{SimpleAuth{Name: "admin", Password: "admin"}, aliceLeaf, newTestDriverFactory().driver}
+
+	for _, test := range []struct {
+		auth   Auth
+		code   int
+		failed bool
+	}{
+		{auth, 232, false},
+		{noRootCertAuth{auth}, 530, true},
+	} {
+		auditor := new(recordingAuditor)
+		s, _ := newTestServer(t, &ServerOpts{Auth: test.auth, Auditor: auditor, TLS: true, ExplicitFTPS: true, TLSConfig: config})
+		c := dialAuthTLS(t, s, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{alice}})
+		expect(t, c, test.code, "USER alice")
+		events := auditor.recorded()
+		if len(events) != 1 || events[0].Action != AuditLogin || events[0].User != "alice" || (events[0].Err != nil) != test.failed {
+			t.Errorf("got events %+v, want a login of alice failed %v", events, test.failed)
+		}
+		c.Close()
+	}
+}
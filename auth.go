@@ -4,11 +4,29 @@
 
 package server
 
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"sync"
+)
+
+// ErrUnknownUser is returned by MultiUserAuth for users it doesn't know.
+var ErrUnknownUser = errors.New("ftp: unknown user")
+
 // Auth is an interface to auth your ftp user login.
 type Auth interface {
 	CheckPasswd(string, string) (bool, error)
 }
 
+// RootAuth is an optional interface an Auth can implement to jail each user
+// to a directory of the driver. All paths the user sends are resolved within
+// it and it appears as "/" to them. Symbolic links are followed by the
+// driver, which has to keep them inside the root.
+type RootAuth interface {
+	Root(user string) (string, error)
+}
+
 var (
 	_ Auth = &SimpleAuth{}
 )
@@ -26,3 +44,109 @@ func (a *SimpleAuth) CheckPasswd(name, pass string) (bool, error) {
 	}
 	return true, nil
 }
+
+// LoginMessageAuth is an optional interface an Auth can implement to greet
+// each user with their own message after login. It may span several lines;
+// an empty message keeps the default.
+type LoginMessageAuth interface {
+	Auth
+	LoginMessage(user string) string
+}
+
+// UserPermissions are the restrictions of a logged in user.
+type UserPermissions struct {
+	// If true, the user may not change files or directories, as with
+	// ServerOpts.ReadOnly.
+	ReadOnly bool
+
+	// The largest upload and download of the user in bytes, replacing
+	// ServerOpts.MaxUploadSize and MaxDownloadSize. Negative for no limit,
+	// or 0 for the limits of the server.
+	MaxUploadSize   int64
+	MaxDownloadSize int64
+
+	// The home directory of the user in the driver, which they start in
+	// and are jailed to, seeing it as "/" like a root of RootAuth. It lies
+	// within that root, if any. Optional, defaults to the root.
+	Home string
+}
+
+// UserAuth is an optional interface an Auth can implement to serve each user
+// with their own driver and permissions. The driver returned after login
+// replaces the one created by the DriverFactory for the connection.
+type UserAuth interface {
+	Auth
+	UserSession(user string) (Driver, UserPermissions, error)
+}
+
+// CertAuth is an optional interface an Auth can implement to log users in
+// by the certificate their client presented in the TLS handshake of the
+// control connection, without a password. Only certificates verified by
+// the tls.Config are passed, so it must set ClientAuth, e.g. to
+// tls.VerifyClientCertIfGiven, and ClientCAs.
+//
+// CertUser returns the user cert belongs to, like the one named by its
+// common name, and the driver serving them, or nil for the one of the
+// connection or UserAuth. A USER command for that user then logs in right
+// away with 232. For an empty user, clients log in with a password.
+type CertAuth interface {
+	Auth
+	CertUser(cert *x509.Certificate) (string, Driver, error)
+}
+
+var (
+	_ UserAuth = &MultiUserAuth{}
+)
+
+// MultiUserAuth implements UserAuth for a set of users kept in memory. It is
+// safe for concurrent use.
+type MultiUserAuth struct {
+	lock  sync.RWMutex
+	users map[string]multiUser
+}
+
+type multiUser struct {
+	password string
+	factory  DriverFactory
+	perms    UserPermissions
+}
+
+// AddUser adds or replaces the user name, served by drivers from factory.
+func (a *MultiUserAuth) AddUser(name, password string, factory DriverFactory, perms UserPermissions) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.users == nil {
+		a.users = make(map[string]multiUser)
+	}
+	a.users[name] = multiUser{password: password, factory: factory, perms: perms}
+}
+
+// RemoveUser removes the user name. Sessions already logged in are kept.
+func (a *MultiUserAuth) RemoveUser(name string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.users, name)
+}
+
+// CheckPasswd will check user's password
+func (a *MultiUserAuth) CheckPasswd(name, pass string) (bool, error) {
+	a.lock.RLock()
+	user, ok := a.users[name]
+	a.lock.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(user.password)) == 1, nil
+}
+
+// UserSession returns a new driver for the user name.
+func (a *MultiUserAuth) UserSession(name string) (Driver, UserPermissions, error) {
+	a.lock.RLock()
+	user, ok := a.users[name]
+	a.lock.RUnlock()
+	if !ok {
+		return nil, UserPermissions{}, ErrUnknownUser
+	}
+	driver, err := user.factory.NewDriver()
+	return driver, user.perms, err
+}
@@ -0,0 +1,256 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// rootAuth is a SimpleAuth jailing its user to /home/<name>.
+type rootAuth struct {
+	SimpleAuth
+}
+
+func (a *rootAuth) Root(user string) (string, error) {
+	return "/home/" + user, nil
+}
+
+func TestRootAuth(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{Auth: &rootAuth{SimpleAuth{Name: "admin", Password: "admin"}}})
+	driver.dirs["/home"] = true
+	driver.dirs["/home/admin"] = true
+	driver.files["/etc/passwd"] = []byte("root:x:0:0")
+	driver.files["/home/admin/etc/passwd"] = []byte("jailed")
+	driver.dirs["/home/admin/etc"] = true
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	if msg := expect(t, c, 257, "PWD"); msg != `"/" is the current directory` {
+		t.Errorf("got %q", msg)
+	}
+
+	// Traversal and absolute paths stay within the root.
+	for _, p := range []string{"/etc/passwd", "../../etc/passwd", "/../../../etc/passwd", "etc/../../etc/passwd"} {
+		if got := download(t, c, "RETR %s", p); got != "jailed" {
+			t.Errorf("%s: got %q, want the file inside the root", p, got)
+		}
+	}
+	// FTP paths are not URL encoded, so %2f is part of the name.
+	expect(t, c, 550, "SIZE ..%%2f..%%2fetc%%2fpasswd")
+
+	expect(t, c, 250, "CWD ../..")
+	if msg := expect(t, c, 257, "PWD"); msg != `"/" is the current directory` {
+		t.Errorf("got %q after CWD ../..", msg)
+	}
+	expect(t, c, 250, "CWD etc")
+	if msg := expect(t, c, 257, "PWD"); msg != `"/etc" is the current directory` {
+		t.Errorf("got %q", msg)
+	}
+	if msg := expect(t, c, 250, "MLST passwd"); strings.Contains(msg, "/home") {
+		t.Errorf("MLST reveals the root: %q", msg)
+	}
+
+	upload(t, c, "/new.txt", "hello")
+	if got := driver.testFile("/home/admin/new.txt"); got != "hello" {
+		t.Errorf("got %q, want the upload inside the root", got)
+	}
+	if got := driver.testFile("/etc/passwd"); got != "root:x:0:0" {
+		t.Errorf("got %q, want /etc/passwd untouched", got)
+	}
+}
+
+func TestMultiUserAuth(t *testing.T) {
+	alice, bob := newTestDriverFactory(), newTestDriverFactory()
+	auth := &MultiUserAuth{}
+	auth.AddUser("alice", "secret", alice, UserPermissions{})
+	auth.AddUser("bob", "hunter2", bob, UserPermissions{ReadOnly: true})
+	s, _ := newTestServer(t, &ServerOpts{Auth: auth})
+
+	for _, creds := range [][2]string{{"alice", "wrong"}, {"bob", "secret"}, {"carol", "secret"}} {
+		c := dialTestServer(t, s)
+		expect(t, c, 331, "USER %s", creds[0])
+		expect(t, c, 530, "PASS %s", creds[1])
+	}
+
+	c := dialTestServer(t, s)
+	expect(t, c, 331, "USER alice")
+	expect(t, c, 230, "PASS secret")
+	upload(t, c, "/alice.txt", "hello")
+	if got := alice.driver.testFile("/alice.txt"); got != "hello" {
+		t.Errorf("got %q, want alice's upload in her driver", got)
+	}
+
+	c = dialTestServer(t, s)
+	expect(t, c, 331, "USER bob")
+	expect(t, c, 230, "PASS hunter2")
+	expect(t, c, 550, "SIZE /alice.txt")
+	expect(t, c, 550, "STOR /bob.txt")
+	if len(bob.driver.files) != 0 {
+		t.Errorf("got files %v in bob's read-only driver", bob.driver.files)
+	}
+
+	auth.RemoveUser("alice")
+	c = dialTestServer(t, s)
+	expect(t, c, 331, "USER alice")
+	expect(t, c, 530, "PASS secret")
+}
+
+func TestUserHome(t *testing.T) {
+	factory := newTestDriverFactory()
+	driver := factory.driver
+	for _, dir := range []string{"/home", "/home/alice", "/home/alice/docs", "/home/bob"} {
+		driver.dirs[dir] = true
+	}
+	driver.files["/home/alice/a.txt"] = []byte("alice's")
+	driver.files["/home/bob/b.txt"] = []byte("bob's")
+	auth := &MultiUserAuth{}
+	auth.AddUser("alice", "secret", factory, UserPermissions{Home: "/home/alice"})
+	auth.AddUser("bob", "hunter2", factory, UserPermissions{Home: "home/bob/"})
+	s, _ := newTestServer(t, &ServerOpts{Auth: auth})
+
+	alice := dialTestServer(t, s)
+	expect(t, alice, 331, "USER alice")
+	expect(t, alice, 230, "PASS secret")
+	bob := dialTestServer(t, s)
+	expect(t, bob, 331, "USER bob")
+	expect(t, bob, 230, "PASS hunter2")
+
+	for _, c := range []*textproto.Conn{alice, bob} {
+		if msg := expect(t, c, 257, "PWD"); msg != `"/" is the current directory` {
+			t.Errorf("got %q", msg)
+		}
+	}
+	if got := download(t, alice, "NLST"); got != "a.txt\r\ndocs\r\n" {
+		t.Errorf("alice: got listing %q", got)
+	}
+	if got := download(t, bob, "NLST"); got != "b.txt\r\n" {
+		t.Errorf("bob: got listing %q", got)
+	}
+	expect(t, bob, 550, "SIZE ../alice/a.txt")
+
+	// CDUP stops at the home directory.
+	expect(t, alice, 250, "CWD docs")
+	expect(t, alice, 250, "CDUP")
+	expect(t, alice, 250, "CDUP")
+	if msg := expect(t, alice, 257, "PWD"); msg != `"/" is the current directory` {
+		t.Errorf("got %q after CDUP at home", msg)
+	}
+	if got := download(t, alice, "RETR a.txt"); got != "alice's" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// messageAuth is a SimpleAuth greeting its user with a message.
+type messageAuth struct {
+	SimpleAuth
+	message string
+}
+
+func (a *messageAuth) LoginMessage(user string) string {
+	return a.message
+}
+
+func TestLoginMessageAuth(t *testing.T) {
+	for _, tt := range []struct{ message, want string }{
+		{"", "230 Password ok, continue\r\n"},
+		{"Hello admin", "230 Hello admin\r\n"},
+		{"Hello admin\nYou have 3 new files", "230-Hello admin\r\n230 You have 3 new files\r\n"},
+	} {
+		s, _ := newTestServer(t, &ServerOpts{Auth: &messageAuth{SimpleAuth{Name: "admin", Password: "admin"}, tt.message}})
+		c := dialTestServer(t, s)
+		expect(t, c, 331, "USER admin")
+		if _, err := c.Cmd("PASS admin"); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(tt.want))
+		if _, err := io.ReadFull(c.R, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+// certAuth is a SimpleAuth logging in alice by her certificate.
+type certAuth struct {
+	SimpleAuth
+	alice  *x509.Certificate
+	driver Driver
+}
+
+func (a *certAuth) CertUser(cert *x509.Certificate) (string, Driver, error) {
+	if cert.Equal(a.alice) {
+		return "alice", a.driver, nil
+	}
+	return "", nil, nil
+}
+
+// testClientCert returns a certificate from testCertFiles for clients.
+func testClientCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	cert, err := tls.LoadX509KeyPair(testCertFiles(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, leaf
+}
+
+func TestCertAuth(t *testing.T) {
+	alice, aliceLeaf := testClientCert(t)
+	unknown, unknownLeaf := testClientCert(t)
+	// both are trusted, only alice's is mapped to a user
+	config := testTLSConfig(t)
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	config.ClientCAs = x509.NewCertPool()
+	config.ClientCAs.AddCert(aliceLeaf)
+	config.ClientCAs.AddCert(unknownLeaf)
+
+	aliceDriver := newTestDriverFactory().driver
+	aliceDriver.files["/alice.txt"] = []byte("alice's")
+	auth := &certAuth{SimpleAuth{Name: "admin", Password: "admin"}, aliceLeaf, aliceDriver}
+	s, _ := newTestServer(t, &ServerOpts{Auth: auth, TLS: true, ExplicitFTPS: true, TLSConfig: config})
+	dial := func(certs ...tls.Certificate) *textproto.Conn {
+		return dialAuthTLS(t, s, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+	}
+
+	// The user of a mapped certificate is logged in without a password.
+	c := dial(alice)
+	expect(t, c, 331, "USER bob")
+	expect(t, c, 232, "USER alice")
+	if got := download(t, c, "RETR /alice.txt"); got != "alice's" {
+		t.Errorf("got %q from the driver of the certificate", got)
+	}
+	if conns := s.ActiveConns(); len(conns) != 1 || conns[0].User != "alice" {
+		t.Errorf("got connections %+v, want alice's", conns)
+	}
+	// After REIN, a password login no longer uses her driver.
+	expect(t, c, 220, "REIN")
+	login(t, c)
+	expect(t, c, 550, "SIZE /alice.txt")
+	c.Close()
+
+	// Others log in with a password.
+	for _, certs := range [][]tls.Certificate{{unknown}, nil} {
+		c := dial(certs...)
+		expect(t, c, 331, "USER alice")
+		expect(t, c, 530, "PASS alice")
+		login(t, c)
+		expect(t, c, 550, "SIZE /alice.txt")
+		c.Close()
+	}
+
+	// Without TLS there is no certificate.
+	c = dialTestServer(t, s)
+	expect(t, c, 331, "USER alice")
+}
@@ -0,0 +1,40 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	// minAcceptBackoff and maxAcceptBackoff bound how long the accept loop
+	// waits after a temporary error, like running out of file descriptors.
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// setBacklog changes the length of the queue of pending connections of l,
+// which must already be listening. Listeners without a socket are left
+// alone.
+func setBacklog(l net.Listener, backlog int) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = raw.Control(func(fd uintptr) {
+		listenErr = relisten(fd, backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
@@ -0,0 +1,17 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package server
+
+// backlogSupported tells whether ListenBacklog has an effect on this
+// platform.
+const backlogSupported = false
+
+// relisten does nothing, as the backlog can't be changed on this platform.
+func relisten(fd uintptr, backlog int) error {
+	return nil
+}
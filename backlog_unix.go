@@ -0,0 +1,20 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package server
+
+import "syscall"
+
+// backlogSupported tells whether ListenBacklog has an effect on this
+// platform.
+const backlogSupported = true
+
+// relisten calls listen again on the listening socket fd, which updates
+// its backlog.
+func relisten(fd uintptr, backlog int) error {
+	return syscall.Listen(int(fd), backlog)
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// cccCloseTimeout is how long CCC waits for the client to end TLS.
+const cccCloseTimeout = 10 * time.Second
+
+// tlsRecordConn is the connection under the TLS of a control connection
+// that may be cleared by CCC. Its reads never go past the end of a TLS
+// record, so the cleartext following the client's close_notify isn't
+// swallowed by the tls.Conn.
+type tlsRecordConn struct {
+	net.Conn
+	header    [5]byte
+	headerLen int // bytes of the header of the next record read so far
+	remaining int // bytes of the current record left to read
+}
+
+func (conn *tlsRecordConn) Read(p []byte) (int, error) {
+	if conn.remaining == 0 {
+		if len(p) > len(conn.header)-conn.headerLen {
+			p = p[:len(conn.header)-conn.headerLen]
+		}
+		n, err := conn.Conn.Read(p)
+		copy(conn.header[conn.headerLen:], p[:n])
+		if conn.headerLen += n; conn.headerLen == len(conn.header) {
+			conn.headerLen = 0
+			conn.remaining = int(binary.BigEndian.Uint16(conn.header[3:]))
+		}
+		return n, err
+	}
+	if len(p) > conn.remaining {
+		p = p[:conn.remaining]
+	}
+	n, err := conn.Conn.Read(p)
+	conn.remaining -= n
+	return n, err
+}
+
+// clearControlTLS ends TLS on the control connection for CCC, which then
+// continues in the clear on the underlying connection.
+func (conn *Conn) clearControlTLS() error {
+	tlsConn, ok := conn.conn.(*tls.Conn)
+	if !ok {
+		return errors.New("ftp: control connection is not protected")
+	}
+	records, ok := tlsConn.NetConn().(*tlsRecordConn)
+	if !ok {
+		return errors.New("ftp: control connection was protected before CCC was allowed")
+	}
+	if err := tlsConn.CloseWrite(); err != nil {
+		return err
+	}
+	// wait for the client's close_notify, after which it talks in the clear
+	tlsConn.SetReadDeadline(time.Now().Add(cccCloseTimeout))
+	_, err := io.Copy(io.Discard, conn.controlReader)
+	tlsConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	records.Conn.SetWriteDeadline(time.Time{}) // left expired by CloseWrite
+	conn.conn = records.Conn
+	conn.controlReader = bufio.NewReader(records.Conn)
+	conn.controlWriter = bufio.NewWriter(records.Conn)
+	return nil
+}
@@ -5,10 +5,18 @@
 package server
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Command interface {
@@ -22,6 +30,7 @@ type commandMap map[string]Command
 
 var (
 	commands = commandMap{
+		"ABOR": commandAbor{},
 		"ADAT": commandAdat{},
 		"ALLO": commandAllo{},
 		"APPE": commandAppe{},
@@ -35,11 +44,15 @@ var (
 		"EPRT": commandEprt{},
 		"EPSV": commandEpsv{},
 		"FEAT": commandFeat{},
+		"HASH": commandHash{},
 		"LIST": commandList{},
 		"NLST": commandNlst{},
 		"MDTM": commandMdtm{},
+		"MFMT": commandMfmt{},
 		"MIC":  commandMic{},
 		"MKD":  commandMkd{},
+		"MLSD": commandMlsd{},
+		"MLST": commandMlst{},
 		"MODE": commandMode{},
 		"NOOP": commandNoop{},
 		"OPTS": commandOpts{},
@@ -50,13 +63,18 @@ var (
 		"PROT": commandProt{},
 		"PWD":  commandPwd{},
 		"QUIT": commandQuit{},
+		"REIN": commandRein{},
 		"RETR": commandRetr{},
+		"RANG": commandRang{},
 		"REST": commandRest{},
 		"RNFR": commandRnfr{},
 		"RNTO": commandRnto{},
 		"RMD":  commandRmd{},
+		"SITE": commandSite{},
 		"SIZE": commandSize{},
+		"STAT": commandStat{},
 		"STOR": commandStor{},
+		"STOU": commandStou{},
 		"STRU": commandStru{},
 		"SYST": commandSyst{},
 		"TYPE": commandType{},
@@ -66,12 +84,66 @@ var (
 		"XPWD": commandPwd{},
 		"XRMD": commandRmd{},
 	}
+
+	// restartKeepingCommands may come between REST and the transfer it is
+	// for. Any other command clears the restart offset.
+	restartKeepingCommands = map[string]bool{
+		"EPRT": true,
+		"EPSV": true,
+		"PASV": true,
+		"PORT": true,
+		"REST": true,
+		"TYPE": true,
+	}
+
+	// activeCommands and passiveCommands open data connections, and are
+	// refused according to the DataConnMode.
+	activeCommands  = map[string]bool{"PORT": true, "EPRT": true}
+	passiveCommands = map[string]bool{"PASV": true, "EPSV": true}
+
+	// mutatingCommands are refused by a ReadOnly server.
+	mutatingCommands = map[string]bool{
+		"APPE": true,
+		"DELE": true,
+		"MFMT": true,
+		"MKD":  true,
+		"RMD":  true,
+		"RNFR": true,
+		"RNTO": true,
+		"STOR": true,
+		"STOU": true,
+		"XRMD": true,
+	}
 )
 
+// commandAbor responds to the ABOR FTP command. A transfer in progress has
+// already been aborted when the command was read, so all that is left to do
+// is closing the data connection.
+type commandAbor struct{}
+
+func (cmd commandAbor) IsExtend() bool {
+	return false
+}
+
+func (cmd commandAbor) RequireParam() bool {
+	return false
+}
+
+func (cmd commandAbor) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandAbor) Execute(conn *Conn, param string) {
+	conn.abortTransfer()
+	conn.closeDataConn()
+	conn.writeMessage(226, "ABOR command successful")
+}
+
 // commandAllo responds to the ALLO FTP command.
 //
-// This is essentially a ping from the client so we just respond with an
-// basic OK message.
+// Clients send it with the size of an upload to reserve space. There is
+// nothing to reserve, but if the Quota or a FreeSpaceDriver tell there is
+// no room for the upload it is refused right away.
 type commandAllo struct{}
 
 func (cmd commandAllo) IsExtend() bool {
@@ -87,9 +159,54 @@ func (cmd commandAllo) RequireAuth() bool {
 }
 
 func (cmd commandAllo) Execute(conn *Conn, param string) {
-	conn.writeMessage(202, "Obsolete")
+	freeSpaceDriver, hasFreeSpace := conn.driver.(FreeSpaceDriver)
+	if !conn.IsLogin() || (conn.server.Quota == nil && !hasFreeSpace) {
+		conn.writeMessage(202, "No storage allocation necessary")
+		return
+	}
+	// the size may be followed by a record size, "R <size>"
+	fields := strings.Fields(param)
+	if len(fields) == 0 {
+		conn.writeMessage(501, "Missing size")
+		return
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		conn.writeMessage(501, "Invalid size")
+		return
+	}
+
+	if quota := conn.server.Quota; quota != nil {
+		if limit := quota.Limit(conn.user); limit > 0 {
+			usage, err := quota.GetUsage(conn.user)
+			if err != nil {
+				conn.logger.Errorf(conn.sessionID, "Unable to get quota usage: %v", err)
+				conn.writeMessage(451, "Unable to check storage space")
+				return
+			}
+			if size > limit-usage {
+				conn.writeMessage(552, "Quota exceeded")
+				return
+			}
+		}
+	}
+	if hasFreeSpace {
+		free, err := freeSpaceDriver.FreeSpace(conn.buildPath(""))
+		if err != nil {
+			conn.logger.Errorf(conn.sessionID, "Unable to get free space: %v", err)
+			conn.writeMessage(451, "Unable to check storage space")
+			return
+		}
+		if size > free {
+			conn.writeMessage(552, "Insufficient storage space")
+			return
+		}
+	}
+	conn.writeMessage(200, "Storage space available")
 }
 
+// commandAppe responds to the APPE FTP command. It allows the user to upload
+// data to the end of a file, creating it if it doesn't exist.
 type commandAppe struct{}
 
 func (cmd commandAppe) IsExtend() bool {
@@ -97,7 +214,7 @@ func (cmd commandAppe) IsExtend() bool {
 }
 
 func (cmd commandAppe) RequireParam() bool {
-	return false
+	return true
 }
 
 func (cmd commandAppe) RequireAuth() bool {
@@ -105,8 +222,16 @@ func (cmd commandAppe) RequireAuth() bool {
 }
 
 func (cmd commandAppe) Execute(conn *Conn, param string) {
+	targetPath := conn.buildPath(param)
 	conn.appendData = true
-	conn.writeMessage(202, "Obsolete")
+	conn.lastFilePos = 0
+	defer func() {
+		conn.appendData = false
+	}()
+
+	if bytes, ok := conn.receiveFile(targetPath, "Data transfer starting"); ok {
+		conn.writeMessage(226, "OK, received "+strconv.Itoa(int(bytes))+" bytes")
+	}
 }
 
 type commandOpts struct{}
@@ -125,6 +250,32 @@ func (cmd commandOpts) RequireAuth() bool {
 
 func (cmd commandOpts) Execute(conn *Conn, param string) {
 	parts := strings.Fields(param)
+	if len(parts) > 0 && strings.ToUpper(parts[0]) == "HASH" {
+		if len(parts) > 1 {
+			name, _, ok := hashAlgorithm(parts[1])
+			if !ok {
+				conn.writeMessage(504, "Unknown hash algorithm")
+				return
+			}
+			conn.hashAlgorithm = name
+		}
+		conn.writeMessage(200, conn.hashAlgorithm)
+		return
+	}
+	if len(parts) > 0 && strings.ToUpper(parts[0]) == "MLST" {
+		var requested string
+		if len(parts) > 1 {
+			requested = parts[1]
+		}
+		conn.mlstFacts = parseMlstFacts(requested)
+		msg := "MLST OPTS"
+		if len(conn.mlstFacts) > 0 {
+			msg += " " + strings.Join(conn.mlstFacts, ";") + ";"
+		}
+		conn.writeMessage(200, msg)
+		return
+	}
+
 	if len(parts) != 2 {
 		conn.writeMessage(550, "Unknow params")
 		return
@@ -135,6 +286,7 @@ func (cmd commandOpts) Execute(conn *Conn, param string) {
 	}
 
 	if strings.ToUpper(parts[1]) == "ON" {
+		conn.utf8 = true
 		conn.writeMessage(200, "UTF8 mode enabled")
 	} else {
 		conn.writeMessage(550, "Unsupported non-utf8 mode")
@@ -157,22 +309,54 @@ func (cmd commandFeat) RequireAuth() bool {
 
 var (
 	feats    = "Extensions supported:\n%s"
-	featCmds = ""
+	featCmds []string // the extended commands, sorted
 )
 
 func init() {
 	for k, v := range commands {
 		if v.IsExtend() {
-			featCmds = featCmds + " " + k + "\n"
+			featCmds = append(featCmds, k)
 		}
 	}
+	sort.Strings(featCmds)
 }
 
 func (cmd commandFeat) Execute(conn *Conn, param string) {
-	if conn.tlsConfig != nil {
-		featCmds += " AUTH TLS\n PBSZ\n PROT\n"
+	conn.writeMessageMultiline(211, fmt.Sprintf(feats, conn.features()))
+}
+
+// features returns the FEAT lines of the extensions available on conn, which
+// depend on the server options and the driver.
+func (conn *Conn) features() string {
+	var feat string
+	if conn.tlsConfig != nil && !conn.isDisabled("AUTH") {
+		feat += " AUTH TLS\n PBSZ\n PROT\n"
+	}
+	for _, name := range featCmds {
+		if conn.isDisabled(name) || conn.dataConnModeRefusal(name) != "" {
+			continue
+		}
+		if name == "MFMT" {
+			if _, ok := conn.driver.(ChtimesDriver); !ok {
+				continue
+			}
+		}
+		feat += " " + name + "\n"
+	}
+	if !conn.isDisabled("HASH") {
+		feat += hashFeature(conn.hashAlgorithm)
+	}
+	if !conn.isDisabled("MLST") {
+		feat += mlstFeature(conn.mlstFacts)
 	}
-	conn.writeMessageMultiline(211, fmt.Sprintf(feats, featCmds))
+	if !conn.isDisabled("MODE") {
+		feat += " MODE Z\n"
+	}
+	if !conn.isDisabled("REST") {
+		feat += " REST STREAM\n"
+	}
+	feat += " UTF8\n"
+	return feat
 }
 
 // cmdCdup responds to the CDUP FTP command.
@@ -214,13 +398,13 @@ func (cmd commandCwd) RequireAuth() bool {
 }
 
 func (cmd commandCwd) Execute(conn *Conn, param string) {
-	path := conn.buildPath(param)
-	err := conn.driver.ChangeDir(path)
+	path := conn.virtualPath(param)
+	err := conn.driver.ChangeDir(conn.rootPath(path))
 	if err == nil {
 		conn.namePrefix = path
 		conn.writeMessage(250, "Directory changed to "+path)
 	} else {
-		conn.writeMessage(550, fmt.Sprintln("Directory change to", path, "failed:", err))
+		conn.writeMessage(fileErrorReply(err, 550, "Directory change to "+path+" failed"))
 	}
 }
 
@@ -243,10 +427,11 @@ func (cmd commandDele) RequireAuth() bool {
 func (cmd commandDele) Execute(conn *Conn, param string) {
 	path := conn.buildPath(param)
 	err := conn.driver.DeleteFile(path)
+	conn.audit(AuditEvent{Action: AuditDelete, Target: path, Err: err})
 	if err == nil {
 		conn.writeMessage(250, "File deleted")
 	} else {
-		conn.writeMessage(550, fmt.Sprintln("File delete failed:", err))
+		conn.writeMessage(fileErrorReply(err, 550, "File delete failed"))
 	}
 }
 
@@ -268,27 +453,77 @@ func (cmd commandEprt) RequireAuth() bool {
 }
 
 func (cmd commandEprt) Execute(conn *Conn, param string) {
-	delim := string(param[0:1])
-	parts := strings.Split(param, delim)
-	addressFamily, err := strconv.Atoi(parts[1])
-	host := parts[2]
-	port, err := strconv.Atoi(parts[3])
-	if addressFamily != 1 && addressFamily != 2 {
+	network, host, port, err := parseEprtParam(param)
+	if err == errEprtProtocol {
 		conn.writeMessage(522, "Network protocol not supported, use (1,2)")
 		return
+	} else if err != nil {
+		conn.writeMessage(501, "Invalid EPRT argument")
+		return
 	}
-	socket, err := newActiveSocket(host, port, conn.logger, conn.sessionID)
+	socket, err := newActiveSocket(conn.dataContext(), network, host, port, conn.dataDialer(), conn.server.DataConnTimeout, conn.logger, conn.sessionID, conn.dataTLSConfig(), conn.server.Metrics)
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
 		return
 	}
-	conn.dataConn = socket
+	conn.setDataConn(socket)
 	conn.writeMessage(200, "Connection established ("+strconv.Itoa(port)+")")
 }
 
+// errEprtProtocol is returned by parseEprtParam for EPRT arguments of an
+// unsupported network protocol, or with an address of another protocol.
+var errEprtProtocol = errors.New("ftp: unsupported EPRT address")
+
+// parseEprtParam parses the argument of EPRT, like |2|::1|6275|, into the
+// network to dial, the host and the port.
+func parseEprtParam(param string) (network, host string, port int, err error) {
+	if len(param) == 0 || param[0] < 33 || param[0] > 126 {
+		return "", "", 0, errors.New("ftp: invalid EPRT delimiter")
+	}
+	parts := strings.Split(param, param[0:1])
+	if len(parts) != 5 || parts[0] != "" || parts[4] != "" {
+		return "", "", 0, errors.New("ftp: malformed EPRT argument")
+	}
+
+	ip := net.ParseIP(parts[2])
+	switch {
+	case parts[1] == "1" && ip != nil && ip.To4() != nil:
+		network = "tcp4"
+	case parts[1] == "2" && ip != nil && ip.To4() == nil:
+		network = "tcp6"
+	case ip == nil:
+		return "", "", 0, errors.New("ftp: invalid EPRT address")
+	default:
+		return "", "", 0, errEprtProtocol
+	}
+
+	port, ok := parseDecimal(parts[3], 65535)
+	if !ok || port < 1 {
+		return "", "", 0, errors.New("ftp: invalid EPRT port")
+	}
+	return network, ip.String(), port, nil
+}
+
+// parseDecimal parses s, made of decimal digits only, as a number up to
+// max.
+func parseDecimal(s string, max int) (int, bool) {
+	if len(s) == 0 || len(s) > 5 {
+		return 0, false
+	}
+	n := 0
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, n <= max
+}
+
 // commandEpsv responds to the EPSV FTP command. It allows the client to
 // request a passive data socket with more options than the original PASV
-// command. It mainly adds ipv6 support, although we don't support that yet.
+// command. It mainly adds ipv6 support, as the reply only carries the port
+// and the client connects to the address of the control connection.
 type commandEpsv struct{}
 
 func (cmd commandEpsv) IsExtend() bool {
@@ -304,24 +539,91 @@ func (cmd commandEpsv) RequireAuth() bool {
 }
 
 func (cmd commandEpsv) Execute(conn *Conn, param string) {
-	addr := conn.passiveListenIP()
-	lastIdx := strings.LastIndex(addr, ":")
-	if lastIdx <= 0 {
-		conn.writeMessage(425, "Data connection failed")
+	// only the address family of the control connection is supported
+	network := conn.dataNetwork()
+	protocol := "1"
+	if network == "tcp6" {
+		protocol = "2"
+	}
+	switch strings.ToUpper(param) {
+	case "", protocol:
+	case "ALL":
+		conn.epsvAll = true
+		conn.writeMessage(200, "EPSV ALL command successful")
+		return
+	default:
+		conn.writeMessage(522, "Network protocol not supported, use ("+protocol+")")
 		return
 	}
 
-	socket, err := newPassiveSocket(addr[:lastIdx], conn.PassivePort(), conn.logger, conn.sessionID, conn.tlsConfig)
+	socket, err := newPassiveSocket(conn.dataContext(), network, conn.passiveListenIP(), conn.passiveBindHost(network), conn.passivePeerIP(), conn.server.passivePorts, conn.server.PassiveAcceptTimeout, conn.server.DataConnTimeout, conn.server.KeepAlivePeriod, conn.server.DataDSCP, conn.server.PassiveBindRetries, conn.logger, conn.sessionID, conn.dataTLSConfig(), conn.server.Metrics)
 	if err != nil {
-		log.Println(err)
+		conn.logger.Errorf(conn.sessionID, "Unable to open a passive data connection: %v", err)
 		conn.writeMessage(425, "Data connection failed")
 		return
 	}
-	conn.dataConn = socket
+	conn.setDataConn(socket)
 	msg := fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", socket.Port())
 	conn.writeMessage(229, msg)
 }
 
+// commandHash responds to the HASH FTP command. It allows the client to
+// verify a transfer by retreiving the digest of a file, or of the byte range
+// set by RANG, computed with the algorithm selected by OPTS HASH.
+type commandHash struct{}
+
+func (cmd commandHash) IsExtend() bool {
+	// listed in FEAT with its algorithms by hashFeature
+	return false
+}
+
+func (cmd commandHash) RequireParam() bool {
+	return true
+}
+
+func (cmd commandHash) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandHash) Execute(conn *Conn, param string) {
+	start, end := conn.rangeStart, conn.rangeEnd
+	conn.rangeStart, conn.rangeEnd = 0, -1
+
+	path := conn.buildPath(param)
+	info, err := conn.driver.Stat(path)
+	if err != nil || info.IsDir() {
+		conn.writeMessage(550, "File not available")
+		return
+	}
+	if start > info.Size() {
+		conn.writeMessage(556, "Invalid byte range")
+		return
+	}
+
+	_, data, err := conn.driver.GetFile(path, start)
+	if err != nil {
+		conn.writeMessage(550, "File not available")
+		return
+	}
+	defer data.Close()
+
+	n := int64(-1)
+	if end >= 0 {
+		n = end - start + 1
+	}
+	name, newHash, _ := hashAlgorithm(conn.hashAlgorithm)
+	digest, hashed, err := hashReader(newHash, data, n)
+	if err != nil {
+		conn.writeMessage(451, "Error reading file")
+		return
+	}
+	last := start + hashed - 1
+	if hashed == 0 {
+		last = start
+	}
+	conn.writeMessage(213, fmt.Sprintf("%s %d-%d %s %s", name, start, last, digest, param))
+}
+
 // commandList responds to the LIST FTP command. It allows the client to retreive
 // a detailed listing of the contents of a directory.
 type commandList struct{}
@@ -342,26 +644,19 @@ func (cmd commandList) Execute(conn *Conn, param string) {
 	path := conn.buildPath(parseListParam(param))
 	info, err := conn.driver.Stat(path)
 	if err != nil {
-		conn.writeMessage(550, err.Error())
+		conn.writeMessage(fileErrorReply(err, 550, "File not available"))
 		return
 	}
 
 	if info == nil || !info.IsDir() {
-		conn.logger.Printf(conn.sessionID, "%s is not a dir.\n", path)
+		conn.logger.Debugf(conn.sessionID, "%s is not a dir.", path)
 		return
 	}
-	var files []FileInfo
-	err = conn.driver.ListDir(path, func(f FileInfo) error {
-		files = append(files, f)
-		return nil
-	})
-	if err != nil {
-		conn.writeMessage(550, err.Error())
+
+	if conn.startTransfer("Opening ASCII mode data connection for file list") != nil {
 		return
 	}
-
-	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
-	conn.sendOutofbandData(listFormatter(files).Detailed())
+	conn.sendListing(path, detailedEntry)
 }
 
 func parseListParam(param string) (path string) {
@@ -401,7 +696,7 @@ func (cmd commandNlst) Execute(conn *Conn, param string) {
 	path := conn.buildPath(parseListParam(param))
 	info, err := conn.driver.Stat(path)
 	if err != nil {
-		conn.writeMessage(550, err.Error())
+		conn.writeMessage(fileErrorReply(err, 550, "File not available"))
 		return
 	}
 	if !info.IsDir() {
@@ -409,17 +704,72 @@ func (cmd commandNlst) Execute(conn *Conn, param string) {
 		return
 	}
 
-	var files []FileInfo
-	err = conn.driver.ListDir(path, func(f FileInfo) error {
-		files = append(files, f)
-		return nil
-	})
+	if conn.startTransfer("Opening ASCII mode data connection for file list") != nil {
+		return
+	}
+	conn.sendListing(path, shortEntry)
+}
+
+// commandMlsd responds to the MLSD FTP command. It allows the client to
+// retreive a machine-readable listing of a directory, as per RFC 3659.
+type commandMlsd struct{}
+
+func (cmd commandMlsd) IsExtend() bool {
+	return true
+}
+
+func (cmd commandMlsd) RequireParam() bool {
+	return false
+}
+
+func (cmd commandMlsd) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMlsd) Execute(conn *Conn, param string) {
+	path := conn.buildPath(param)
+	info, err := conn.driver.Stat(path)
 	if err != nil {
-		conn.writeMessage(550, err.Error())
+		conn.writeMessage(fileErrorReply(err, 550, "File not available"))
+		return
+	}
+	if !info.IsDir() {
+		conn.writeMessage(501, param+" is not a directory")
+		return
+	}
+
+	if conn.startTransfer("Opening ASCII mode data connection for file list") != nil {
 		return
 	}
-	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
-	conn.sendOutofbandData(listFormatter(files).Short())
+	conn.sendListing(path, mlsdEntry(conn.mlstFacts))
+}
+
+// commandMlst responds to the MLST FTP command. It allows the client to
+// retreive the facts of a single file or directory on the control
+// connection, in the format of MLSD.
+type commandMlst struct{}
+
+func (cmd commandMlst) IsExtend() bool {
+	// listed in FEAT with its facts by mlstFeature
+	return false
+}
+
+func (cmd commandMlst) RequireParam() bool {
+	return false
+}
+
+func (cmd commandMlst) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMlst) Execute(conn *Conn, param string) {
+	path := conn.virtualPath(param)
+	info, err := conn.driver.Stat(conn.rootPath(path))
+	if err != nil {
+		conn.writeMessage(550, "File not available")
+		return
+	}
+	conn.writeMessageMultiline(250, "Listing "+path+"\r\n "+mlstEntry(info, conn.mlstFacts)+" "+path)
 }
 
 // commandMdtm responds to the MDTM FTP command. It allows the client to
@@ -427,7 +777,7 @@ func (cmd commandNlst) Execute(conn *Conn, param string) {
 type commandMdtm struct{}
 
 func (cmd commandMdtm) IsExtend() bool {
-	return false
+	return true
 }
 
 func (cmd commandMdtm) RequireParam() bool {
@@ -442,12 +792,53 @@ func (cmd commandMdtm) Execute(conn *Conn, param string) {
 	path := conn.buildPath(param)
 	stat, err := conn.driver.Stat(path)
 	if err == nil {
-		conn.writeMessage(213, stat.ModTime().Format("20060102150405"))
+		conn.writeMessage(213, stat.ModTime().UTC().Format("20060102150405"))
 	} else {
-		conn.writeMessage(450, "File not available")
+		conn.writeMessage(550, "File not available")
 	}
 }
 
+// commandMfmt responds to the MFMT FTP command. It allows the client to set
+// the last modified time of a file, given as YYYYMMDDHHMMSS in UTC.
+type commandMfmt struct{}
+
+func (cmd commandMfmt) IsExtend() bool {
+	return true
+}
+
+func (cmd commandMfmt) RequireParam() bool {
+	return true
+}
+
+func (cmd commandMfmt) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMfmt) Execute(conn *Conn, param string) {
+	parts := strings.SplitN(param, " ", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		conn.writeMessage(501, "Syntax error in parameters")
+		return
+	}
+	mtime, err := time.ParseInLocation("20060102150405", parts[0], time.UTC)
+	if err != nil {
+		conn.writeMessage(501, "Invalid timestamp")
+		return
+	}
+	driver, ok := conn.driver.(ChtimesDriver)
+	if !ok {
+		conn.writeMessage(502, "Command not implemented")
+		return
+	}
+
+	path := conn.virtualPath(strings.TrimSpace(parts[1]))
+	if err := driver.Chtimes(conn.rootPath(path), mtime); err != nil {
+		conn.writeMessage(550, "Action not taken")
+		return
+	}
+	conn.writeMessage(213, "Modify="+mtime.Format("20060102150405")+"; "+path)
+}
+
 // commandMkd responds to the MKD FTP command. It allows the client to create
 // a new directory
 type commandMkd struct{}
@@ -467,10 +858,11 @@ func (cmd commandMkd) RequireAuth() bool {
 func (cmd commandMkd) Execute(conn *Conn, param string) {
 	path := conn.buildPath(param)
 	err := conn.driver.MakeDir(path)
+	conn.audit(AuditEvent{Action: AuditMakeDir, Target: path, Err: err})
 	if err == nil {
 		conn.writeMessage(257, "Directory created")
 	} else {
-		conn.writeMessage(550, fmt.Sprintln("Action not taken:", err))
+		conn.writeMessage(fileErrorReply(err, 550, "Action not taken"))
 	}
 }
 
@@ -479,7 +871,8 @@ func (cmd commandMkd) Execute(conn *Conn, param string) {
 // the original FTP spec had various options for hosts to negotiate how data
 // would be sent over the data socket, In reality these days (S)tream mode
 // is all that is used for the mode - data is just streamed down the data
-// socket unchanged.
+// socket unchanged. The exception is MODE Z, which deflates the stream for
+// slow links.
 type commandMode struct{}
 
 func (cmd commandMode) IsExtend() bool {
@@ -495,9 +888,14 @@ func (cmd commandMode) RequireAuth() bool {
 }
 
 func (cmd commandMode) Execute(conn *Conn, param string) {
-	if strings.ToUpper(param) == "S" {
+	switch strings.ToUpper(param) {
+	case "S":
+		conn.deflate = false
 		conn.writeMessage(200, "OK")
-	} else {
+	case "Z":
+		conn.deflate = true
+		conn.writeMessage(200, "OK")
+	default:
 		conn.writeMessage(504, "MODE is an obsolete command")
 	}
 }
@@ -541,17 +939,57 @@ func (cmd commandPass) RequireAuth() bool {
 }
 
 func (cmd commandPass) Execute(conn *Conn, param string) {
+	ip := remoteIP(conn.conn)
+	if conn.server.loginFailures.locked(ip) {
+		conn.logger.Warnf(conn.sessionID, "Refusing login of %s from locked out %s", conn.reqUser, ip)
+		conn.audit(AuditEvent{Action: AuditLogin, User: conn.reqUser, Err: errAuditLocked})
+		conn.writeMessage(530, "Too many failed logins, try again later")
+		return
+	}
 	ok, err := conn.server.Auth.CheckPasswd(conn.reqUser, param)
 	if err != nil {
+		conn.audit(AuditEvent{Action: AuditLogin, User: conn.reqUser, Err: err})
 		conn.writeMessage(550, "Checking password error")
 		return
 	}
 
 	if ok {
+		if err := conn.setRoot(conn.reqUser); err != nil {
+			conn.logger.Errorf(conn.sessionID, "Unable to find the root of %s: %v", conn.reqUser, err)
+			conn.audit(AuditEvent{Action: AuditLogin, User: conn.reqUser, Err: err})
+			conn.writeMessage(530, "Not logged in")
+			return
+		}
+		if err := conn.startUserSession(conn.reqUser); err != nil {
+			conn.logger.Errorf(conn.sessionID, "Unable to start the session of %s: %v", conn.reqUser, err)
+			conn.audit(AuditEvent{Action: AuditLogin, User: conn.reqUser, Err: err})
+			conn.writeMessage(530, "Not logged in")
+			return
+		}
+		conn.server.loginFailures.succeed(ip)
 		conn.user = conn.reqUser
 		conn.reqUser = ""
-		conn.writeMessage(230, "Password ok, continue")
+		conn.audit(AuditEvent{Action: AuditLogin})
+		msg := "Password ok, continue"
+		if messageAuth, ok := conn.server.Auth.(LoginMessageAuth); ok {
+			if m := messageAuth.LoginMessage(conn.user); m != "" {
+				msg = m
+			}
+		}
+		conn.writeMessage(230, msg)
 	} else {
+		conn.audit(AuditEvent{Action: AuditLogin, User: conn.reqUser, Err: errAuditPassword})
+		server := conn.server
+		delay := server.loginFailures.fail(ip, server.LoginDelay, server.MaxLoginFailures, server.LoginFailureWindow, server.LoginLockout)
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-conn.ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
 		conn.writeMessage(530, "Incorrect password, not logged in")
 	}
 }
@@ -575,21 +1013,26 @@ func (cmd commandPasv) RequireAuth() bool {
 }
 
 func (cmd commandPasv) Execute(conn *Conn, param string) {
-	listenIP := conn.passiveListenIP()
-	lastIdx := strings.LastIndex(listenIP, ":")
-	if lastIdx <= 0 {
+	ip := net.ParseIP(conn.passiveListenIP())
+	if ip == nil {
 		conn.writeMessage(425, "Data connection failed")
 		return
 	}
-	socket, err := newPassiveSocket(listenIP[:lastIdx], conn.PassivePort(), conn.logger, conn.sessionID, conn.tlsConfig)
+	if ip.To4() == nil {
+		// the 227 reply can only hold an IPv4 address
+		conn.writeMessage(522, "PASV is only available over IPv4, use EPSV")
+		return
+	}
+	socket, err := newPassiveSocket(conn.dataContext(), "tcp4", ip.To4().String(), conn.passiveBindHost("tcp4"), conn.passivePeerIP(), conn.server.passivePorts, conn.server.PassiveAcceptTimeout, conn.server.DataConnTimeout, conn.server.KeepAlivePeriod, conn.server.DataDSCP, conn.server.PassiveBindRetries, conn.logger, conn.sessionID, conn.dataTLSConfig(), conn.server.Metrics)
 	if err != nil {
+		conn.logger.Errorf(conn.sessionID, "Unable to open a passive data connection: %v", err)
 		conn.writeMessage(425, "Data connection failed")
 		return
 	}
-	conn.dataConn = socket
+	conn.setDataConn(socket)
 	p1 := socket.Port() / 256
 	p2 := socket.Port() - (p1 * 256)
-	quads := strings.Split(listenIP[:lastIdx], ".")
+	quads := strings.Split(socket.Host(), ".")
 	target := fmt.Sprintf("(%s,%s,%s,%s,%d,%d)", quads[0], quads[1], quads[2], quads[3], p1, p2)
 	msg := "Entering Passive Mode " + target
 	conn.writeMessage(227, msg)
@@ -614,20 +1057,42 @@ func (cmd commandPort) RequireAuth() bool {
 }
 
 func (cmd commandPort) Execute(conn *Conn, param string) {
-	nums := strings.Split(param, ",")
-	portOne, _ := strconv.Atoi(nums[4])
-	portTwo, _ := strconv.Atoi(nums[5])
-	port := (portOne * 256) + portTwo
-	host := nums[0] + "." + nums[1] + "." + nums[2] + "." + nums[3]
-	socket, err := newActiveSocket(host, port, conn.logger, conn.sessionID)
+	host, port, err := parsePortParam(param)
+	if err != nil {
+		conn.writeMessage(501, "Invalid PORT argument")
+		return
+	}
+	socket, err := newActiveSocket(conn.dataContext(), "tcp4", host, port, conn.dataDialer(), conn.server.DataConnTimeout, conn.logger, conn.sessionID, conn.dataTLSConfig(), conn.server.Metrics)
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
 		return
 	}
-	conn.dataConn = socket
+	conn.setDataConn(socket)
 	conn.writeMessage(200, "Connection established ("+strconv.Itoa(port)+")")
 }
 
+// parsePortParam parses the argument of PORT, six comma separated bytes
+// like 132,235,1,2,24,131, into the IPv4 address and the port.
+func parsePortParam(param string) (host string, port int, err error) {
+	fields := strings.Split(param, ",")
+	if len(fields) != 6 {
+		return "", 0, errors.New("ftp: malformed PORT argument")
+	}
+	var nums [6]int
+	for i, field := range fields {
+		n, ok := parseDecimal(strings.TrimSpace(field), 255)
+		if !ok {
+			return "", 0, errors.New("ftp: malformed PORT argument")
+		}
+		nums[i] = n
+	}
+	port = nums[4]*256 + nums[5]
+	if port == 0 {
+		return "", 0, errors.New("ftp: invalid PORT port")
+	}
+	return fmt.Sprintf("%d.%d.%d.%d", nums[0], nums[1], nums[2], nums[3]), port, nil
+}
+
 // commandPwd responds to the PWD FTP command.
 //
 // Tells the client what the current working directory is.
@@ -670,6 +1135,43 @@ func (cmd commandQuit) Execute(conn *Conn, param string) {
 	conn.Close()
 }
 
+// commandRein responds to the REIN FTP command. It logs the user out and
+// resets the session as if the client had just connected, keeping the
+// control connection and its TLS state. The protection level of data
+// connections has to be negotiated again with PBSZ and PROT.
+type commandRein struct{}
+
+func (cmd commandRein) IsExtend() bool {
+	return false
+}
+
+func (cmd commandRein) RequireParam() bool {
+	return false
+}
+
+func (cmd commandRein) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandRein) Execute(conn *Conn, param string) {
+	// closing the data socket also closes a pending passive listener
+	conn.abortTransfer()
+	conn.closeDataConn()
+	conn.user = ""
+	conn.reqUser = ""
+	conn.driver = conn.sessionDriver
+	conn.root = ""
+	conn.namePrefix = "/"
+	conn.readOnly = false
+	conn.maxUpload = 0
+	conn.maxDownload = 0
+	conn.pbsz = conn.implicitTLS
+	conn.dataTLS = conn.implicitTLS
+	conn.clearRestartOffset()
+	conn.resetSessionState()
+	conn.writeMessage(220, conn.server.WelcomeMessage)
+}
+
 // commandRetr responds to the RETR FTP command. It allows the client to
 // download a file.
 type commandRetr struct{}
@@ -691,14 +1193,61 @@ func (cmd commandRetr) Execute(conn *Conn, param string) {
 	defer func() {
 		conn.lastFilePos = 0
 	}()
+	if conn.lastFilePos > 0 {
+		info, err := conn.driver.Stat(path)
+		if err != nil {
+			conn.closeDataConn()
+			conn.writeMessage(551, "File not available")
+			return
+		}
+		if conn.lastFilePos > info.Size() {
+			conn.closeDataConn()
+			conn.writeMessage(554, "Restart offset beyond end of file")
+			return
+		}
+	}
+	if conn.dataConn == nil {
+		conn.writeMessage(425, "Use PORT or PASV first")
+		return
+	}
+	if err := conn.server.Notifier.BeforeDownload(conn, path); err != nil {
+		conn.logger.Infof(conn.sessionID, "Download of %s refused: %v", path, err)
+		conn.closeDataConn()
+		conn.writeMessage(550, "Download refused: "+err.Error())
+		return
+	}
+	var sent int64
 	bytes, data, err := conn.driver.GetFile(path, conn.lastFilePos)
 	if err == nil {
 		defer data.Close()
-		conn.writeMessage(150, fmt.Sprintf("Data transfer starting %v bytes", bytes))
-		err = conn.sendOutofBandDataWriter(data)
+		limit := sizeLimit(conn.maxDownload, conn.server.MaxDownloadSize)
+		if limit > 0 && bytes > limit {
+			conn.closeDataConn()
+			conn.writeMessage(552, "File exceeds the download size limit")
+			conn.server.Notifier.AfterDownload(conn, path, 0, ErrFileTooLarge)
+			return
+		}
+		if limit > 0 {
+			// in case the driver got the size wrong
+			data = struct {
+				io.Reader
+				io.Closer
+			}{&sizeLimitReader{r: data, remaining: limit}, data}
+		}
+		if conn.server.ProgressCallback != nil {
+			data = struct {
+				io.Reader
+				io.Closer
+			}{conn.newProgressReader(path, data), data}
+		}
+		if err = conn.startTransfer(fmt.Sprintf("Data transfer starting %v bytes", bytes)); err == nil {
+			sent, err = conn.sendOutofBandDataWriter(data)
+		}
 	} else {
-		conn.writeMessage(551, "File not available")
+		conn.closeDataConn()
+		conn.writeMessage(fileErrorReply(err, 551, "File not available"))
 	}
+	conn.server.Notifier.AfterDownload(conn, path, sent, err)
 }
 
 type commandRest struct{}
@@ -716,16 +1265,55 @@ func (cmd commandRest) RequireAuth() bool {
 }
 
 func (cmd commandRest) Execute(conn *Conn, param string) {
-	var err error
-	conn.lastFilePos, err = strconv.ParseInt(param, 10, 64)
-	if err != nil {
-		conn.writeMessage(551, "File not available")
+	offset, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || offset < 0 {
+		conn.writeMessage(501, "Invalid restart offset")
 		return
 	}
+	conn.lastFilePos = offset
 
-	conn.appendData = true
+	conn.writeMessage(350, fmt.Sprint("Start transfer from ", conn.lastFilePos))
+}
+
+// commandRang responds to the RANG FTP command. It sets the inclusive byte
+// range the next HASH command applies to. RANG 1 0 resets the range.
+type commandRang struct{}
+
+func (cmd commandRang) IsExtend() bool {
+	return true
+}
+
+func (cmd commandRang) RequireParam() bool {
+	return true
+}
 
-	conn.writeMessage(350, fmt.Sprintln("Start transfer from", conn.lastFilePos))
+func (cmd commandRang) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandRang) Execute(conn *Conn, param string) {
+	parts := strings.Fields(param)
+	if len(parts) != 2 {
+		conn.writeMessage(501, "Syntax error in parameters")
+		return
+	}
+	start, err1 := strconv.ParseInt(parts[0], 10, 64)
+	end, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < 0 {
+		conn.writeMessage(501, "Syntax error in parameters")
+		return
+	}
+	if start == 1 && end == 0 {
+		conn.rangeStart, conn.rangeEnd = 0, -1
+		conn.writeMessage(350, "Byte range reset")
+		return
+	}
+	if end < start {
+		conn.writeMessage(501, "Invalid byte range")
+		return
+	}
+	conn.rangeStart, conn.rangeEnd = start, end
+	conn.writeMessage(350, fmt.Sprintf("Restarting at %d. End byte range at %d", start, end))
 }
 
 // commandRnfr responds to the RNFR FTP command. It's the first of two commands
@@ -745,7 +1333,12 @@ func (cmd commandRnfr) RequireAuth() bool {
 }
 
 func (cmd commandRnfr) Execute(conn *Conn, param string) {
-	conn.renameFrom = conn.buildPath(param)
+	path := conn.buildPath(param)
+	if _, err := conn.driver.Stat(path); err != nil {
+		conn.writeMessage(fileErrorReply(err, 550, "File not available"))
+		return
+	}
+	conn.renameFrom = path
 	conn.writeMessage(350, "Requested file action pending further information.")
 }
 
@@ -766,8 +1359,13 @@ func (cmd commandRnto) RequireAuth() bool {
 }
 
 func (cmd commandRnto) Execute(conn *Conn, param string) {
+	if conn.renameFrom == "" {
+		conn.writeMessage(503, "Bad sequence of commands, send RNFR first")
+		return
+	}
 	toPath := conn.buildPath(param)
 	err := conn.driver.Rename(conn.renameFrom, toPath)
+	conn.audit(AuditEvent{Action: AuditRename, Target: conn.renameFrom, To: toPath, Err: err})
 	defer func() {
 		conn.renameFrom = ""
 	}()
@@ -775,7 +1373,7 @@ func (cmd commandRnto) Execute(conn *Conn, param string) {
 	if err == nil {
 		conn.writeMessage(250, "File renamed")
 	} else {
-		conn.writeMessage(550, fmt.Sprintln("Action not taken", err))
+		conn.writeMessage(fileErrorReply(err, 550, "Action not taken"))
 	}
 }
 
@@ -798,10 +1396,11 @@ func (cmd commandRmd) RequireAuth() bool {
 func (cmd commandRmd) Execute(conn *Conn, param string) {
 	path := conn.buildPath(param)
 	err := conn.driver.DeleteDir(path)
+	conn.audit(AuditEvent{Action: AuditRemoveDir, Target: path, Err: err})
 	if err == nil {
 		conn.writeMessage(250, "Directory deleted")
 	} else {
-		conn.writeMessage(550, fmt.Sprintln("Directory delete failed:", err))
+		conn.writeMessage(fileErrorReply(err, 550, "Directory delete failed"))
 	}
 }
 
@@ -843,13 +1442,15 @@ func (cmd commandAuth) Execute(conn *Conn, param string) {
 		conn.writeMessage(234, "AUTH command OK")
 		err := conn.upgradeToTLS()
 		if err != nil {
-			conn.logger.Printf("Error upgrading connection to TLS %v", err.Error())
+			conn.logger.Errorf(conn.sessionID, "Error upgrading connection to TLS %v", err)
 		}
 	} else {
 		conn.writeMessage(550, "Action not taken")
 	}
 }
 
+// commandCcc responds to the CCC FTP command of RFC 4217. If AllowCCC is
+// set, the control connection continues in the clear.
 type commandCcc struct{}
 
 func (cmd commandCcc) IsExtend() bool {
@@ -857,7 +1458,7 @@ func (cmd commandCcc) IsExtend() bool {
 }
 
 func (cmd commandCcc) RequireParam() bool {
-	return true
+	return false
 }
 
 func (cmd commandCcc) RequireAuth() bool {
@@ -865,7 +1466,22 @@ func (cmd commandCcc) RequireAuth() bool {
 }
 
 func (cmd commandCcc) Execute(conn *Conn, param string) {
-	conn.writeMessage(550, "Action not taken")
+	if !conn.server.AllowCCC {
+		conn.audit(AuditEvent{Action: AuditClearTLS, Err: errAuditCCC})
+		conn.writeMessage(534, "CCC denied for policy reasons")
+		return
+	}
+	if _, ok := conn.TLSConnectionState(); !ok {
+		conn.writeMessage(533, "Control connection is not protected")
+		return
+	}
+	conn.writeMessage(200, "Control connection cleared")
+	err := conn.clearControlTLS()
+	conn.audit(AuditEvent{Action: AuditClearTLS, Err: err})
+	if err != nil {
+		conn.logger.Warnf(conn.sessionID, "Clearing the control connection failed: %v", err)
+		conn.Close()
+	}
 }
 
 type commandEnc struct{}
@@ -920,6 +1536,7 @@ func (cmd commandPbsz) RequireAuth() bool {
 
 func (cmd commandPbsz) Execute(conn *Conn, param string) {
 	if conn.tls && param == "0" {
+		conn.pbsz = true
 		conn.writeMessage(200, "OK")
 	} else {
 		conn.writeMessage(550, "Action not taken")
@@ -941,12 +1558,25 @@ func (cmd commandProt) RequireAuth() bool {
 }
 
 func (cmd commandProt) Execute(conn *Conn, param string) {
-	if conn.tls && param == "P" {
-		conn.writeMessage(200, "OK")
-	} else if conn.tls {
-		conn.writeMessage(536, "Only P level is supported")
-	} else {
+	if !conn.tls {
 		conn.writeMessage(550, "Action not taken")
+		return
+	}
+	if !conn.pbsz {
+		conn.writeMessage(503, "PBSZ required before PROT")
+		return
+	}
+	switch strings.ToUpper(param) {
+	case "C":
+		conn.dataTLS = false
+		conn.writeMessage(200, "OK")
+	case "P":
+		conn.dataTLS = true
+		conn.writeMessage(200, "OK")
+	case "S", "E":
+		conn.writeMessage(536, "Only C and P levels are supported")
+	default:
+		conn.writeMessage(504, "Unknown protection level")
 	}
 }
 
@@ -973,7 +1603,7 @@ func (cmd commandConf) Execute(conn *Conn, param string) {
 type commandSize struct{}
 
 func (cmd commandSize) IsExtend() bool {
-	return false
+	return true
 }
 
 func (cmd commandSize) RequireParam() bool {
@@ -985,14 +1615,153 @@ func (cmd commandSize) RequireAuth() bool {
 }
 
 func (cmd commandSize) Execute(conn *Conn, param string) {
-	path := conn.buildPath(param)
-	stat, err := conn.driver.Stat(path)
+	path := conn.virtualPath(param)
+	stat, err := conn.driver.Stat(conn.rootPath(path))
 	if err != nil {
-		log.Printf("Size: error(%s)", err)
-		conn.writeMessage(450, fmt.Sprintln("path", path, "not found"))
+		conn.logger.Debugf(conn.sessionID, "Size: error(%s)", err)
+		conn.writeMessage(550, "path "+path+" not found")
+	} else if stat.IsDir() {
+		conn.writeMessage(550, path+" is not a file")
 	} else {
-		conn.writeMessage(213, strconv.Itoa(int(stat.Size())))
+		conn.writeMessage(213, strconv.FormatInt(stat.Size(), 10))
+	}
+}
+
+// commandSite responds to the SITE FTP command, which runs server specific
+// subcommands: SITE CHMOD and those registered with Server.HandleSite.
+type commandSite struct{}
+
+func (cmd commandSite) IsExtend() bool {
+	return false
+}
+
+func (cmd commandSite) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSite) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandSite) Execute(conn *Conn, param string) {
+	parts := strings.SplitN(param, " ", 2)
+	var args string
+	if len(parts) > 1 {
+		args = parts[1]
+	}
+	if handler := conn.server.siteHandlers.get(parts[0]); handler != nil {
+		conn.writeMessage(handler(conn, args))
+		return
 	}
+	switch strings.ToUpper(parts[0]) {
+	case "CHMOD":
+		conn.siteChmod(args)
+	case "WHO":
+		conn.siteWho()
+	default:
+		conn.writeMessage(504, "Unknown SITE command")
+	}
+}
+
+// siteChmod changes the mode of a file for SITE CHMOD <mode> <path>, with
+// mode in octal.
+func (conn *Conn) siteChmod(param string) {
+	parts := strings.SplitN(strings.TrimLeft(param, " "), " ", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		conn.writeMessage(501, "Usage: SITE CHMOD <mode> <path>")
+		return
+	}
+	mode, err := parseOctalMode(parts[0])
+	if err != nil {
+		conn.writeMessage(501, "Invalid mode "+parts[0])
+		return
+	}
+	if conn.isReadOnly() {
+		conn.writeMessage(550, "Read-only server")
+		return
+	}
+	chmodDriver, ok := conn.driver.(ChmodDriver)
+	if !ok {
+		conn.writeMessage(550, "SITE CHMOD not supported")
+		return
+	}
+	path := conn.virtualPath(parts[1])
+	err = chmodDriver.Chmod(conn.rootPath(path), mode)
+	conn.audit(AuditEvent{Action: AuditChmod, Target: conn.rootPath(path), Err: err})
+	if err != nil {
+		conn.logger.Debugf(conn.sessionID, "Chmod %s: %v", path, err)
+		conn.writeMessage(550, "Unable to change the mode of "+path)
+		return
+	}
+	conn.writeMessage(200, "SITE CHMOD command successful")
+}
+
+// parseOctalMode parses an octal mode such as 755 or 4755.
+func parseOctalMode(s string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if bits > 07777 {
+		return 0, errors.New("ftp: mode out of range")
+	}
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// commandStat responds to the STAT FTP command. Without a parameter it
+// reports the status of the session, otherwise it lists a file or directory
+// on the control connection. A STAT sent during a transfer is answered by
+// readCommands.
+type commandStat struct{}
+
+func (cmd commandStat) IsExtend() bool {
+	return false
+}
+
+func (cmd commandStat) RequireParam() bool {
+	return false
+}
+
+func (cmd commandStat) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandStat) Execute(conn *Conn, param string) {
+	if param == "" {
+		conn.writeStatus("")
+		return
+	}
+	path := conn.virtualPath(parseListParam(param))
+	info, err := conn.driver.Stat(conn.rootPath(path))
+	if err != nil {
+		conn.writeMessage(fileErrorReply(err, 550, "File not available"))
+		return
+	}
+	if !info.IsDir() {
+		conn.writeMessageMultiline(213, "Status of "+path+"\r\n"+detailedEntry(info))
+		return
+	}
+	var listing strings.Builder
+	err = conn.driver.ListDir(conn.rootPath(path), func(f FileInfo) error {
+		listing.WriteString(detailedEntry(f))
+		return nil
+	})
+	if err != nil {
+		conn.logger.Errorf(conn.sessionID, "Listing %s failed: %v", path, err)
+		conn.writeMessage(fileErrorReply(err, 450, "Listing failed"))
+		return
+	}
+	conn.writeMessageMultiline(212, "Status of "+path+"\r\n"+listing.String())
 }
 
 // commandStor responds to the STOR FTP command. It allows the user to upload a
@@ -1013,18 +1782,159 @@ func (cmd commandStor) RequireAuth() bool {
 
 func (cmd commandStor) Execute(conn *Conn, param string) {
 	targetPath := conn.buildPath(param)
-	conn.writeMessage(150, "Data transfer starting")
-
 	defer func() {
 		conn.appendData = false
+		conn.lastFilePos = 0
 	}()
 
-	bytes, err := conn.driver.PutFile(targetPath, conn.dataConn, conn.appendData)
-	if err == nil {
-		msg := "OK, received " + strconv.Itoa(int(bytes)) + " bytes"
-		conn.writeMessage(226, msg)
+	// Resuming an upload at an offset other than the end of the file
+	// requires the driver to support writing at an offset.
+	_, canRestart := conn.driver.(RestartDriver)
+	if conn.lastFilePos > 0 && !canRestart {
+		info, err := conn.driver.Stat(targetPath)
+		if err != nil || info.Size() != conn.lastFilePos {
+			conn.closeDataConn()
+			conn.writeMessage(554, "Restart offset not supported for this file")
+			return
+		}
+	}
+	if bytes, ok := conn.receiveFile(targetPath, "Data transfer starting"); ok {
+		conn.writeMessage(226, "OK, received "+strconv.Itoa(int(bytes))+" bytes")
+	}
+}
+
+// receiveFile stores the upload on the data connection at targetPath,
+// honoring APPE, REST and the quota. The transfer is announced with a 150
+// reply of msg. It replies to failures itself and returns false; on success
+// the caller sends the 226 reply.
+func (conn *Conn) receiveFile(targetPath, msg string) (int64, bool) {
+	if conn.dataConn == nil {
+		conn.writeMessage(425, "Use PORT or PASV first")
+		return 0, false
+	}
+	if err := conn.server.Notifier.BeforeUpload(conn, targetPath); err != nil {
+		conn.logger.Infof(conn.sessionID, "Upload of %s refused: %v", targetPath, err)
+		conn.closeDataConn()
+		conn.writeMessage(550, "Upload refused: "+err.Error())
+		return 0, false
+	}
+	bytes, err := conn.storeFile(targetPath, msg)
+	conn.server.Notifier.AfterUpload(conn, targetPath, bytes, err)
+	conn.audit(AuditEvent{Action: AuditUpload, Target: targetPath, Err: err})
+	return bytes, err == nil
+}
+
+// storeFile runs the upload for receiveFile, replying to failures.
+func (conn *Conn) storeFile(targetPath, msg string) (int64, error) {
+	var data io.Reader = bufio.NewReaderSize(conn.transferConn(), conn.server.DataBufferSize)
+	// an overwrite frees the space of the file it replaces, and an upload
+	// that fails is only removed if it created the file
+	overwrite := !conn.appendData && conn.lastFilePos == 0
+	var oldSize, freed int64
+	existing, statErr := conn.driver.Stat(targetPath)
+	created := errors.Is(statErr, os.ErrNotExist)
+	if statErr == nil && !existing.IsDir() {
+		oldSize = existing.Size()
+	}
+	if overwrite {
+		freed = oldSize
+	}
+	quota, err := conn.uploadQuota(data, freed)
+	if err == ErrQuotaExceeded {
+		conn.closeDataConn()
+		conn.writeMessage(552, "Quota exceeded")
+		return 0, err
+	} else if err != nil {
+		conn.closeDataConn()
+		conn.writeMessage(451, "Unable to check quota")
+		return 0, err
+	} else if quota != nil {
+		data = quota
+	}
+	var limited *sizeLimitReader
+	if limit := sizeLimit(conn.maxUpload, conn.server.MaxUploadSize); limit > 0 {
+		limited = &sizeLimitReader{r: data, remaining: limit}
+		data = limited
+	}
+	data = conn.newProgressReader(targetPath, data)
+
+	if err := conn.startTransfer(msg); err != nil {
+		return 0, err
+	}
+	conn.allowNextCommand()
+
+	var bytes int64
+	restartDriver, canRestart := conn.driver.(RestartDriver)
+	if conn.lastFilePos > 0 && canRestart {
+		bytes, err = restartDriver.PutFileAt(targetPath, data, conn.lastFilePos)
 	} else {
-		conn.writeMessage(450, fmt.Sprintln("error during transfer:", err))
+		bytes, err = conn.driver.PutFile(targetPath, data, conn.appendData || conn.lastFilePos > 0)
+	}
+	conn.closeDataConn()
+	tooLarge := limited != nil && limited.exceeded
+	if (tooLarge || (quota != nil && quota.exceeded)) && overwrite && created {
+		// roll back a new upload entirely
+		conn.driver.DeleteFile(targetPath)
+	}
+	if quota != nil {
+		// drivers may have stored part of a failed upload, or truncated the
+		// file it replaces
+		expected := storedGrowth(oldSize, conn.lastFilePos, bytes, overwrite, conn.appendData)
+		if growth := conn.uploadGrowth(targetPath, oldSize, expected); growth != 0 {
+			if err := conn.server.Quota.Add(conn.user, growth); err != nil {
+				conn.logger.Errorf(conn.sessionID, "Unable to update quota: %v", err)
+			}
+		}
+	}
+	if quota != nil && quota.exceeded {
+		conn.writeMessage(552, "Quota exceeded; transfer aborted")
+		return bytes, ErrQuotaExceeded
+	}
+	if tooLarge {
+		conn.writeMessage(552, "Upload size limit exceeded; transfer aborted")
+		return bytes, ErrFileTooLarge
+	}
+	if err == ErrAborted {
+		conn.writeMessage(426, "Connection closed; transfer aborted")
+	} else if err != nil {
+		conn.writeMessage(fileErrorReply(err, 450, "Error during transfer"))
+	}
+	return bytes, err
+}
+
+// commandStou responds to the STOU FTP command. It allows the user to upload
+// a file under a name chosen by the server, which is returned in the replies
+// as required by RFC 1123. An optional parameter is used as the base name.
+type commandStou struct{}
+
+func (cmd commandStou) IsExtend() bool {
+	return false
+}
+
+func (cmd commandStou) RequireParam() bool {
+	return false
+}
+
+func (cmd commandStou) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandStou) Execute(conn *Conn, param string) {
+	conn.appendData = false
+	conn.lastFilePos = 0
+
+	targetPath, err := conn.uniquePath(param)
+	if err != nil {
+		conn.logger.Warnf(conn.sessionID, "STOU: %v", err)
+		conn.closeDataConn()
+		conn.writeMessage(553, "Unable to find a unique file name")
+		return
+	}
+	defer conn.server.uploads.release(targetPath)
+
+	name := path.Base(targetPath)
+	if bytes, ok := conn.receiveFile(targetPath, "FILE: "+name); ok {
+		conn.writeMessage(226, "OK, received "+strconv.Itoa(int(bytes))+" bytes; FILE: "+name)
 	}
 }
 
@@ -1084,10 +1994,10 @@ func (cmd commandSyst) Execute(conn *Conn, param string) {
 //  protocol was more aware of the content of the files it was transferring, and
 //  would sometimes be expected to translate things like EOL markers on the fly.
 //
-//  Valid options were A(SCII), I(mage), E(BCDIC) or LN (for local type). Since
-//  we plan to just accept bytes from the client unchanged, I think Image mode is
-//  adequate. The RFC requires we accept ASCII mode however, so accept it, but
-//  ignore it.
+//  Valid options were A(SCII), I(mage), E(BCDIC) or LN (for local type). Image
+//  mode transfers bytes unchanged. In ASCII mode, file transfers translate
+//  line endings between LF on the server and CRLF on the wire, see
+//  asciiSocket.
 type commandType struct{}
 
 func (cmd commandType) IsExtend() bool {
@@ -1103,16 +2013,20 @@ func (cmd commandType) RequireAuth() bool {
 }
 
 func (cmd commandType) Execute(conn *Conn, param string) {
-	if strings.ToUpper(param) == "A" {
+	switch strings.ToUpper(param) {
+	case "A", "A N":
+		conn.asciiMode = true
 		conn.writeMessage(200, "Type set to ASCII")
-	} else if strings.ToUpper(param) == "I" {
+	case "I", "L 8":
+		conn.asciiMode = false
 		conn.writeMessage(200, "Type set to binary")
-	} else {
+	default:
 		conn.writeMessage(500, "Invalid type")
 	}
 }
 
-// commandUser responds to the USER FTP command by asking for the password
+// commandUser responds to the USER FTP command by asking for the password,
+// unless the client certificate already authenticated the user
 type commandUser struct{}
 
 func (cmd commandUser) IsExtend() bool {
@@ -1128,6 +2042,20 @@ func (cmd commandUser) RequireAuth() bool {
 }
 
 func (cmd commandUser) Execute(conn *Conn, param string) {
+	user, driver, err := conn.certUser()
+	if err != nil {
+		conn.logger.Warnf(conn.sessionID, "Unable to map the client certificate to a user: %v", err)
+	} else if user != "" && user == param {
+		if err := conn.certLogin(user, driver); err != nil {
+			conn.logger.Errorf(conn.sessionID, "Unable to log in %s by certificate: %v", user, err)
+			conn.audit(AuditEvent{Action: AuditLogin, User: user, Err: err})
+			conn.writeMessage(530, "Not logged in")
+			return
+		}
+		conn.audit(AuditEvent{Action: AuditLogin})
+		conn.writeMessage(232, "User logged in, authorized by certificate")
+		return
+	}
 	conn.reqUser = param
 	conn.writeMessage(331, "User name ok, password required")
 }
@@ -4,7 +4,21 @@
 
 package server
 
-import "testing"
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestParseListParam(t *testing.T) {
 	var paramTests = []struct {
@@ -32,3 +46,1606 @@ func TestParseListParam(t *testing.T) {
 		}
 	}
 }
+
+func TestCmdRestart(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	upload(t, c, "/resume.txt", "hello")
+
+	// Resuming an upload at the end of the file appends the rest.
+	expect(t, c, 350, "REST 5")
+	upload(t, c, "/resume.txt", " world")
+	if got := driver.testFile("/resume.txt"); got != "hello world" {
+		t.Errorf("got %q, want %q", got, "hello world")
+	}
+
+	// The test driver can't write in the middle of a file.
+	expect(t, c, 350, "REST 3")
+	expect(t, c, 554, "STOR /resume.txt")
+
+	expect(t, c, 350, "REST 6")
+	if got := download(t, c, "RETR /resume.txt"); got != "world" {
+		t.Errorf("got %q, want %q", got, "world")
+	}
+	// The offset only applies to a single transfer.
+	if got := download(t, c, "RETR /resume.txt"); got != "hello world" {
+		t.Errorf("got %q, want %q", got, "hello world")
+	}
+
+	expect(t, c, 350, "REST 12")
+	expect(t, c, 554, "RETR /resume.txt")
+	expect(t, c, 501, "REST -1")
+	expect(t, c, 501, "REST 99999999999999999999")
+}
+
+func TestCmdRestartOffsetLifetime(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/a.txt"] = []byte("hello world")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	// Data connection setup may come between REST and the transfer.
+	expect(t, c, 350, "REST 6")
+	expect(t, c, 200, "TYPE I")
+	if got := download(t, c, "RETR /a.txt"); got != "world" {
+		t.Errorf("got %q, want %q", got, "world")
+	}
+	if got := download(t, c, "RETR /a.txt"); got != "hello world" {
+		t.Errorf("after a restarted RETR: got %q, want %q", got, "hello world")
+	}
+
+	// Other commands drop the offset.
+	for _, tt := range []struct {
+		cmd  string
+		code int
+	}{
+		{"SIZE /a.txt", 213},
+		{"NOOP", 200},
+		{"PWD", 257},
+		{"FOO", 500},
+	} {
+		expect(t, c, 350, "REST 6")
+		expect(t, c, tt.code, "%s", tt.cmd)
+		if got := download(t, c, "RETR /a.txt"); got != "hello world" {
+			t.Errorf("after REST and %s: got %q, want %q", tt.cmd, got, "hello world")
+		}
+	}
+	expect(t, c, 350, "REST 6")
+	download(t, c, "LIST /")
+	if got := download(t, c, "RETR /a.txt"); got != "hello world" {
+		t.Errorf("after REST and LIST: got %q, want %q", got, "hello world")
+	}
+}
+
+func TestCmdAbor(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/big"] = make([]byte, 32<<20)
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	data := openPassive(t, c)
+	defer data.Close()
+	expect(t, c, 150, "RETR /big")
+	if _, err := data.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The aborted transfer is answered first, then ABOR itself.
+	c.PrintfLine("\xff\xf4\xff\xf2ABOR")
+	if _, _, err := c.ReadResponse(426); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 200, "NOOP")
+}
+
+func TestCmdEpsvIPv6(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("IPv6 loopback not available: ", err)
+	} else {
+		l.Close()
+	}
+	s, driver := newTestServer(t, &ServerOpts{Hostname: "::1"})
+	driver.files["/v6.txt"] = []byte("over IPv6")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	expect(t, c, 522, "EPSV 3")
+	if msg := expect(t, c, 522, "EPSV 1"); !strings.Contains(msg, "(2)") {
+		t.Errorf("EPSV 1 over IPv6: got %q, want a hint to use protocol 2", msg)
+	}
+	if msg := expect(t, c, 522, "PASV"); !strings.Contains(msg, "EPSV") {
+		t.Errorf("PASV over IPv6: got %q, want a hint to use EPSV", msg)
+	}
+	port := epsvPort(t, expect(t, c, 229, "EPSV 2"))
+	// The listener is IPv6 only, like the control connection.
+	if v4, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		v4.Close()
+		t.Fatal("EPSV over IPv6 listens on IPv4")
+	}
+	port = epsvPort(t, expect(t, c, 229, "EPSV"))
+	data, err := net.Dial("tcp", net.JoinHostPort("::1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	expect(t, c, 150, "RETR /v6.txt")
+	got, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "over IPv6" {
+		t.Errorf("got %q, want %q", got, "over IPv6")
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// epsvPort returns the port of an EPSV reply.
+func epsvPort(t *testing.T, msg string) int {
+	t.Helper()
+	var port int
+	if _, err := fmt.Sscanf(msg[strings.Index(msg, "("):], "(|||%d|)", &port); err != nil {
+		t.Fatalf("malformed EPSV reply %q: %v", msg, err)
+	}
+	return port
+}
+
+func TestCmdPassiveIPv4(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/v4.txt"] = []byte("over IPv4")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	// Both PASV and EPSV listen on IPv4 only.
+	if l, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		l.Close()
+		port := epsvPort(t, expect(t, c, 229, "EPSV"))
+		if v6, err := net.Dial("tcp", net.JoinHostPort("::1", strconv.Itoa(port))); err == nil {
+			v6.Close()
+			t.Error("EPSV over IPv4 listens on IPv6")
+		}
+	}
+	if got := download(t, c, "RETR /v4.txt"); got != "over IPv4" {
+		t.Errorf("got %q over PASV", got)
+	}
+
+	if msg := expect(t, c, 522, "EPSV 2"); !strings.Contains(msg, "(1)") {
+		t.Errorf("EPSV 2 over IPv4: got %q, want a hint to use protocol 1", msg)
+	}
+	port := epsvPort(t, expect(t, c, 229, "EPSV 1"))
+	data, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	expect(t, c, 150, "RETR /v4.txt")
+	if got, _ := ioutil.ReadAll(data); string(got) != "over IPv4" {
+		t.Errorf("got %q over EPSV", got)
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseEprtParam(t *testing.T) {
+	var eprtTests = []struct {
+		param   string
+		network string
+		host    string
+		port    int
+		err     bool
+	}{
+		{"|1|132.235.1.2|6275|", "tcp4", "132.235.1.2", 6275, false},
+		{"|2|1080::8:800:200C:417A|5282|", "tcp6", "1080::8:800:200c:417a", 5282, false},
+		{"!2!::1!21!", "tcp6", "::1", 21, false},
+		{"", "", "", 0, true},
+		{"|3|132.235.1.2|6275|", "", "", 0, true},
+		{"|1|::1|6275|", "", "", 0, true},
+		{"|2|132.235.1.2|6275|", "", "", 0, true},
+		{"|1|132.235.1.2|0|", "", "", 0, true},
+		{"|1|132.235.1.2|65536|", "", "", 0, true},
+		{"|1|132.235.1.2|6275", "", "", 0, true},
+		{"|1|host.example|6275|", "", "", 0, true},
+		{" 1 132.235.1.2 6275 ", "", "", 0, true},
+		{"|1|132.235.1.2|+6275|", "", "", 0, true},
+		{"|1|132.235.1.2||", "", "", 0, true},
+		{"|1|132.235.1.2|0006275|", "", "", 0, true},
+	}
+	for _, tt := range eprtTests {
+		network, host, port, err := parseEprtParam(tt.param)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: got error %v, want error %v", tt.param, err, tt.err)
+			continue
+		}
+		if network != tt.network || host != tt.host || port != tt.port {
+			t.Errorf("%q: got %s %s %d, want %s %s %d", tt.param, network, host, port, tt.network, tt.host, tt.port)
+		}
+	}
+}
+
+func TestParsePortParam(t *testing.T) {
+	var portTests = []struct {
+		param string
+		host  string
+		port  int
+		err   bool
+	}{
+		{"132,235,1,2,24,131", "132.235.1.2", 6275, false},
+		{"127,0,0,1,0,21", "127.0.0.1", 21, false},
+		{"127, 0, 0, 1, 255, 255", "127.0.0.1", 65535, false},
+		{"", "", 0, true},
+		{"127,0,0,1,4", "", 0, true},
+		{"127,0,0,1,4,1,1", "", 0, true},
+		{"127,0,0,1,x,1", "", 0, true},
+		{"127,0,0,-1,4,1", "", 0, true},
+		{"127,0,0,1,256,1", "", 0, true},
+		{"127,0,0,1,1,256", "", 0, true},
+		{"127,0,0,1,0,0", "", 0, true},
+		{"127,0,0,1,,1", "", 0, true},
+	}
+	for _, tt := range portTests {
+		host, port, err := parsePortParam(tt.param)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: got error %v, want error %v", tt.param, err, tt.err)
+			continue
+		}
+		if host != tt.host || port != tt.port {
+			t.Errorf("%q: got %s %d, want %s %d", tt.param, host, port, tt.host, tt.port)
+		}
+	}
+}
+
+func TestCmdPortMalformed(t *testing.T) {
+	s, _ := newTestServer(t, &ServerOpts{})
+	c := dialTestServer(t, s)
+	login(t, c)
+	for _, cmd := range []string{
+		"PORT 127,0,0,1",
+		"PORT 127,0,0,1,a,b",
+		"PORT 127,0,0,1,256,0",
+		"EPRT |1|127.0.0.1|",
+		"EPRT |1|127.0.0.1|x|",
+		"EPRT |1|127.0.0.1|65536|",
+		"EPRT |1|nowhere|21|",
+	} {
+		expect(t, c, 501, "%s", cmd)
+	}
+	expect(t, c, 522, "EPRT |3|127.0.0.1|21|")
+	// Nothing was set up for a transfer.
+	expect(t, c, 425, "RETR /a.txt")
+}
+
+func TestCmdEpsvAll(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/a.txt"] = []byte("hello")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	openPassive(t, c).Close()
+	expect(t, c, 200, "EPSV ALL")
+	for _, cmd := range []string{"PASV", "pasv", "PORT 127,0,0,1,4,1", "EPRT |1|127.0.0.1|1025|"} {
+		expect(t, c, 501, "%s", cmd)
+	}
+
+	port := epsvPort(t, expect(t, c, 229, "EPSV"))
+	data, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	expect(t, c, 150, "RETR /a.txt")
+	if got, _ := ioutil.ReadAll(data); string(got) != "hello" {
+		t.Errorf("got %q over EPSV", got)
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restriction is per session.
+	other := dialTestServer(t, s)
+	login(t, other)
+	openPassive(t, other).Close()
+}
+
+func TestCmdDelayTransferReply(t *testing.T) {
+	for _, delay := range []bool{false, true} {
+		s, driver := newTestServer(t, &ServerOpts{DelayTransferReply: delay})
+		driver.files["/a.txt"] = []byte("hello")
+		c := dialTestServer(t, s)
+		login(t, c)
+
+		for _, cmd := range []string{"RETR /a.txt", "STOR /b.txt", "NLST"} {
+			port := epsvPort(t, expect(t, c, 229, "EPSV"))
+			if _, err := c.Cmd("%s", cmd); err != nil {
+				t.Fatal(err)
+			}
+			reply := make(chan int, 1)
+			go func() {
+				code, _, _ := c.ReadResponse(0)
+				reply <- code
+			}()
+			if delay {
+				select {
+				case code := <-reply:
+					t.Fatalf("%s: got %d before the client connected", cmd, code)
+				case <-time.After(100 * time.Millisecond):
+				}
+			} else if code := <-reply; code != 150 {
+				t.Fatalf("%s: got %d, want 150 before the client connected", cmd, code)
+			}
+
+			data, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if delay {
+				if code := <-reply; code != 150 {
+					t.Fatalf("%s: got %d, want 150", cmd, code)
+				}
+			}
+			if cmd == "STOR /b.txt" {
+				data.Write([]byte("stored"))
+			} else if got, _ := ioutil.ReadAll(data); len(got) == 0 {
+				t.Errorf("%s: got no data", cmd)
+			}
+			data.Close()
+			if _, _, err := c.ReadResponse(226); err != nil {
+				t.Fatalf("%s: %v", cmd, err)
+			}
+		}
+		if got := driver.testFile("/b.txt"); got != "stored" {
+			t.Errorf("got %q", got)
+		}
+	}
+
+	// Without a client connecting, the transfer is refused.
+	s, driver := newTestServer(t, &ServerOpts{DelayTransferReply: true, PassiveAcceptTimeout: 50 * time.Millisecond})
+	driver.files["/a.txt"] = []byte("hello")
+	c := dialTestServer(t, s)
+	login(t, c)
+	expect(t, c, 229, "EPSV")
+	expect(t, c, 425, "RETR /a.txt")
+	expect(t, c, 200, "NOOP")
+}
+
+func TestCmdEprtIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available: ", err)
+	}
+	defer l.Close()
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/v6.txt"] = []byte("over IPv6")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	expect(t, c, 522, "EPRT |2|127.0.0.1|21|")
+	expect(t, c, 200, "EPRT |2|::1|%d|", l.Addr().(*net.TCPAddr).Port)
+	data, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	expect(t, c, 150, "RETR /v6.txt")
+	got, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "over IPv6" {
+		t.Errorf("got %q, want %q", got, "over IPv6")
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dialExplicitTLS logs in to s after securing the control connection with
+// AUTH TLS using config.
+func dialExplicitTLS(t *testing.T, s *Server, config *tls.Config) *textproto.Conn {
+	t.Helper()
+	c := dialAuthTLS(t, s, config)
+	login(t, c)
+	return c
+}
+
+// dialAuthTLS connects to s and secures the control connection with AUTH
+// TLS using config.
+func dialAuthTLS(t *testing.T, s *Server, config *tls.Config) *textproto.Conn {
+	t.Helper()
+	nc, err := net.Dial("tcp", s.listenTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := textproto.NewConn(nc)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 234, "AUTH TLS")
+	c = textproto.NewConn(tls.Client(nc, config))
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCmdProt(t *testing.T) {
+	certFile, keyFile := testCertFiles(t)
+	s, driver := newTestServer(t, &ServerOpts{TLS: true, ExplicitFTPS: true, CertFile: certFile, KeyFile: keyFile})
+	driver.files["/prot.txt"] = []byte("protected")
+	c := dialExplicitTLS(t, s, &tls.Config{InsecureSkipVerify: true})
+
+	expect(t, c, 503, "PROT P")
+	expect(t, c, 200, "PBSZ 0")
+	expect(t, c, 536, "PROT S")
+	expect(t, c, 504, "PROT X")
+
+	expect(t, c, 200, "PROT C")
+	if got := download(t, c, "RETR /prot.txt"); got != "protected" {
+		t.Errorf("PROT C: got %q, want %q", got, "protected")
+	}
+
+	expect(t, c, 200, "PROT P")
+	data := tls.Client(openPassive(t, c), &tls.Config{InsecureSkipVerify: true})
+	defer data.Close()
+	expect(t, c, 150, "RETR /prot.txt")
+	got, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "protected" {
+		t.Errorf("PROT P: got %q, want %q", got, "protected")
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCmdCcc(t *testing.T) {
+	certFile, keyFile := testCertFiles(t)
+	opts := &ServerOpts{TLS: true, ExplicitFTPS: true, CertFile: certFile, KeyFile: keyFile}
+	s, _ := newTestServer(t, opts)
+	c := dialExplicitTLS(t, s, &tls.Config{InsecureSkipVerify: true})
+	expect(t, c, 534, "CCC")
+
+	s, driver := newTestServer(t, &ServerOpts{TLS: true, ExplicitFTPS: true, CertFile: certFile, KeyFile: keyFile, AllowCCC: true})
+	driver.files["/ccc.txt"] = []byte("still protected")
+	plain := dialTestServer(t, s)
+	login(t, plain)
+	expect(t, plain, 533, "CCC")
+
+	nc, err := net.Dial("tcp", s.listenTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	c = textproto.NewConn(nc)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 234, "AUTH TLS")
+	tlsConn := tls.Client(nc, &tls.Config{InsecureSkipVerify: true})
+	c = textproto.NewConn(tlsConn)
+	login(t, c)
+	expect(t, c, 200, "PBSZ 0")
+	expect(t, c, 200, "PROT P")
+	expect(t, c, 200, "CCC")
+	if err := tlsConn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, tlsConn); err != nil {
+		t.Fatal(err)
+	}
+	nc.SetWriteDeadline(time.Time{}) // left expired by CloseWrite
+
+	// The commands continue in the clear, while data is still protected.
+	c = textproto.NewConn(nc)
+	expect(t, c, 200, "NOOP")
+	data := tls.Client(openPassive(t, c), &tls.Config{InsecureSkipVerify: true})
+	defer data.Close()
+	expect(t, c, 150, "RETR /ccc.txt")
+	got, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "still protected" {
+		t.Errorf("got %q, want %q", got, "still protected")
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCmdStrictTLSResumption(t *testing.T) {
+	certFile, keyFile := testCertFiles(t)
+	s, driver := newTestServer(t, &ServerOpts{TLS: true, ExplicitFTPS: true, CertFile: certFile, KeyFile: keyFile, StrictTLSResumption: true})
+	driver.files["/resume.txt"] = []byte("resumed")
+
+	// The client resumes the control session on the data connection since
+	// both share a session cache under the same server name.
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "127.0.0.1",
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	c := dialExplicitTLS(t, s, config)
+	expect(t, c, 200, "PBSZ 0")
+	expect(t, c, 200, "PROT P")
+
+	data := tls.Client(openPassive(t, c), config)
+	expect(t, c, 150, "RETR /resume.txt")
+	got, err := ioutil.ReadAll(data)
+	data.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "resumed" || !data.ConnectionState().DidResume {
+		t.Errorf("got %q, resumed %v", got, data.ConnectionState().DidResume)
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+
+	// A data connection with a fresh session is refused.
+	data = tls.Client(openPassive(t, c), &tls.Config{InsecureSkipVerify: true})
+	defer data.Close()
+	expect(t, c, 150, "RETR /resume.txt")
+	if got, _ := ioutil.ReadAll(data); len(got) != 0 {
+		t.Errorf("got %q over a data connection that did not resume", got)
+	}
+	if code, _, err := c.ReadResponse(0); err != nil || code < 400 {
+		t.Errorf("got %d %v, want a failed transfer", code, err)
+	}
+
+	// So is one resuming the session of another control connection.
+	other := dialExplicitTLS(t, s, &tls.Config{InsecureSkipVerify: true})
+	expect(t, other, 200, "PBSZ 0")
+	expect(t, other, 200, "PROT P")
+	data = tls.Client(openPassive(t, other), config)
+	defer data.Close()
+	expect(t, other, 150, "RETR /resume.txt")
+	if got, _ := ioutil.ReadAll(data); len(got) != 0 {
+		t.Errorf("got %q over a data connection resuming another session", got)
+	}
+	if code, _, err := other.ReadResponse(0); err != nil || code < 400 {
+		t.Errorf("got %d %v, want a failed transfer", code, err)
+	}
+}
+
+func TestCmdMlsd(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/dir/a.txt"] = []byte("hello")
+	driver.dirs["/dir"] = true
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	want := "type=file;size=5;modify=20180102030405;perm=adfwr; a.txt\r\n"
+	if got := download(t, c, "MLSD /dir"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	expect(t, c, 501, "MLSD /dir/a.txt")
+	expect(t, c, 550, "MLSD /missing")
+
+	if msg := expect(t, c, 200, "OPTS MLST size;type;bogus;"); msg != "MLST OPTS type;size;" {
+		t.Errorf("got %q", msg)
+	}
+	if got := download(t, c, "MLSD /dir"); got != "type=file;size=5; a.txt\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCmdMlst(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/dir/a.txt"] = []byte("hello")
+	driver.dirs["/dir"] = true
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	var mlstTests = []struct {
+		cmd  string
+		want string
+	}{
+		{"MLST /dir/a.txt", "Listing /dir/a.txt\n type=file;size=5;modify=20180102030405;perm=adfwr; /dir/a.txt\nEND"},
+		{"MLST /dir", "Listing /dir\n type=dir;modify=20180102030405;perm=cdfmpel; /dir\nEND"},
+		{"MLST", "Listing /\n type=dir;modify=20180102030405;perm=cdfmpel; /\nEND"},
+	}
+	for _, tt := range mlstTests {
+		if got := expect(t, c, 250, "%s", tt.cmd); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+	expect(t, c, 550, "MLST /missing")
+
+	expect(t, c, 200, "OPTS MLST type;")
+	if msg := expect(t, c, 211, "FEAT"); !strings.Contains(msg, " MLST type*;size;modify;perm;") {
+		t.Errorf("FEAT does not list the selected facts: %q", msg)
+	}
+}
+
+func TestCmdOptsMlst(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/dir/a.txt"] = []byte("hello")
+	driver.dirs["/dir"] = true
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	var optsTests = []struct {
+		facts string
+		reply string
+		entry string // of a.txt, in MLSD and MLST
+	}{
+		{"modify;", "MLST OPTS modify;", "modify=20180102030405;"},
+		{"PERM;Size;", "MLST OPTS size;perm;", "size=5;perm=adfwr;"},
+		{"unique;lang;", "MLST OPTS", ""},
+		{"", "MLST OPTS", ""},
+		{"type;size;modify;perm;", "MLST OPTS type;size;modify;perm;", "type=file;size=5;modify=20180102030405;perm=adfwr;"},
+	}
+	for _, tt := range optsTests {
+		if msg := expect(t, c, 200, "OPTS MLST %s", tt.facts); msg != tt.reply {
+			t.Errorf("OPTS MLST %s: got %q, want %q", tt.facts, msg, tt.reply)
+		}
+		if got := download(t, c, "MLSD /dir"); got != tt.entry+" a.txt\r\n" {
+			t.Errorf("MLSD after OPTS MLST %s: got %q", tt.facts, got)
+		}
+		want := "Listing /dir/a.txt\n " + tt.entry + " /dir/a.txt\nEND"
+		if got := expect(t, c, 250, "MLST /dir/a.txt"); got != want {
+			t.Errorf("MLST after OPTS MLST %s: got %q, want %q", tt.facts, got, want)
+		}
+	}
+}
+
+func TestCmdMdtm(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/a.txt"] = []byte("hello")
+	driver.mtimes["/a.txt"] = time.Date(2018, 1, 2, 5, 4, 5, 0, time.FixedZone("UTC+2", 2*60*60))
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	if msg := expect(t, c, 213, "MDTM /a.txt"); msg != "20180102030405" {
+		t.Errorf("got %q, want %q", msg, "20180102030405")
+	}
+	expect(t, c, 550, "MDTM /missing.txt")
+}
+
+// basicDriverFactory hides the optional interfaces of a testDriver.
+type basicDriverFactory struct {
+	driver *testDriver
+}
+
+func (factory basicDriverFactory) NewDriver() (Driver, error) {
+	return struct{ Driver }{factory.driver}, nil
+}
+
+func TestCmdMfmt(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/a file.txt"] = []byte("hello")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	if msg := expect(t, c, 213, "MFMT 20200304050607 /a file.txt"); msg != "Modify=20200304050607; /a file.txt" {
+		t.Errorf("got %q", msg)
+	}
+	if msg := expect(t, c, 213, "MDTM /a file.txt"); msg != "20200304050607" {
+		t.Errorf("got MDTM %q after MFMT", msg)
+	}
+	expect(t, c, 501, "MFMT 2020-03-04 /a file.txt")
+	expect(t, c, 501, "MFMT 20201304050607 /a file.txt")
+	expect(t, c, 501, "MFMT 20200304050607")
+	expect(t, c, 550, "MFMT 20200304050607 /missing.txt")
+
+	basic, _ := newTestServer(t, &ServerOpts{Factory: basicDriverFactory{driver}})
+	c = dialTestServer(t, basic)
+	login(t, c)
+	expect(t, c, 502, "MFMT 20200304050607 /a file.txt")
+}
+
+func TestCmdSize(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/a.txt"] = []byte("hello")
+	driver.dirs["/dir"] = true
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	if msg := expect(t, c, 213, "SIZE /a.txt"); msg != "5" {
+		t.Errorf("got %q, want %q", msg, "5")
+	}
+	expect(t, c, 550, "SIZE /dir")
+	expect(t, c, 550, "SIZE /missing.txt")
+}
+
+func TestCmdHash(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/a.txt"] = []byte("hello world")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	msg := expect(t, c, 213, "HASH /a.txt")
+	if want := "SHA-256 0-10 b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9 /a.txt"; msg != want {
+		t.Errorf("got %q, want %q", msg, want)
+	}
+
+	if msg := expect(t, c, 200, "OPTS HASH md5"); msg != "MD5" {
+		t.Errorf("got %q, want %q", msg, "MD5")
+	}
+	expect(t, c, 504, "OPTS HASH SHA-3")
+	if msg := expect(t, c, 211, "FEAT"); !strings.Contains(msg, " HASH SHA-1;SHA-256;SHA-512;MD5*;CRC32") {
+		t.Errorf("FEAT does not list the selected algorithm: %q", msg)
+	}
+
+	// The range only applies to the next HASH.
+	expect(t, c, 350, "RANG 6 10")
+	if msg := expect(t, c, 213, "HASH /a.txt"); msg != "MD5 6-10 7d793037a0760186574b0282f2f435e7 /a.txt" {
+		t.Errorf("got %q", msg)
+	}
+	if msg := expect(t, c, 213, "HASH /a.txt"); msg != "MD5 0-10 5eb63bbbe01eeed093cb22bb8f5acdc3 /a.txt" {
+		t.Errorf("got %q", msg)
+	}
+
+	expect(t, c, 501, "RANG 5 1")
+	expect(t, c, 350, "RANG 20 30")
+	expect(t, c, 556, "HASH /a.txt")
+	expect(t, c, 550, "HASH /missing.txt")
+}
+
+func TestCmdRename(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{Auth: &rootAuth{SimpleAuth{Name: "admin", Password: "admin"}}})
+	for _, dir := range []string{"/home", "/home/admin", "/home/admin/dir"} {
+		driver.dirs[dir] = true
+	}
+	driver.files["/home/admin/a.txt"] = []byte("a")
+	driver.files["/etc/passwd"] = []byte("root:x:0:0")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	expect(t, c, 350, "RNFR a.txt")
+	expect(t, c, 250, "RNTO b.txt")
+	expect(t, c, 350, "RNFR /b.txt")
+	expect(t, c, 250, "RNTO dir/c.txt")
+	if got := driver.testFile("/home/admin/dir/c.txt"); got != "a" {
+		t.Fatalf("got %q, want the file moved into dir", got)
+	}
+	expect(t, c, 250, "CWD dir")
+	expect(t, c, 350, "RNFR c.txt")
+	expect(t, c, 250, "RNTO ../d.txt")
+	if got := driver.testFile("/home/admin/d.txt"); got != "a" {
+		t.Fatalf("got %q, want the file moved back up", got)
+	}
+
+	// RNTO needs an RNFR right before it.
+	expect(t, c, 250, "CWD /")
+	expect(t, c, 503, "RNTO e.txt")
+	expect(t, c, 350, "RNFR /d.txt")
+	expect(t, c, 200, "NOOP")
+	expect(t, c, 503, "RNTO e.txt")
+	expect(t, c, 350, "RNFR /d.txt")
+	expect(t, c, 250, "RNTO e.txt")
+	expect(t, c, 503, "RNTO f.txt")
+	expect(t, c, 550, "RNFR /missing.txt")
+	expect(t, c, 503, "RNTO f.txt")
+
+	// Both paths stay within the root.
+	expect(t, c, 550, "RNFR ../../../etc/passwd")
+	driver.dirs["/home/admin/etc"] = true
+	expect(t, c, 350, "RNFR /e.txt")
+	expect(t, c, 250, "RNTO ../../../etc/passwd")
+	if got := driver.testFile("/etc/passwd"); got != "root:x:0:0" {
+		t.Errorf("got %q, want /etc/passwd untouched", got)
+	}
+	if got := driver.testFile("/home/admin/etc/passwd"); got != "a" {
+		t.Errorf("got %q, want the file moved within the root", got)
+	}
+}
+
+func TestCmdReadOnly(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{ReadOnly: true})
+	driver.files["/a.txt"] = []byte("hello")
+	driver.dirs["/dir"] = true
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	for _, cmd := range []string{
+		"STOR /b.txt",
+		"STOU /c.txt",
+		"APPE /a.txt",
+		"DELE /a.txt",
+		"MKD /new",
+		"RMD /dir",
+		"XRMD /dir",
+		"RNFR /a.txt",
+		"RNTO /b.txt",
+		"MFMT 20200304050607 /a.txt",
+	} {
+		if msg := expect(t, c, 550, "%s", cmd); msg != "Read-only server" {
+			t.Errorf("%s: got %q", cmd, msg)
+		}
+	}
+	if got := driver.testFile("/a.txt"); got != "hello" {
+		t.Errorf("got %q, want the file unchanged", got)
+	}
+	if !driver.dirs["/dir"] {
+		t.Error("expected /dir to be kept")
+	}
+
+	if got := download(t, c, "RETR /a.txt"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+	if got := download(t, c, "LIST /"); !strings.Contains(got, "a.txt") {
+		t.Errorf("got listing %q", got)
+	}
+}
+
+func TestCmdDisabled(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{DisabledCommands: []string{"port", "EPRT", "SITE", "DELE"}})
+	driver.files["/a.txt"] = []byte("hello")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	for _, cmd := range []string{
+		"PORT 127,0,0,1,4,1",
+		"port 127,0,0,1,4,1",
+		"EPRT |1|127.0.0.1|1025|",
+		"SITE CHMOD 600 /a.txt",
+		"DELE /a.txt",
+		"DELE",
+	} {
+		if msg := expect(t, c, 502, "%s", cmd); msg != "Command not implemented" {
+			t.Errorf("%s: got %q", cmd, msg)
+		}
+	}
+	if got := driver.testFile("/a.txt"); got != "hello" {
+		t.Errorf("got %q, want the file unchanged", got)
+	}
+	if driver.modes["/a.txt"] != 0 {
+		t.Error("expected the mode to be unchanged")
+	}
+
+	// Passive mode still works.
+	if got := download(t, c, "RETR /a.txt"); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+	expect(t, c, 213, "SIZE /a.txt")
+	c.Cmd("FEAT")
+	_, msg, err := c.ReadResponse(211)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(msg, "EPRT") || !strings.Contains(msg, "EPSV") {
+		t.Errorf("got features %q, want EPSV without EPRT", msg)
+	}
+
+	bad := NewServer(&ServerOpts{Factory: newTestDriverFactory(), DisabledCommands: []string{"FOO"}, Logger: new(DiscardLogger)})
+	if err := bad.prepare(); err == nil {
+		t.Error("expected an error for an unknown command")
+	}
+}
+
+func TestCmdDataConnMode(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{DataConnMode: DataConnPassiveOnly})
+	driver.files["/a.txt"] = []byte("hello")
+	c := dialTestServer(t, s)
+	login(t, c)
+	expect(t, c, 500, "PORT 127,0,0,1,4,1")
+	expect(t, c, 500, "EPRT |1|127.0.0.1|1025|")
+	if got := download(t, c, "RETR /a.txt"); got != "hello" {
+		t.Errorf("passive only: got %q, want %q", got, "hello")
+	}
+	expect(t, c, 229, "EPSV")
+
+	s, driver = newTestServer(t, &ServerOpts{DataConnMode: DataConnActiveOnly})
+	driver.files["/a.txt"] = []byte("hello")
+	c = dialTestServer(t, s)
+	login(t, c)
+	expect(t, c, 500, "PASV")
+	expect(t, c, 500, "EPSV")
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	expect(t, c, 200, "EPRT |1|127.0.0.1|%d|", l.Addr().(*net.TCPAddr).Port)
+	data, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	expect(t, c, 150, "RETR /a.txt")
+	if got, _ := ioutil.ReadAll(data); string(got) != "hello" {
+		t.Errorf("active only: got %q, want %q", got, "hello")
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := NewServer(&ServerOpts{Factory: newTestDriverFactory(), DataConnMode: 3, Logger: new(DiscardLogger)})
+	if err := bad.prepare(); err == nil {
+		t.Error("expected an error for an invalid mode")
+	}
+}
+
+func TestCmdUTF8(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	if msg := expect(t, c, 211, "FEAT"); !strings.Contains(msg, "\n UTF8\n") {
+		t.Errorf("FEAT does not list UTF8: %q", msg)
+	}
+	if conn := driver.lastConn(); conn.UTF8() {
+		t.Error("UTF8 enabled before OPTS UTF8 ON")
+	}
+	expect(t, c, 200, "OPTS UTF8 ON")
+	if conn := driver.lastConn(); !conn.UTF8() {
+		t.Error("UTF8 not enabled after OPTS UTF8 ON")
+	}
+
+	// The name of the second file ends with a no-break space.
+	dir := "/données"
+	expect(t, c, 257, "MKD %s", dir)
+	for _, name := range []string{"日本語 ファイル.txt", "naïve "} {
+		p := dir + "/" + name
+		upload(t, c, p, "content of "+name)
+		if got := driver.testFile(p); got != "content of "+name {
+			t.Errorf("%q: got %q in the driver", name, got)
+		}
+		if got := download(t, c, "RETR %s", p); got != "content of "+name {
+			t.Errorf("%q: got %q", name, got)
+		}
+		if got := download(t, c, "LIST %s", dir); !strings.Contains(got, " "+name+"\r\n") {
+			t.Errorf("%q: got listing %q", name, got)
+		}
+		if got := download(t, c, "NLST %s", dir); !strings.Contains(got, name+"\r\n") {
+			t.Errorf("%q: got names %q", name, got)
+		}
+	}
+}
+
+func TestCmdFeat(t *testing.T) {
+	s, _ := newTestServer(t, &ServerOpts{})
+	c := dialTestServer(t, s)
+	plain := expect(t, c, 211, "FEAT")
+	for _, feat := range []string{"EPRT", "EPSV", "MDTM", "MFMT", "MLSD", "SIZE", "REST STREAM", "UTF8"} {
+		if !strings.Contains(plain, "\n "+feat+"\n") {
+			t.Errorf("FEAT does not list %s: %q", feat, plain)
+		}
+	}
+	for _, feat := range []string{"AUTH TLS", "PBSZ", "PROT"} {
+		if strings.Contains(plain, "\n "+feat+"\n") {
+			t.Errorf("FEAT lists %s without TLS: %q", feat, plain)
+		}
+	}
+	if again := expect(t, c, 211, "FEAT"); again != plain {
+		t.Errorf("FEAT changed from %q to %q", plain, again)
+	}
+
+	certFile, keyFile := testCertFiles(t)
+	s, _ = newTestServer(t, &ServerOpts{TLS: true, ExplicitFTPS: true, CertFile: certFile, KeyFile: keyFile})
+	c = dialTestServer(t, s)
+	secure := expect(t, c, 211, "FEAT")
+	for _, feat := range []string{"AUTH TLS", "PBSZ", "PROT", "SIZE"} {
+		if !strings.Contains(secure, "\n "+feat+"\n") {
+			t.Errorf("FEAT does not list %s with TLS: %q", feat, secure)
+		}
+	}
+	if again := expect(t, c, 211, "FEAT"); again != secure {
+		t.Errorf("FEAT changed from %q to %q", secure, again)
+	}
+
+	s, _ = newTestServer(t, &ServerOpts{Factory: basicDriverFactory{newTestDriverFactory().driver}})
+	c = dialTestServer(t, s)
+	if msg := expect(t, c, 211, "FEAT"); strings.Contains(msg, "MFMT") {
+		t.Errorf("FEAT lists MFMT for a driver without Chtimes: %q", msg)
+	}
+}
+
+func TestCmdNlst(t *testing.T) {
+	for _, opts := range []*ServerOpts{{}, {RateLimit: 1 << 20}} {
+		s, driver := newTestServer(t, opts)
+		driver.dirs["/dir"] = true
+		driver.dirs["/dir/sub"] = true
+		driver.dirs["/empty"] = true
+		driver.files["/dir/a.txt"] = []byte("a")
+		driver.files["/dir/b c.txt"] = []byte("bc")
+		c := dialTestServer(t, s)
+		login(t, c)
+
+		want := "a.txt\r\nb c.txt\r\nsub\r\n"
+		if got := download(t, c, "NLST /dir"); got != want {
+			t.Errorf("NLST /dir: got %q, want %q", got, want)
+		}
+		var names []string
+		for _, line := range strings.Split(strings.TrimSuffix(download(t, c, "LIST /dir"), "\r\n"), "\r\n") {
+			names = append(names, line[strings.LastIndex(line, ":")+4:])
+		}
+		if got := strings.Join(names, "\r\n") + "\r\n"; got != want {
+			t.Errorf("LIST /dir lists %q, NLST %q", got, want)
+		}
+
+		expect(t, c, 250, "CWD /dir")
+		if got := download(t, c, "NLST"); got != want {
+			t.Errorf("NLST in /dir: got %q, want %q", got, want)
+		}
+		if got := download(t, c, "NLST sub"); got != "" {
+			t.Errorf("NLST sub: got %q, want nothing", got)
+		}
+		if got := download(t, c, "NLST /empty"); got != "" {
+			t.Errorf("NLST /empty: got %q, want nothing", got)
+		}
+		if got := download(t, c, "LIST /empty"); got != "" {
+			t.Errorf("LIST /empty: got %q, want nothing", got)
+		}
+
+		expect(t, c, 550, "NLST /missing")
+		expect(t, c, 150, "NLST /dir")
+		if _, _, err := c.ReadResponse(425); err != nil {
+			t.Errorf("NLST without a data connection: %v", err)
+		}
+	}
+}
+
+func TestCmdStat(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.dirs["/dir"] = true
+	driver.dirs["/dir/sub"] = true
+	driver.files["/dir/a.txt"] = []byte("a")
+	driver.files["/big"] = bytes.Repeat([]byte("x"), 16<<20)
+	c := dialTestServer(t, s)
+	expect(t, c, 530, "STAT")
+	login(t, c)
+	expect(t, c, 200, "TYPE A")
+
+	msg := expect(t, c, 211, "STAT")
+	for _, want := range []string{"Logged in as admin", "TYPE: ASCII, MODE: STREAM", "No data transfer in progress"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("STAT: %q lacks %q", msg, want)
+		}
+	}
+
+	// Paths are listed on the control connection, like LIST does.
+	want := "Status of /dir\n" + strings.Replace(download(t, c, "LIST /dir"), "\r\n", "\n", -1) + "END"
+	if msg := expect(t, c, 212, "STAT /dir"); msg != want {
+		t.Errorf("STAT /dir: got %q, want %q", msg, want)
+	}
+	expect(t, c, 250, "CWD /dir")
+	if msg := expect(t, c, 213, "STAT a.txt"); !strings.HasPrefix(msg, "Status of /dir/a.txt\n-") || !strings.HasSuffix(msg, " a.txt\nEND") {
+		t.Errorf("STAT a.txt: got %q", msg)
+	}
+	if msg := expect(t, c, 212, "STAT sub"); msg != "Status of /dir/sub\nEND" {
+		t.Errorf("STAT sub: got %q", msg)
+	}
+	expect(t, c, 550, "STAT /missing")
+
+	// STAT is answered during a transfer.
+	expect(t, c, 200, "TYPE I")
+	data := openPassive(t, c)
+	defer data.Close()
+	expect(t, c, 150, "RETR /big")
+	if _, err := io.ReadFull(data, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expect(t, c, 211, "STAT"); !strings.Contains(msg, "Transfer in progress: RETR /big, 0 bytes received, ") {
+		t.Errorf("STAT during RETR: got %q", msg)
+	}
+	if n, err := io.Copy(ioutil.Discard, data); err != nil || n != 16<<20-1 {
+		t.Fatalf("got %d bytes, %v", n, err)
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 200, "NOOP")
+}
+
+func TestCmdStou(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.dirs["/dir"] = true
+	driver.files["/dir/report.txt"] = []byte("old")
+	c := dialTestServer(t, s)
+	login(t, c)
+	expect(t, c, 250, "CWD /dir")
+
+	// stou uploads content with STOU param and returns the chosen name.
+	stou := func(c *textproto.Conn, param, content string) string {
+		t.Helper()
+		data := openPassive(t, c)
+		msg := expect(t, c, 150, "STOU %s", param)
+		data.Write([]byte(content))
+		data.Close()
+		_, done, err := c.ReadResponse(226)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := strings.TrimPrefix(msg, "FILE: ")
+		if !strings.HasSuffix(done, "FILE: "+name) {
+			t.Errorf("226 reply %q doesn't name %q", done, name)
+		}
+		return name
+	}
+
+	random := stou(c, "", "random")
+	if strings.Contains(random, "/") || random == "" {
+		t.Fatalf("got name %q", random)
+	}
+	if got := driver.testFile("/dir/" + random); got != "random" {
+		t.Errorf("got %q in %s", got, random)
+	}
+	if other := stou(c, "", "other"); other == random {
+		t.Errorf("got %q twice", other)
+	}
+
+	if name := stou(c, "report.txt", "new"); name != "report.txt.1" {
+		t.Errorf("got name %q, want report.txt.1", name)
+	}
+	if got := driver.testFile("/dir/report.txt"); got != "old" {
+		t.Errorf("existing file overwritten with %q", got)
+	}
+	if name := stou(c, "fresh.txt", "fresh"); name != "fresh.txt" {
+		t.Errorf("got name %q, want fresh.txt", name)
+	}
+
+	// Concurrent uploads under the same base name get different names.
+	conns := []*textproto.Conn{dialTestServer(t, s), dialTestServer(t, s)}
+	var datas []net.Conn
+	var names []string
+	for _, c := range conns {
+		login(t, c)
+		data := openPassive(t, c)
+		datas = append(datas, data)
+		names = append(names, strings.TrimPrefix(expect(t, c, 150, "STOU /dir/report.txt"), "FILE: "))
+	}
+	if names[0] == names[1] {
+		t.Fatalf("concurrent STOU both got %q", names[0])
+	}
+	for i, c := range conns {
+		datas[i].Write([]byte(names[i]))
+		datas[i].Close()
+		if _, _, err := c.ReadResponse(226); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range names {
+		if got := driver.testFile("/dir/" + name); got != name {
+			t.Errorf("got %q in %s", got, name)
+		}
+	}
+}
+
+func TestCmdAppe(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/log.txt"] = []byte("hello")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	appe := func(p, content string) string {
+		t.Helper()
+		data := openPassive(t, c)
+		expect(t, c, 150, "APPE %s", p)
+		data.Write([]byte(content))
+		data.Close()
+		_, msg, err := c.ReadResponse(226)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	if msg := appe("/log.txt", " world"); msg != "OK, received 6 bytes" {
+		t.Errorf("got %q", msg)
+	}
+	if got := driver.testFile("/log.txt"); got != "hello world" {
+		t.Errorf("got %q, want %q", got, "hello world")
+	}
+	if msg := expect(t, c, 213, "SIZE /log.txt"); msg != "11" {
+		t.Errorf("got size %s, want 11", msg)
+	}
+
+	if msg := appe("/new.txt", "created"); msg != "OK, received 7 bytes" {
+		t.Errorf("got %q", msg)
+	}
+	if got := driver.testFile("/new.txt"); got != "created" {
+		t.Errorf("got %q, want %q", got, "created")
+	}
+
+	// STOR still replaces the file afterwards.
+	upload(t, c, "/log.txt", "replaced")
+	if got := driver.testFile("/log.txt"); got != "replaced" {
+		t.Errorf("got %q after STOR, want %q", got, "replaced")
+	}
+
+	expect(t, c, 553, "APPE")
+	expect(t, c, 425, "APPE /log.txt")
+}
+
+func TestCmdType(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	const mixed = "unix\nwindows\r\nlone\rcr\n\x00\xff\n"
+	const asCRLF = "unix\r\nwindows\r\nlone\rcr\r\n\x00\xff\r\n"
+	const asLF = "unix\nwindows\nlone\rcr\n\x00\xff\n"
+	driver.files["/mixed.txt"] = []byte(mixed)
+
+	// Binary is the default and leaves content alone both ways.
+	if got := download(t, c, "RETR /mixed.txt"); got != mixed {
+		t.Errorf("binary RETR: got %q, want %q", got, mixed)
+	}
+	upload(t, c, "/binary.txt", mixed)
+	if got := driver.testFile("/binary.txt"); got != mixed {
+		t.Errorf("binary STOR: got %q, want %q", got, mixed)
+	}
+
+	expect(t, c, 200, "TYPE A")
+	if got := download(t, c, "RETR /mixed.txt"); got != asCRLF {
+		t.Errorf("ASCII RETR: got %q, want %q", got, asCRLF)
+	}
+	upload(t, c, "/ascii.txt", asCRLF)
+	if got := driver.testFile("/ascii.txt"); got != asLF {
+		t.Errorf("ASCII STOR: got %q, want %q", got, asLF)
+	}
+	// Listings are already in CRLF.
+	if got := download(t, c, "NLST /"); got != "ascii.txt\r\nbinary.txt\r\nmixed.txt\r\n" {
+		t.Errorf("ASCII NLST: got %q", got)
+	}
+
+	expect(t, c, 200, "TYPE I")
+	if got := download(t, c, "RETR /mixed.txt"); got != mixed {
+		t.Errorf("RETR after TYPE I: got %q, want %q", got, mixed)
+	}
+
+	expect(t, c, 200, "TYPE A N")
+	expect(t, c, 200, "TYPE L 8")
+	expect(t, c, 500, "TYPE E")
+}
+
+func TestCmdTypeDefault(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{DefaultTransferType: TransferASCII})
+	c := dialTestServer(t, s)
+	login(t, c)
+	driver.files["/unix.txt"] = []byte("a\nb\n")
+
+	// ASCII applies without TYPE.
+	if got := download(t, c, "RETR /unix.txt"); got != "a\r\nb\r\n" {
+		t.Errorf("default RETR: got %q", got)
+	}
+
+	// TYPE I lasts across other commands and transfers.
+	expect(t, c, 200, "TYPE I")
+	expect(t, c, 257, "PWD")
+	expect(t, c, 213, "SIZE /unix.txt")
+	download(t, c, "NLST /")
+	upload(t, c, "/copy.txt", "c\r\n")
+	if got := download(t, c, "RETR /unix.txt"); got != "a\nb\n" {
+		t.Errorf("RETR after other commands: got %q", got)
+	}
+	if got := driver.testFile("/copy.txt"); got != "c\r\n" {
+		t.Errorf("STOR after other commands: got %q", got)
+	}
+
+	// REIN restores the default and logs out.
+	expect(t, c, 250, "CWD /")
+	expect(t, c, 220, "REIN")
+	expect(t, c, 530, "PWD")
+	login(t, c)
+	if got := download(t, c, "RETR /unix.txt"); got != "a\r\nb\r\n" {
+		t.Errorf("RETR after REIN: got %q", got)
+	}
+
+	bad := NewServer(&ServerOpts{Factory: newTestDriverFactory(), DefaultTransferType: 2, Logger: new(DiscardLogger)})
+	if err := bad.prepare(); err == nil {
+		t.Error("expected an error for an invalid DefaultTransferType")
+	}
+}
+
+func TestCmdRein(t *testing.T) {
+	certFile, keyFile := testCertFiles(t)
+	s, driver := newTestServer(t, &ServerOpts{TLS: true, ExplicitFTPS: true, CertFile: certFile, KeyFile: keyFile})
+	driver.files["/unix.txt"] = []byte("a\nb\n")
+	c := dialExplicitTLS(t, s, &tls.Config{InsecureSkipVerify: true})
+	expect(t, c, 257, "MKD /dir")
+	expect(t, c, 250, "CWD /dir")
+	expect(t, c, 200, "TYPE A")
+	expect(t, c, 200, "PBSZ 0")
+	expect(t, c, 200, "PROT P")
+	expect(t, c, 200, "EPSV ALL")
+	port := epsvPort(t, expect(t, c, 229, "EPSV"))
+	expect(t, c, 350, "REST 2")
+
+	expect(t, c, 220, "REIN")
+	// The pending passive listener is closed.
+	if data, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		data.Close()
+		t.Error("expected the passive listener to be closed")
+	}
+	if conns := s.ActiveConns(); len(conns) != 1 || conns[0].User != "" {
+		t.Errorf("got connections %+v, want one without a user", conns)
+	}
+	expect(t, c, 530, "PWD")
+	login(t, c)
+	if msg := expect(t, c, 257, "PWD"); !strings.HasPrefix(msg, `"/"`) {
+		t.Errorf("got %q, want the root", msg)
+	}
+	// The data connection is closed and EPSV ALL forgotten.
+	expect(t, c, 150, "LIST")
+	if _, _, err := c.ReadResponse(425); err != nil {
+		t.Error(err)
+	}
+	// Data connections are in the clear again, transfers binary and from
+	// the start.
+	expect(t, c, 503, "PROT P")
+	if got := download(t, c, "RETR /unix.txt"); got != "a\nb\n" {
+		t.Errorf("RETR after REIN: got %q, want %q", got, "a\nb\n")
+	}
+}
+
+// freeSpaceDriver is a testDriver with a fixed amount of free space.
+type freeSpaceDriver struct {
+	*testDriver
+	free int64
+}
+
+func (driver *freeSpaceDriver) FreeSpace(p string) (int64, error) {
+	return driver.free, nil
+}
+
+type freeSpaceDriverFactory struct {
+	driver *freeSpaceDriver
+}
+
+func (factory freeSpaceDriverFactory) NewDriver() (Driver, error) {
+	return factory.driver, nil
+}
+
+func TestCmdAllo(t *testing.T) {
+	// Without a checker ALLO is a no-op.
+	s, _ := newTestServer(t, &ServerOpts{})
+	c := dialTestServer(t, s)
+	expect(t, c, 202, "ALLO 100")
+	login(t, c)
+	expect(t, c, 202, "ALLO 100")
+	expect(t, c, 202, "ALLO")
+
+	driver := &freeSpaceDriver{newTestDriverFactory().driver, 100}
+	s, _ = newTestServer(t, &ServerOpts{Factory: freeSpaceDriverFactory{driver}})
+	c = dialTestServer(t, s)
+	login(t, c)
+	expect(t, c, 200, "ALLO 100")
+	expect(t, c, 200, "ALLO 100 R 10")
+	expect(t, c, 552, "ALLO 101")
+	expect(t, c, 501, "ALLO")
+	expect(t, c, 501, "ALLO -1")
+	expect(t, c, 501, "ALLO lots")
+}
+
+func TestCmdSiteChmod(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/a file.txt"] = []byte("hello")
+	driver.dirs["/dir"] = true
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	for _, tt := range []struct {
+		cmd  string
+		path string
+		want os.FileMode
+	}{
+		{"SITE CHMOD 644 /a file.txt", "/a file.txt", 0644},
+		{"site chmod 0600 /a file.txt", "/a file.txt", 0600},
+		{"SITE CHMOD 755 dir", "/dir", 0755},
+		{"SITE CHMOD 4750 /dir", "/dir", os.ModeSetuid | 0750},
+		{"SITE CHMOD 1777 /dir", "/dir", os.ModeSticky | 0777},
+	} {
+		expect(t, c, 200, "%s", tt.cmd)
+		if got := driver.modes[tt.path]; got != tt.want {
+			t.Errorf("%s: got mode %v, want %v", tt.cmd, got, tt.want)
+		}
+	}
+
+	for _, cmd := range []string{"SITE CHMOD", "SITE CHMOD 644", "SITE CHMOD rwx /dir", "SITE CHMOD 8 /dir", "SITE CHMOD 17777 /dir", "SITE CHMOD -1 /dir"} {
+		expect(t, c, 501, "%s", cmd)
+	}
+	expect(t, c, 550, "SITE CHMOD 644 /missing.txt")
+	expect(t, c, 504, "SITE UNKNOWN")
+
+	basic, _ := newTestServer(t, &ServerOpts{Factory: basicDriverFactory{driver}})
+	c = dialTestServer(t, basic)
+	login(t, c)
+	if msg := expect(t, c, 550, "SITE CHMOD 644 /dir"); msg != "SITE CHMOD not supported" {
+		t.Errorf("got %q", msg)
+	}
+
+	readOnly, _ := newTestServer(t, &ServerOpts{Factory: &testDriverFactory{driver}, ReadOnly: true})
+	c = dialTestServer(t, readOnly)
+	login(t, c)
+	expect(t, c, 550, "SITE CHMOD 600 /dir")
+	if got := driver.modes["/dir"]; got != os.ModeSticky|0777 {
+		t.Errorf("read-only server changed the mode to %v", got)
+	}
+}
+
+func TestCmdSiteHandler(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	var gotConn *Conn
+	var gotArgs string
+	s.HandleSite("who", func(conn *Conn, args string) (int, string) {
+		gotConn, gotArgs = conn, args
+		return 200, "admin\nguest"
+	})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	if msg := expect(t, c, 200, "SITE WHO  all users"); msg != "admin\nguest" {
+		t.Errorf("got reply %q", msg)
+	}
+	if gotConn != driver.lastConn() || gotArgs != " all users" {
+		t.Errorf("got args %q", gotArgs)
+	}
+	expect(t, c, 200, "site Who")
+	if gotArgs != "" {
+		t.Errorf("got args %q, want none", gotArgs)
+	}
+
+	// Handlers may replace built-in subcommands, and be removed again.
+	s.HandleSite("CHMOD", func(conn *Conn, args string) (int, string) {
+		return 550, "Not here"
+	})
+	expect(t, c, 550, "SITE CHMOD 644 /")
+	s.HandleSite("WHO", nil)
+	expect(t, c, 530, "SITE WHO") // the built-in one, for admins only
+	expect(t, c, 504, "SITE HELLO")
+}
+
+func TestCmdSiteWho(t *testing.T) {
+	s, _ := newTestServer(t, &ServerOpts{
+		Auth:       &MultiUserAuth{},
+		AdminUsers: []string{"root"},
+	})
+	auth := s.Auth.(*MultiUserAuth)
+	auth.AddUser("root", "secret", newTestDriverFactory(), UserPermissions{})
+	auth.AddUser("guest", "guest", newTestDriverFactory(), UserPermissions{})
+
+	guest := dialTestServer(t, s)
+	expect(t, guest, 530, "SITE WHO")
+	expect(t, guest, 331, "USER guest")
+	expect(t, guest, 230, "PASS guest")
+	expect(t, guest, 530, "SITE WHO")
+	dialTestServer(t, s) // not logged in
+
+	root := dialTestServer(t, s)
+	expect(t, root, 331, "USER root")
+	expect(t, root, 230, "PASS secret")
+	msg := expect(t, root, 200, "SITE WHO")
+	lines := strings.Split(msg, "\n")
+	if len(lines) != 4 || lines[0] != "3 sessions connected" {
+		t.Fatalf("got %q, want three sessions", msg)
+	}
+	conns := s.ActiveConns()
+	for i, want := range []string{"guest " + conns[0].RemoteAddr + " idle", "- " + conns[1].RemoteAddr + " idle", "root " + conns[2].RemoteAddr + " SITE WHO"} {
+		if got := lines[i+1]; got != conns[i].SessionID+" "+want {
+			t.Errorf("line %d: got %q, want %q", i+1, got, conns[i].SessionID+" "+want)
+		}
+	}
+}
+
+// lazyDriver is a testDriver listing /huge with entries made up as they are
+// asked for, without holding them.
+type lazyDriver struct {
+	*testDriver
+	entries int
+	// listed is sent the number of entries listed so far every pauseEvery
+	// entries, and the listing waits for a reply on resume
+	pauseEvery int
+	listed     chan int
+	resume     chan struct{}
+	err        error // returned after all entries
+}
+
+func (driver *lazyDriver) Stat(p string) (FileInfo, error) {
+	if p == "/huge" {
+		return testFileInfo{name: "huge", isDir: true}, nil
+	}
+	return driver.testDriver.Stat(p)
+}
+
+func (driver *lazyDriver) ListDir(p string, callback func(FileInfo) error) error {
+	if p != "/huge" {
+		return driver.testDriver.ListDir(p, callback)
+	}
+	for i := 0; i < driver.entries; i++ {
+		if driver.pauseEvery > 0 && i > 0 && i%driver.pauseEvery == 0 {
+			driver.listed <- i
+			<-driver.resume
+		}
+		if err := callback(testFileInfo{name: fmt.Sprintf("file%07d", i)}); err != nil {
+			return err
+		}
+	}
+	return driver.err
+}
+
+type lazyDriverFactory struct {
+	driver *lazyDriver
+}
+
+func (factory lazyDriverFactory) NewDriver() (Driver, error) {
+	return factory.driver, nil
+}
+
+func TestCmdListStreaming(t *testing.T) {
+	const entries = 200000
+	driver := &lazyDriver{
+		testDriver: newTestDriverFactory().driver,
+		entries:    entries,
+		pauseEvery: 20000,
+		listed:     make(chan int),
+		resume:     make(chan struct{}),
+	}
+	s, _ := newTestServer(t, &ServerOpts{Factory: lazyDriverFactory{driver}})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	data := openPassive(t, c)
+	defer data.Close()
+	expect(t, c, 150, "NLST /huge")
+	// While the driver is paused, everything it listed but one buffer has
+	// reached the client, so the server holds no more than that.
+	received := 0
+	buf := make([]byte, 64*1024)
+	for {
+		var listed int
+		select {
+		case listed = <-driver.listed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("listing stalled")
+		}
+		want := listed*len("file0000000\r\n") - s.DataBufferSize
+		data.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for received < want {
+			n, err := data.Read(buf)
+			if err != nil {
+				t.Fatalf("got %d bytes after %d entries were listed: %v", received, listed, err)
+			}
+			received += n
+		}
+		driver.resume <- struct{}{}
+		if listed+driver.pauseEvery >= entries {
+			break
+		}
+	}
+	rest, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received += len(rest); received != entries*len("file0000000\r\n") {
+		t.Errorf("got %d bytes, want %d", received, entries*len("file0000000\r\n"))
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCmdListDriverError(t *testing.T) {
+	driver := &lazyDriver{
+		testDriver: newTestDriverFactory().driver,
+		entries:    10,
+		err:        errors.New("directory vanished"),
+	}
+	s, _ := newTestServer(t, &ServerOpts{Factory: lazyDriverFactory{driver}})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	for _, cmd := range []string{"LIST /huge", "NLST /huge", "MLSD /huge"} {
+		data := openPassive(t, c)
+		expect(t, c, 150, "%s", cmd)
+		if _, err := ioutil.ReadAll(data); err != nil {
+			t.Errorf("%s: %v", cmd, err)
+		}
+		data.Close()
+		if _, _, err := c.ReadResponse(426); err != nil {
+			t.Errorf("%s: %v", cmd, err)
+		}
+	}
+}
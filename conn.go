@@ -6,36 +6,63 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	mrand "math/rand"
 	"net"
+	"path"
 	"path/filepath"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 const (
-	defaultWelcomeMessage = "Welcome to the Go FTP Server"
+	defaultWelcomeMessage       = "Welcome to the Go FTP Server"
+	defaultPassiveAcceptTimeout = 60 * time.Second
+	implicitTLSHandshakeTimeout = 10 * time.Second
+	defaultActiveDialTimeout    = 30 * time.Second
+	defaultDataBufferSize       = 32 * 1024
+	minDataBufferSize           = 4096
 )
 
 type Conn struct {
+	ctx           context.Context
+	cancel        context.CancelFunc
 	conn          net.Conn
 	controlReader *bufio.Reader
 	controlWriter *bufio.Writer
+	writeLock     sync.Mutex // serializes replies sent during a transfer
 	dataConn      DataSocket
+	dataTracked   *trackedSocket // dataConn as registered for GracefulShutdown
+	dataReady     func() error   // waits for the client to connect to a passive dataConn
 	driver        Driver
+	sessionDriver Driver // the driver of the DriverFactory, until a login replaces it
 	auth          Auth
-	logger        Logger
+	logger        LeveledLogger
 	server        *Server
 	tlsConfig     *tls.Config
 	sessionID     string
-	namePrefix    string
+	namePrefix    string // the working directory, relative to root
+	root          string // the directory the user is jailed to, if any
+	readOnly      bool   // the user may not change files
+	maxUpload     int64  // UserPermissions.MaxUploadSize
+	maxDownload   int64  // UserPermissions.MaxDownloadSize
+	utf8          bool   // the client sent OPTS UTF8 ON
+	asciiMode     bool   // TYPE A, line endings are translated
+	deflate       bool   // MODE Z, data is compressed
+	epsvAll       bool   // EPSV ALL was sent, other data commands are refused
+	running       int32  // 1 while a command runs, accessed atomically
+	session       *session
 	reqUser       string
 	user          string
 	renameFrom    string
@@ -43,55 +70,138 @@ type Conn struct {
 	appendData    bool
 	closed        bool
 	tls           bool
+	pbsz          bool // PBSZ was accepted, so PROT may follow
+	dataTLS       bool // PROT P is in effect
+	implicitTLS   bool
+	nextCommand   func()
+	dataLock      sync.Mutex
+	dataCancel    context.CancelFunc
+	stats         sessionStats
+	mlstFacts     []string // facts selected with OPTS MLST
+	hashAlgorithm string   // selected with OPTS HASH
+	rangeStart    int64    // byte range set with RANG
+	rangeEnd      int64    // inclusive, -1 for the end of the file
+}
+
+// commandLine is a line read from the control connection. The reader waits
+// for next to be called before it reads the following line.
+type commandLine struct {
+	line string
+	next func()
 }
 
 func (conn *Conn) LoginUser() string {
 	return conn.user
 }
 
+// SessionID returns the ID of the session, which all its log messages,
+// including those of data connections, are tagged with.
+func (conn *Conn) SessionID() string {
+	return conn.sessionID
+}
+
 func (conn *Conn) IsLogin() bool {
 	return len(conn.user) > 0
 }
 
+// UTF8 reports whether the client enabled UTF-8 with OPTS UTF8 ON. Paths
+// are always passed to the driver as received, which is UTF-8 for clients
+// following RFC 2640.
+func (conn *Conn) UTF8() bool {
+	return conn.utf8
+}
+
+// TLSConnectionState returns the state of the TLS session of the control
+// connection, like the negotiated cipher suite and the certificates of the
+// client, and false if the control connection is not encrypted.
+func (conn *Conn) TLSConnectionState() (tls.ConnectionState, bool) {
+	tlsConn, ok := conn.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// DataTLS reports whether data connections are encrypted, as requested by
+// the client with PROT P or implied by implicit FTPS.
+func (conn *Conn) DataTLS() bool {
+	return conn.dataTLS
+}
+
 func (conn *Conn) PublicIp() string {
 	return conn.server.PublicIp
 }
 
+// passiveListenIP returns the IP advertised to the client for passive data
+// connections. It is the result of PublicIpFunc or the configured PublicIp
+// if any, otherwise the local IP of the control connection. The passive
+// listener itself always binds locally.
 func (conn *Conn) passiveListenIP() string {
+	if conn.server.PublicIpFunc != nil {
+		if ip := conn.server.PublicIpFunc(conn.conn.LocalAddr(), conn.conn.RemoteAddr()); ip != "" {
+			return ip
+		}
+	}
 	if len(conn.PublicIp()) > 0 {
 		return conn.PublicIp()
 	}
-	return conn.conn.LocalAddr().String()
+	host, _, err := net.SplitHostPort(conn.conn.LocalAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
 }
 
-func (conn *Conn) PassivePort() int {
-	if len(conn.server.PassivePorts) > 0 {
-		portRange := strings.Split(conn.server.PassivePorts, "-")
-
-		if len(portRange) != 2 {
-			log.Println("empty port")
-			return 0
+// passiveBindHost returns the local IP passive listeners of network bind
+// to, or "" for all interfaces.
+func (conn *Conn) passiveBindHost(network string) string {
+	if conn.server.PassiveBindToControlLocalIP {
+		if addr, ok := conn.conn.LocalAddr().(*net.TCPAddr); ok && (addr.IP.To4() != nil) == (network == "tcp4") {
+			return addr.IP.String()
 		}
+	}
+	return conn.server.PassiveListenHost
+}
 
-		minPort, _ := strconv.Atoi(strings.TrimSpace(portRange[0]))
-		maxPort, _ := strconv.Atoi(strings.TrimSpace(portRange[1]))
+// dataNetwork returns the network of the control connection, "tcp4" or
+// "tcp6", for passive data connections to use the same. Without one, like
+// over a Unix socket, it is the network of the advertised IP.
+func (conn *Conn) dataNetwork() string {
+	if addr, ok := conn.conn.LocalAddr().(*net.TCPAddr); ok {
+		if addr.IP.To4() == nil {
+			return "tcp6"
+		}
+		return "tcp4"
+	}
+	if ip := net.ParseIP(conn.passiveListenIP()); ip != nil && ip.To4() == nil {
+		return "tcp6"
+	}
+	return "tcp4"
+}
 
-		return minPort + mrand.Intn(maxPort-minPort)
+// passivePeerIP returns the only IP passive data connections are accepted
+// from, or nil if any host may connect.
+func (conn *Conn) passivePeerIP() net.IP {
+	if !conn.server.RequireDataConnSameHost {
+		return nil
 	}
-	// let system automatically chose one port
-	return 0
+	if addr, ok := conn.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
 }
 
-// returns a random 20 char string that can be used as a unique session ID
+// sessionCounter numbers the sessions whose ID couldn't be made random.
+var sessionCounter uint64
+
+// newSessionID is the default SessionIDGenerator. It returns 16 random
+// bytes in hex.
 func newSessionID() string {
-	hash := sha256.New()
-	_, err := io.CopyN(hash, rand.Reader, 50)
-	if err != nil {
-		return "????????????????????"
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return fmt.Sprintf("%032x", atomic.AddUint64(&sessionCounter, 1))
 	}
-	md := hash.Sum(nil)
-	mdStr := hex.EncodeToString(md)
-	return mdStr[0:20]
+	return hex.EncodeToString(id)
 }
 
 // Serve starts an endless loop that reads FTP commands from the client and
@@ -100,43 +210,252 @@ func newSessionID() string {
 // goroutine, so use this channel to be notified when the connection can be
 // cleaned up.
 func (conn *Conn) Serve() {
-	conn.logger.Print(conn.sessionID, "Connection Established")
+	conn.logger.Infof(conn.sessionID, "Connection Established")
+	if conn.implicitTLS {
+		if err := conn.acceptImplicitTLS(); err != nil {
+			conn.logger.Warnf(conn.sessionID, "Implicit TLS handshake failed: %v", err)
+			conn.reset()
+			conn.logger.Infof(conn.sessionID, "Connection Terminated")
+			return
+		}
+	}
 	// send welcome
 	conn.writeMessage(220, conn.server.WelcomeMessage)
 	// read commands
-	for {
-		line, err := conn.controlReader.ReadString('\n')
-		if err != nil {
-			if err != io.EOF {
-				conn.logger.Print(conn.sessionID, fmt.Sprintln("read error:", err))
-			}
-
-			break
-		}
-		conn.receiveLine(line)
+	lines := make(chan commandLine)
+	go conn.readCommands(lines)
+	for cmd := range lines {
+		conn.nextCommand = cmd.next
+		atomic.StoreInt32(&conn.running, 1)
+		conn.receiveLine(cmd.line)
+		atomic.StoreInt32(&conn.running, 0)
+		conn.updateSession("", "")
 		// QUIT command closes connection, break to avoid error on reading from
 		// closed socket
 		if conn.closed == true {
 			break
 		}
+		cmd.next()
 	}
 	conn.Close()
-	conn.logger.Print(conn.sessionID, "Connection Terminated")
+	conn.logger.Infof(conn.sessionID, "Connection Terminated")
+}
+
+// readCommands reads lines from the control connection and hands them to
+// the Serve loop. The next line is only read once the previous command
+// completed or started a data transfer, so commands changing the control
+// connection, like AUTH, are never read past. An ABOR read during a
+// transfer aborts it right away.
+func (conn *Conn) readCommands(lines chan<- commandLine) {
+	defer close(lines)
+	for {
+		line, err := conn.readLine()
+		if err != nil {
+			if err != io.EOF && err != errControlIdle && conn.ctx.Err() == nil {
+				conn.logger.Warnf(conn.sessionID, "read error: %v", err)
+			}
+			// the client is gone, so don't let a running command wait
+			// for a data connection until the accept timeout
+			conn.cancel()
+			return
+		}
+
+		command, param := conn.parseLine(line)
+		if strings.ToUpper(command) == "ABOR" {
+			conn.abortTransfer()
+		}
+		if strings.ToUpper(command) == "STAT" && param == "" && atomic.LoadInt32(&conn.running) == 1 {
+			// the status of a transfer is wanted while it runs
+			conn.logger.PrintCommand(conn.sessionID, command, param)
+			conn.writeStatus(conn.runningCommand())
+			continue
+		}
+
+		next := make(chan struct{})
+		var once sync.Once
+		cmd := commandLine{line: line, next: func() { once.Do(func() { close(next) }) }}
+		select {
+		case lines <- cmd:
+		case <-conn.ctx.Done():
+			return
+		}
+		select {
+		case <-next:
+		case <-conn.ctx.Done():
+			return
+		}
+	}
+}
+
+// errControlIdle is returned by readLine once ControlIdleTimeout expired.
+var errControlIdle = errors.New("ftp: control connection idle")
+
+// readLine reads the next line from the control connection. If no command
+// arrives within ControlIdleTimeout while none is running, the client is
+// told with a 421 reply and errControlIdle is returned.
+func (conn *Conn) readLine() (string, error) {
+	timeout := conn.server.ControlIdleTimeout
+	var line string
+	for {
+		if timeout > 0 {
+			conn.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		part, err := conn.controlReader.ReadString('\n')
+		line += part
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && timeout > 0 {
+			if atomic.LoadInt32(&conn.running) == 1 {
+				// a data transfer is in progress
+				continue
+			}
+			conn.logger.Infof(conn.sessionID, "Control connection idle for %v, closing", timeout)
+			conn.writeMessage(421, "Idle timeout, closing control connection")
+			return line, errControlIdle
+		}
+		return line, err
+	}
+}
+
+// allowNextCommand lets the next command be read while the current one is
+// still running a data transfer, so the client can abort it.
+func (conn *Conn) allowNextCommand() {
+	if conn.nextCommand != nil {
+		conn.nextCommand()
+	}
+}
+
+// dataContext returns the context of a new data connection. It is cancelled
+// by ABOR, when another data connection is opened or when the control
+// connection closes.
+func (conn *Conn) dataContext() context.Context {
+	conn.dataLock.Lock()
+	defer conn.dataLock.Unlock()
+	if conn.dataCancel != nil {
+		conn.dataCancel()
+	}
+	ctx, cancel := context.WithCancel(conn.ctx)
+	conn.dataCancel = cancel
+	return ctx
+}
+
+// abortTransfer aborts the transfer on the current data connection, if any.
+func (conn *Conn) abortTransfer() {
+	conn.dataLock.Lock()
+	defer conn.dataLock.Unlock()
+	if conn.dataCancel != nil {
+		conn.dataCancel()
+		conn.dataCancel = nil
+	}
 }
 
 // Close will manually close this connection, even if the client isn't ready.
 func (conn *Conn) Close() {
+	if conn.cancel != nil {
+		conn.cancel()
+	}
 	conn.conn.Close()
 	conn.closed = true
-	if conn.dataConn != nil {
-		conn.dataConn.Close()
-		conn.dataConn = nil
+	conn.closeDataConn()
+}
+
+// dataDialer returns the dialer used to open active data connections, the
+// ActiveDialer if set.
+func (conn *Conn) dataDialer() Dialer {
+	if conn.server.ActiveDialer != nil {
+		return timeoutDialer{conn.server.ActiveDialer, conn.server.ActiveDialTimeout}
 	}
+	return conn.activeDialer()
+}
+
+// activeDialer returns the default dialer of active data connections.
+func (conn *Conn) activeDialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: conn.server.ActiveDialTimeout, KeepAlive: conn.server.KeepAlivePeriod}
+	var controls []func(network, address string, c syscall.RawConn) error
+	if conn.server.ActiveDataPort > 0 {
+		dialer.LocalAddr = &net.TCPAddr{Port: conn.server.ActiveDataPort}
+		controls = append(controls, reuseAddr)
+	}
+	if conn.server.DataDSCP > 0 {
+		controls = append(controls, dscpControl(conn.server.DataDSCP))
+	}
+	if len(controls) > 0 {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			for _, control := range controls {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return dialer
+}
+
+// dataTLSConfig returns the TLS config used for data connections, or nil if
+// the client did not ask for a protected data channel with PROT P. Sharing
+// the control connection's config lets clients resume its TLS session.
+func (conn *Conn) dataTLSConfig() *tls.Config {
+	if !conn.dataTLS {
+		return nil
+	}
+	if !conn.server.StrictTLSResumption {
+		return conn.tlsConfig
+	}
+	// The clone shares the session ticket keys of the control connection,
+	// which are its own, so tickets of other sessions can't be resumed.
+	config := conn.tlsConfig.Clone()
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if !state.DidResume {
+			return ErrTLSNotResumed
+		}
+		return nil
+	}
+	return config
+}
+
+// sessionTLSConfig returns a copy of config with session ticket keys of its
+// own, for a control connection whose data connections are only allowed to
+// resume its sessions.
+func sessionTLSConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	var key [32]byte
+	rand.Read(key[:])
+	config.SetSessionTicketKeys([][32]byte{key})
+	return config
+}
+
+// acceptImplicitTLS performs the TLS handshake an implicit FTPS client starts
+// the session with. Data connections are protected by default.
+func (conn *Conn) acceptImplicitTLS() error {
+	conn.conn.SetDeadline(time.Now().Add(implicitTLSHandshakeTimeout))
+	if err := conn.upgradeToTLS(); err != nil {
+		return err
+	}
+	conn.conn.SetDeadline(time.Time{})
+	conn.pbsz = true
+	conn.dataTLS = true
+	return nil
+}
+
+// reset drops the control connection with a TCP RST rather than an orderly
+// shutdown, e.g. for clients speaking plaintext to an implicit FTPS port.
+func (conn *Conn) reset() {
+	netConn := conn.conn
+	if proxied, ok := netConn.(*proxyConn); ok {
+		netConn = proxied.Conn
+	}
+	if tcpConn, ok := netConn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
 }
 
 func (conn *Conn) upgradeToTLS() error {
-	conn.logger.Print(conn.sessionID, "Upgrading connectiion to TLS")
-	tlsConn := tls.Server(conn.conn, conn.tlsConfig)
+	conn.logger.Debugf(conn.sessionID, "Upgrading connectiion to TLS")
+	netConn := conn.conn
+	if conn.server.AllowCCC {
+		netConn = &tlsRecordConn{Conn: netConn}
+	}
+	tlsConn := tls.Server(netConn, conn.tlsConfig)
 	err := tlsConn.Handshake()
 	if err == nil {
 		conn.conn = tlsConn
@@ -151,65 +470,245 @@ func (conn *Conn) upgradeToTLS() error {
 // appropriate response.
 func (conn *Conn) receiveLine(line string) {
 	command, param := conn.parseLine(line)
-	conn.logger.PrintCommand(conn.sessionID, command, param)
+	defer conn.recoverPanic(command)
+	if !strings.EqualFold(command, "RNTO") {
+		// RNTO has to follow RNFR right away
+		conn.renameFrom = ""
+	}
+	if !restartKeepingCommands[strings.ToUpper(command)] {
+		// a stale offset must not apply to a later transfer
+		defer conn.clearRestartOffset()
+	}
+	conn.updateSession(command, param)
+	conn.logger.PrintCommand(conn.sessionID, command, redactParam(command, param))
 	cmdObj := commands[strings.ToUpper(command)]
 	if cmdObj == nil {
-		conn.writeMessage(500, "Command not found")
+		conn.logger.Debugf(conn.sessionID, "Unknown command %q", command)
+		conn.writeMessage(conn.server.UnknownCommandCode, "Command not found")
+		return
+	}
+	if conn.isDisabled(command) {
+		conn.writeMessage(502, "Command not implemented")
 		return
 	}
 	if cmdObj.RequireParam() && param == "" {
 		conn.writeMessage(553, "action aborted, required param missing")
 	} else if cmdObj.RequireAuth() && conn.user == "" {
 		conn.writeMessage(530, "not logged in")
+	} else if conn.isReadOnly() && mutatingCommands[strings.ToUpper(command)] {
+		conn.writeMessage(550, "Read-only server")
+	} else if refusal := conn.dataConnModeRefusal(command); refusal != "" {
+		conn.writeMessage(500, refusal)
+	} else if conn.epsvAll && (activeCommands[strings.ToUpper(command)] || strings.ToUpper(command) == "PASV") {
+		conn.writeMessage(501, "Only EPSV is allowed after EPSV ALL")
 	} else {
 		cmdObj.Execute(conn, param)
 	}
 }
 
+// writeStatus replies to STAT without a parameter with the status of the
+// session. transfer is the command of the transfer in progress, if any.
+func (conn *Conn) writeStatus(transfer string) {
+	var status strings.Builder
+	fmt.Fprintf(&status, "FTP server status:\n Connected to %s\n", conn.conn.RemoteAddr())
+	if conn.user != "" {
+		fmt.Fprintf(&status, " Logged in as %s\n", conn.user)
+	}
+	dataType, mode := "BINARY", "STREAM"
+	if conn.asciiMode {
+		dataType = "ASCII"
+	}
+	if conn.deflate {
+		mode = "DEFLATE"
+	}
+	fmt.Fprintf(&status, " TYPE: %s, MODE: %s\n", dataType, mode)
+	if _, ok := conn.TLSConnectionState(); ok {
+		status.WriteString(" Control connection protected by TLS\n")
+	}
+	if conn.dataTLS {
+		status.WriteString(" Data connections protected by TLS\n")
+	}
+	if stats, ok := conn.stats.current(); transfer != "" && ok {
+		fmt.Fprintf(&status, " Transfer in progress: %s, %d bytes received, %d bytes sent\n", transfer, stats.BytesIn, stats.BytesOut)
+	} else {
+		status.WriteString(" No data transfer in progress\n")
+	}
+	conn.writeMessageMultiline(211, status.String())
+}
+
+// runningCommand returns the command being run as recorded for
+// Server.ActiveConns, if the connection is served by a Server.
+func (conn *Conn) runningCommand() string {
+	if conn.session == nil {
+		return ""
+	}
+	conn.session.lock.Lock()
+	defer conn.session.lock.Unlock()
+	return conn.session.command
+}
+
+// recoverPanic keeps a panic while running command, e.g. in the driver,
+// from taking down the server. The session is closed, as its state can't
+// be relied on anymore.
+func (conn *Conn) recoverPanic(command string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	conn.logger.Errorf(conn.sessionID, "Panic running %s: %v\n%s", command, r, debug.Stack())
+	conn.writeMessage(421, "Internal server error, closing control connection")
+	conn.Close()
+}
+
+// clearRestartOffset forgets the offset set with REST.
+func (conn *Conn) clearRestartOffset() {
+	conn.lastFilePos = 0
+}
+
+// redactParam returns the parameter of command as it may be logged, with
+// passwords hidden.
+func redactParam(command, param string) string {
+	if strings.ToUpper(command) == "PASS" {
+		return "****"
+	}
+	return param
+}
+
+// updateSession records the running command for Server.ActiveConns, if the
+// connection is served by a Server.
+func (conn *Conn) updateSession(command, param string) {
+	if conn.session != nil {
+		conn.session.update(conn.user, command, param)
+	}
+}
+
+// isDisabled reports whether command was disabled by DisabledCommands.
+func (conn *Conn) isDisabled(command string) bool {
+	return conn.server.disabledCommands[strings.ToUpper(command)]
+}
+
+// dataConnModeRefusal returns why command is refused by the DataConnMode,
+// or "" if it isn't.
+func (conn *Conn) dataConnModeRefusal(command string) string {
+	command = strings.ToUpper(command)
+	switch {
+	case conn.server.DataConnMode == DataConnPassiveOnly && activeCommands[command]:
+		return "Active mode is disabled, use PASV or EPSV"
+	case conn.server.DataConnMode == DataConnActiveOnly && passiveCommands[command]:
+		return "Passive mode is disabled, use PORT or EPRT"
+	}
+	return ""
+}
+
+// isReadOnly reports whether the user may not change files.
+func (conn *Conn) isReadOnly() bool {
+	return conn.server.ReadOnly || conn.readOnly
+}
+
 func (conn *Conn) parseLine(line string) (string, string) {
+	// Clients may precede ABOR with the Telnet IP and Synch sequences.
+	for len(line) > 0 && (line[0] == 0xff || line[0] == 0xf4 || line[0] == 0xf2) {
+		line = line[1:]
+	}
 	params := strings.SplitN(strings.Trim(line, "\r\n"), " ", 2)
 	if len(params) == 1 {
 		return params[0], ""
 	}
-	return params[0], strings.TrimSpace(params[1])
+	// Only trim ASCII spaces, as others may be part of a UTF-8 file name.
+	return params[0], strings.Trim(params[1], " \t")
 }
 
-// writeMessage will send a standard FTP response back to the client.
+// writeMessage will send a standard FTP response back to the client. A
+// message of several lines is sent as a multi-line reply.
 func (conn *Conn) writeMessage(code int, message string) (wrote int, err error) {
+	code, message = conn.hookReply(code, message)
 	conn.logger.PrintResponse(conn.sessionID, code, message)
-	line := fmt.Sprintf("%d %s\r\n", code, message)
-	wrote, err = conn.controlWriter.WriteString(line)
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	wrote, err = conn.controlWriter.WriteString(formatReply(code, message))
 	conn.controlWriter.Flush()
 	return
 }
 
-// writeMessage will send a standard FTP response back to the client.
+// writeMessageMultiline sends a multi-line response whose first line is the
+// first line of message, followed by its other lines and an END line.
 func (conn *Conn) writeMessageMultiline(code int, message string) (wrote int, err error) {
+	code, message = conn.hookReply(code, message)
 	conn.logger.PrintResponse(conn.sessionID, code, message)
-	line := fmt.Sprintf("%d-%s\r\n%d END\r\n", code, message, code)
-	wrote, err = conn.controlWriter.WriteString(line)
+	lines := replyLines(message)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d-%s\r\n", code, lines[0])
+	for _, line := range lines[1:] {
+		// a line starting with a digit could be taken for the end
+		if line != "" && line[0] >= '0' && line[0] <= '9' {
+			line = " " + line
+		}
+		buf.WriteString(line + "\r\n")
+	}
+	fmt.Fprintf(&buf, "%d END\r\n", code)
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	wrote, err = conn.controlWriter.Write(buf.Bytes())
 	conn.controlWriter.Flush()
 	return
 }
 
+// hookReply returns the reply to send in place of code and message, as
+// changed by ReplyHook.
+func (conn *Conn) hookReply(code int, message string) (int, string) {
+	if conn.server == nil || conn.server.ReplyHook == nil {
+		return code, message
+	}
+	return conn.server.ReplyHook(conn.sessionID, code, message)
+}
+
+// formatReply formats a reply, such as "220 Welcome\r\n". Every line of a
+// message of several lines but the last is sent as "220-line".
+func formatReply(code int, message string) string {
+	lines := replyLines(message)
+	var buf bytes.Buffer
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(&buf, "%d%s%s\r\n", code, sep, line)
+	}
+	return buf.String()
+}
+
+// replyLines splits message into lines, whether they end with CRLF or LF.
+func replyLines(message string) []string {
+	message = strings.Replace(message, "\r\n", "\n", -1)
+	return strings.Split(strings.TrimSuffix(message, "\n"), "\n")
+}
+
 // buildPath takes a client supplied path or filename and generates a safe
 // absolute path within their account sandbox.
 //
-//    buildpath("/")
-//    => "/"
-//    buildpath("one.txt")
-//    => "/one.txt"
-//    buildpath("/files/two.txt")
-//    => "/files/two.txt"
-//    buildpath("files/two.txt")
-//    => "/files/two.txt"
-//    buildpath("/../../../../etc/passwd")
-//    => "/etc/passwd"
+//	buildpath("/")
+//	=> "/"
+//	buildpath("one.txt")
+//	=> "/one.txt"
+//	buildpath("/files/two.txt")
+//	=> "/files/two.txt"
+//	buildpath("files/two.txt")
+//	=> "/files/two.txt"
+//	buildpath("/../../../../etc/passwd")
+//	=> "/etc/passwd"
 //
 // The driver implementation is responsible for deciding how to treat this path.
 // Obviously they MUST NOT just read the path off disk. The probably want to
 // prefix the path with something to scope the users access to a sandbox.
-func (conn *Conn) buildPath(filename string) (fullPath string) {
+//
+// If the Auth implements RootAuth, the path is prefixed with the user's root.
+func (conn *Conn) buildPath(filename string) string {
+	return conn.rootPath(conn.virtualPath(filename))
+}
+
+// virtualPath returns the absolute path of filename as seen by the client,
+// which never leaves "/" however many ".." filename contains.
+func (conn *Conn) virtualPath(filename string) (fullPath string) {
 	if len(filename) > 0 && filename[0:1] == "/" {
 		fullPath = filepath.Clean(filename)
 	} else if len(filename) > 0 && filename != "-a" {
@@ -222,31 +721,275 @@ func (conn *Conn) buildPath(filename string) (fullPath string) {
 	return
 }
 
-// sendOutofbandData will send a string to the client via the currently open
-// data socket. Assumes the socket is open and ready to be used.
-func (conn *Conn) sendOutofbandData(data []byte) {
-	bytes := len(data)
+// rootPath maps the virtual path p into the root of the user.
+func (conn *Conn) rootPath(p string) string {
+	if conn.root == "" {
+		return p
+	}
+	return path.Join(conn.root, p)
+}
+
+// setRoot jails the session to the root the Auth returns for user, if it
+// implements RootAuth.
+func (conn *Conn) setRoot(user string) error {
+	conn.root = ""
+	conn.namePrefix = "/"
+	rootAuth, ok := conn.server.Auth.(RootAuth)
+	if !ok {
+		return nil
+	}
+	root, err := rootAuth.Root(user)
+	if err != nil {
+		return err
+	}
+	if root = path.Clean("/" + root); root != "/" {
+		conn.root = root
+	}
+	return nil
+}
+
+// resetSessionState sets the parameters of the session that commands like
+// TYPE and OPTS change to their defaults, for a new session or REIN.
+func (conn *Conn) resetSessionState() {
+	conn.asciiMode = conn.server.DefaultTransferType == TransferASCII
+	conn.deflate = false
+	conn.utf8 = false
+	conn.epsvAll = false
+	conn.renameFrom = ""
+	conn.mlstFacts = mlstFacts
+	conn.hashAlgorithm = defaultHashAlgorithm
+	conn.rangeStart = 0
+	conn.rangeEnd = -1
+}
+
+// certUser returns the user and driver the verified client certificate of
+// the control connection belongs to, if the Auth implements CertAuth.
+func (conn *Conn) certUser() (string, Driver, error) {
+	certAuth, ok := conn.server.Auth.(CertAuth)
+	if !ok {
+		return "", nil, nil
+	}
+	state, ok := conn.TLSConnectionState()
+	if !ok || len(state.VerifiedChains) == 0 {
+		return "", nil, nil
+	}
+	return certAuth.CertUser(state.VerifiedChains[0][0])
+}
+
+// certLogin logs in user, authenticated by their client certificate, and
+// serves them with driver, or the driver of UserAuth if nil.
+func (conn *Conn) certLogin(user string, driver Driver) error {
+	if err := conn.setRoot(user); err != nil {
+		return err
+	}
+	if driver == nil {
+		if err := conn.startUserSession(user); err != nil {
+			return err
+		}
+	} else {
+		conn.driver = driver
+		driver.Init(conn)
+	}
+	conn.user = user
+	conn.reqUser = ""
+	return nil
+}
+
+// startUserSession switches to the driver and permissions of user, if the
+// Auth implements UserAuth, or else back to the driver of the DriverFactory.
+func (conn *Conn) startUserSession(user string) error {
+	conn.driver = conn.sessionDriver
+	userAuth, ok := conn.server.Auth.(UserAuth)
+	if !ok {
+		return nil
+	}
+	driver, perms, err := userAuth.UserSession(user)
+	if err != nil {
+		return err
+	}
+	conn.driver = driver
+	conn.readOnly = perms.ReadOnly
+	conn.maxUpload = perms.MaxUploadSize
+	conn.maxDownload = perms.MaxDownloadSize
+	if home := path.Clean("/" + perms.Home); home != "/" {
+		conn.root = path.Join("/", conn.root, home)
+	}
+	driver.Init(conn)
+	return nil
+}
+
+// setDataConn makes socket the data connection used by the next transfer,
+// applying the configured transfer limits. A previously opened data
+// connection that was never used is closed.
+func (conn *Conn) setDataConn(socket DataSocket) {
+	if conn.dataConn != nil {
+		conn.dataConn.Close()
+	}
+	conn.dataReady = nil
+	if passive, ok := socket.(*ftpPassiveSocket); ok {
+		conn.dataReady = passive.waitForOpenSocket
+	}
+	socket = newMetricsSocket(conn.stats.track(socket), conn.server.Metrics)
+	if conn.server.RateLimit > 0 || conn.server.globalLimiter != nil {
+		socket = newThrottledSocket(socket, conn.server.RateLimit, conn.server.globalLimiter)
+	}
+	conn.dataTracked = newTrackedSocket(socket, &conn.server.dataSockets)
+	conn.dataConn = conn.dataTracked
+}
+
+// closeDataConn closes the data connection, if any, e.g. when a transfer is
+// refused before it starts.
+func (conn *Conn) closeDataConn() {
 	if conn.dataConn != nil {
-		conn.dataConn.Write(data)
 		conn.dataConn.Close()
 		conn.dataConn = nil
 	}
+}
+
+// startTransfer sends the 150 reply msg starting a transfer. With
+// DelayTransferReply, it first waits for the client to connect to a passive
+// data connection, and replies 425 or 426 instead if it didn't.
+func (conn *Conn) startTransfer(msg string) error {
+	if conn.server.DelayTransferReply && conn.dataConn != nil && conn.dataReady != nil {
+		// let ABOR interrupt the wait
+		conn.allowNextCommand()
+		if err := conn.dataReady(); err != nil {
+			conn.logger.Warnf(conn.sessionID, "Passive data connection not opened: %v", err)
+			conn.dataConn.Close()
+			conn.dataConn = nil
+			if err == ErrAborted {
+				conn.writeMessage(426, "Connection closed; transfer aborted")
+			} else {
+				conn.writeMessage(425, "Can't open data connection")
+			}
+			return err
+		}
+	}
+	// dataConn may already be wrapped for MODE Z
+	if conn.dataConn != nil {
+		conn.dataTracked.start()
+	}
+	conn.writeMessage(150, msg)
+	return nil
+}
+
+// transferConn returns the data connection to transfer files on, which
+// translates line endings in ASCII mode.
+func (conn *Conn) transferConn() DataSocket {
+	if conn.asciiMode {
+		return newASCIISocket(conn.modeConn())
+	}
+	return conn.modeConn()
+}
+
+// modeConn returns the data connection, which compresses data in MODE Z.
+func (conn *Conn) modeConn() DataSocket {
+	if !conn.deflate {
+		return conn.dataConn
+	}
+	if _, ok := conn.dataConn.(*deflateSocket); !ok {
+		conn.dataConn = newDeflateSocket(conn.dataConn)
+	}
+	return conn.dataConn
+}
+
+// finishTransfer ends the compressed stream of data sent in MODE Z, so the
+// client gets all of it before the data connection is closed.
+func (conn *Conn) finishTransfer() error {
+	if socket, ok := conn.dataConn.(*deflateSocket); ok {
+		return socket.finish()
+	}
+	return nil
+}
+
+// sendListing sends the listing of the directory at path to the client via
+// the currently open data socket, one line per file formatted by entry. The
+// lines are written as the driver lists the files, so huge directories
+// aren't held in memory.
+func (conn *Conn) sendListing(path string, entry func(FileInfo) string) {
+	if conn.dataConn == nil {
+		conn.writeMessage(425, "Can't open data connection")
+		return
+	}
+	data := bufio.NewWriterSize(conn.modeConn(), conn.server.DataBufferSize)
+	bytes := 0
+	var writeErr error
+	err := conn.driver.ListDir(path, func(f FileInfo) error {
+		var n int
+		n, writeErr = data.WriteString(entry(f))
+		bytes += n
+		return writeErr
+	})
+	if err == nil {
+		if err = data.Flush(); err == nil {
+			err = conn.finishTransfer()
+		}
+		writeErr = err
+	}
+	conn.dataConn.Close()
+	conn.dataConn = nil
+	if err != nil {
+		if writeErr != nil {
+			conn.logger.Warnf(conn.sessionID, "Sending listing failed: %v", err)
+		} else {
+			conn.logger.Errorf(conn.sessionID, "Listing %s failed: %v", path, err)
+		}
+		conn.writeMessage(426, "Connection closed; transfer aborted")
+		return
+	}
 	message := "Closing data connection, sent " + strconv.Itoa(bytes) + " bytes"
 	conn.writeMessage(226, message)
 }
 
-func (conn *Conn) sendOutofBandDataWriter(data io.ReadCloser) error {
+// errReader records the error of the reader it wraps, to tell the errors
+// of the source of a copy from those of its destination.
+type errReader struct {
+	io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (conn *Conn) sendOutofBandDataWriter(data io.ReadCloser) (int64, error) {
 	conn.lastFilePos = 0
-	bytes, err := io.Copy(conn.dataConn, data)
+	conn.allowNextCommand()
+	// hide ReaderFrom and WriterTo so the buffer is always used
+	buf := make([]byte, conn.server.DataBufferSize)
+	src := &errReader{Reader: data}
+	bytes, err := io.CopyBuffer(struct{ io.Writer }{conn.transferConn()}, src, buf)
+	if err == nil {
+		err = conn.finishTransfer()
+	}
 	if err != nil {
 		conn.dataConn.Close()
 		conn.dataConn = nil
-		return err
+		switch {
+		case src.err == ErrFileTooLarge:
+			conn.writeMessage(552, "Download size limit exceeded; transfer aborted")
+		case src.err != nil:
+			conn.logger.Errorf(conn.sessionID, "Reading file failed: %v", err)
+			conn.writeMessage(451, "Local error reading file; transfer aborted")
+		case err == ErrAborted:
+			conn.writeMessage(426, "Connection closed; transfer aborted")
+		case isConnReset(err):
+			conn.logger.Infof(conn.sessionID, "Client closed the data connection: %v", err)
+			conn.writeMessage(426, "Connection closed; transfer aborted")
+		default:
+			conn.logger.Warnf(conn.sessionID, "Sending file failed: %v", err)
+			conn.writeMessage(426, "Connection closed; transfer aborted")
+		}
+		return bytes, err
 	}
 	message := "Closing data connection, sent " + strconv.Itoa(int(bytes)) + " bytes"
 	conn.writeMessage(226, message)
 	conn.dataConn.Close()
 	conn.dataConn = nil
 
-	return nil
+	return bytes, nil
 }
@@ -5,7 +5,22 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestConnBuildPath(t *testing.T) {
@@ -32,3 +47,580 @@ func TestConnBuildPath(t *testing.T) {
 		})
 	}
 }
+
+type addrConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestConnPassiveListenIP(t *testing.T) {
+	local := &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 21}
+	var iptests = []struct {
+		publicIP string
+		out      string
+	}{
+		{"", "10.0.0.5"},
+		{"203.0.113.7", "203.0.113.7"},
+	}
+	for _, tt := range iptests {
+		t.Run(tt.publicIP, func(t *testing.T) {
+			c := &Conn{
+				conn:   addrConn{local: local},
+				server: NewServer(&ServerOpts{PublicIp: tt.publicIP}),
+			}
+			if ip := c.passiveListenIP(); ip != tt.out {
+				t.Errorf("got %q, want %q", ip, tt.out)
+			}
+		})
+	}
+}
+
+func TestConnPublicIpFunc(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 4000}
+	s := NewServer(&ServerOpts{
+		PublicIp: "203.0.113.1",
+		PublicIpFunc: func(local, addr net.Addr) string {
+			if addr.String() != remote.String() {
+				t.Errorf("got remote address %v, want %v", addr, remote)
+			}
+			switch local.(*net.TCPAddr).IP.String() {
+			case "10.0.0.5":
+				return "203.0.113.5"
+			case "10.0.0.6":
+				return "203.0.113.6"
+			}
+			return ""
+		},
+	})
+	var iptests = []struct {
+		local string
+		out   string
+	}{
+		{"10.0.0.5", "203.0.113.5"},
+		{"10.0.0.6", "203.0.113.6"},
+		{"10.0.0.7", "203.0.113.1"},
+	}
+	for _, tt := range iptests {
+		t.Run(tt.local, func(t *testing.T) {
+			c := &Conn{
+				conn:   addrConn{local: &net.TCPAddr{IP: net.ParseIP(tt.local), Port: 21}, remote: remote},
+				server: s,
+			}
+			if ip := c.passiveListenIP(); ip != tt.out {
+				t.Errorf("got %q, want %q", ip, tt.out)
+			}
+		})
+	}
+}
+
+func TestConnImplicitTLS(t *testing.T) {
+	certFile, keyFile := testCertFiles(t)
+	s, _ := newTestServer(t, &ServerOpts{TLS: true, CertFile: certFile, KeyFile: keyFile})
+
+	c, err := tls.Dial("tcp", s.listenTo, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := textproto.NewConn(c)
+	defer tc.Close()
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, tc, 331, "USER admin")
+	expect(t, tc, 230, "PASS admin")
+	expect(t, tc, 200, "PBSZ 0")
+	expect(t, tc, 200, "PROT P")
+
+	// A plaintext client is dropped instead of left hanging.
+	plain, err := net.Dial("tcp", s.listenTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.Write([]byte("USER admin\r\n"))
+	plain.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := plain.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the plaintext connection to be dropped")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("plaintext connection was left hanging")
+	}
+}
+
+func TestConnSecureTLSConfig(t *testing.T) {
+	s, _ := newTestServer(t, &ServerOpts{TLS: true, TLSConfig: SecureTLSConfig(testTLSConfig(t))})
+	for _, test := range []struct {
+		config *tls.Config
+		ok     bool
+	}{
+		{&tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS10}, false},
+		{&tls.Config{MinVersion: tls.VersionTLS11, MaxVersion: tls.VersionTLS11}, false},
+		{&tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}}, false},
+		{&tls.Config{MaxVersion: tls.VersionTLS12}, true},
+		{&tls.Config{}, true},
+	} {
+		test.config.InsecureSkipVerify = true
+		c, err := tls.Dial("tcp", s.listenTo, test.config)
+		if !test.ok {
+			if err == nil {
+				c.Close()
+				t.Errorf("%+v: expected the handshake to fail", test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", test.config, err)
+			continue
+		}
+		tc := textproto.NewConn(c)
+		if _, _, err := tc.ReadResponse(220); err != nil {
+			t.Error(err)
+		}
+		tc.Close()
+	}
+
+	// The original config is left alone.
+	config := &tls.Config{}
+	SecureTLSConfig(config)
+	if config.MinVersion != 0 || config.CipherSuites != nil {
+		t.Error("SecureTLSConfig modified its argument")
+	}
+}
+
+// tlsStateNotifier records the client certificate and data protection of
+// downloads.
+type tlsStateNotifier struct {
+	nopNotifier
+	subjects chan string
+}
+
+func (n tlsStateNotifier) BeforeDownload(conn *Conn, path string) error {
+	subject := "none"
+	if state, ok := conn.TLSConnectionState(); ok && len(state.PeerCertificates) > 0 {
+		subject = state.PeerCertificates[0].Subject.CommonName
+	}
+	n.subjects <- subject + " data TLS " + strconv.FormatBool(conn.DataTLS())
+	return nil
+}
+
+func TestConnTLSConnectionState(t *testing.T) {
+	certFile, keyFile := testCertFiles(t)
+	config := testTLSConfig(t)
+	config.ClientAuth = tls.RequireAnyClientCert
+	notifier := tlsStateNotifier{subjects: make(chan string, 2)}
+	s, driver := newTestServer(t, &ServerOpts{TLS: true, ExplicitFTPS: true, TLSConfig: config, Notifier: notifier})
+	driver.files["/a.txt"] = []byte("a")
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dialExplicitTLS(t, s, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}})
+	download(t, c, "RETR /a.txt")
+	if got := <-notifier.subjects; got != "127.0.0.1 data TLS false" {
+		t.Errorf("got %q, want the client certificate", got)
+	}
+	expect(t, c, 200, "PBSZ 0")
+	expect(t, c, 200, "PROT P")
+	data := tls.Client(openPassive(t, c), &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}})
+	expect(t, c, 150, "RETR /a.txt")
+	ioutil.ReadAll(data)
+	data.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-notifier.subjects; got != "127.0.0.1 data TLS true" {
+		t.Errorf("got %q after PROT P", got)
+	}
+
+	plain := dialTestServer(t, s)
+	login(t, plain)
+	download(t, plain, "RETR /a.txt")
+	if got := <-notifier.subjects; got != "none data TLS false" {
+		t.Errorf("got %q for a plaintext session", got)
+	}
+	if _, ok := new(Conn).TLSConnectionState(); ok {
+		t.Error("got a TLS state without a connection")
+	}
+}
+
+func TestConnActiveDataPort(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataPort := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	c := &Conn{server: NewServer(&ServerOpts{ActiveDataPort: dataPort})}
+
+	// Back to back transfers must not fail with "address already in use".
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted := make(chan net.Addr, 1)
+		go func() {
+			if c, err := l.Accept(); err == nil {
+				accepted <- c.RemoteAddr()
+				c.Close()
+			}
+			close(accepted)
+		}()
+
+		socket, err := newActiveSocket(context.Background(), "tcp4", "127.0.0.1", l.Addr().(*net.TCPAddr).Port, c.activeDialer(), 0, new(DiscardLogger), "test", nil, nopMetrics{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr := <-accepted; addr == nil || addr.(*net.TCPAddr).Port != dataPort {
+			t.Errorf("got source address %v, want port %d", addr, dataPort)
+		}
+		socket.Close()
+		l.Close()
+	}
+}
+
+// recordingDialer dials through a net.Dialer, recording the addresses it
+// is asked for and whether the dial had a deadline.
+type recordingDialer struct {
+	dials chan string
+}
+
+func (d recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	_, hasDeadline := ctx.Deadline()
+	d.dials <- network + " " + address + " deadline " + strconv.FormatBool(hasDeadline)
+	return new(net.Dialer).DialContext(ctx, network, address)
+}
+
+func TestConnActiveDialer(t *testing.T) {
+	dialer := recordingDialer{make(chan string, 1)}
+	s, driver := newTestServer(t, &ServerOpts{ActiveDialer: dialer})
+	driver.files["/a.txt"] = []byte("dialed")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	expect(t, c, 200, "PORT 127,0,0,1,%d,%d", port>>8, port&0xff)
+	if got, want := <-dialer.dials, "tcp4 127.0.0.1:"+strconv.Itoa(port)+" deadline true"; got != want {
+		t.Errorf("got dial %q, want %q", got, want)
+	}
+	data, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	expect(t, c, 150, "RETR /a.txt")
+	if got, _ := ioutil.ReadAll(data); string(got) != "dialed" {
+		t.Errorf("got %q", got)
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnReplyFormat(t *testing.T) {
+	var tests = []struct {
+		code      int
+		message   string
+		multiline bool
+		want      string
+	}{
+		{220, "Welcome", false, "220 Welcome\r\n"},
+		{220, "Welcome\nto the server", false, "220-Welcome\r\n220 to the server\r\n"},
+		{230, "one\r\ntwo\r\nthree\r\n", false, "230-one\r\n230-two\r\n230 three\r\n"},
+		{220, "", false, "220 \r\n"},
+		{211, "Features:\n SIZE\n", true, "211-Features:\r\n SIZE\r\n211 END\r\n"},
+		{211, "Features", true, "211-Features\r\n211 END\r\n"},
+		{250, "Listing /a\r\n211 x", true, "250-Listing /a\r\n 211 x\r\n250 END\r\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		conn := &Conn{logger: leveledLogger(new(DiscardLogger)), controlWriter: bufio.NewWriter(&buf)}
+		if tt.multiline {
+			conn.writeMessageMultiline(tt.code, tt.message)
+		} else {
+			conn.writeMessage(tt.code, tt.message)
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%d %q: got %q, want %q", tt.code, tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestConnReplyHook(t *testing.T) {
+	var requests int32
+	s, _ := newTestServer(t, &ServerOpts{ReplyHook: func(sessionID string, code int, message string) (int, string) {
+		if code == 502 {
+			code = 500
+		}
+		return code, fmt.Sprintf("%s (request %s-%d)", message, sessionID, atomic.AddInt32(&requests, 1))
+	}})
+	c := dialTestServer(t, s)
+	login(t, c)
+	sessionID := s.ActiveConns()[0].SessionID
+	if msg := expect(t, c, 200, "NOOP"); !strings.HasSuffix(msg, fmt.Sprintf(" (request %s-4)", sessionID)) {
+		t.Errorf("NOOP: got %q", msg)
+	}
+	expect(t, c, 500, "FOO")
+	// Multi-line replies keep their framing.
+	if msg := expect(t, c, 211, "FEAT"); !strings.HasPrefix(msg, "Extensions supported:\n") || !strings.HasSuffix(msg, "(request "+sessionID+"-6)\nEND") {
+		t.Errorf("FEAT: got %q", msg)
+	}
+}
+
+func TestConnCommandLogging(t *testing.T) {
+	logger := new(printLogger)
+	s, _ := newTestServer(t, &ServerOpts{Logger: logger, UnknownCommandCode: 502})
+	c := dialTestServer(t, s)
+	expect(t, c, 331, "USER admin")
+	expect(t, c, 230, "pass admin")
+	expect(t, c, 502, "FOO bar")
+
+	logger.lock.Lock()
+	log := strings.Join(logger.lines, "\n")
+	logger.lock.Unlock()
+	for _, want := range []string{"> USER admin", "> pass ****", "> FOO bar", `Unknown command "FOO"`} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log %q lacks %q", log, want)
+		}
+	}
+	if strings.Contains(log, "pass admin") {
+		t.Errorf("log %q shows the password", log)
+	}
+
+	bad := NewServer(&ServerOpts{Factory: newTestDriverFactory(), UnknownCommandCode: 404, Logger: new(DiscardLogger)})
+	if err := bad.prepare(); err == nil {
+		t.Error("expected an error for an invalid reply code")
+	}
+}
+
+func TestConnWelcomeMessage(t *testing.T) {
+	for _, tt := range []struct{ message, want string }{
+		{"", "220 " + defaultWelcomeMessage + "\r\n"},
+		{"Hello", "220 Hello\r\n"},
+		{"Hello\nAuthorized use only", "220-Hello\r\n220 Authorized use only\r\n"},
+	} {
+		s, _ := newTestServer(t, &ServerOpts{WelcomeMessage: tt.message})
+		nc, err := net.Dial("tcp", s.listenTo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nc.Close()
+		got := make([]byte, len(tt.want))
+		nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(nc, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("got banner %q, want %q", got, tt.want)
+		}
+		c := textproto.NewConn(nc)
+		expect(t, c, 200, "NOOP")
+	}
+}
+
+func TestConnControlIdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	s, driver := newTestServer(t, &ServerOpts{ControlIdleTimeout: timeout})
+
+	// Commands and transfers in progress keep the session open.
+	c := dialTestServer(t, s)
+	login(t, c)
+	for i := 0; i < 4; i++ {
+		time.Sleep(timeout / 2)
+		expect(t, c, 200, "NOOP")
+	}
+	data := openPassive(t, c)
+	expect(t, c, 150, "STOR /slow.txt")
+	for i := 0; i < 4; i++ {
+		time.Sleep(timeout / 2)
+		data.Write([]byte("x"))
+	}
+	data.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if got := driver.testFile("/slow.txt"); got != "xxxx" {
+		t.Errorf("got %q", got)
+	}
+
+	// A silent client is disconnected, logged in or not.
+	for _, loggedIn := range []bool{true, false} {
+		c := dialTestServer(t, s)
+		if loggedIn {
+			login(t, c)
+		}
+		start := time.Now()
+		if _, _, err := c.ReadResponse(421); err != nil {
+			t.Fatalf("logged in %v: %v", loggedIn, err)
+		}
+		if elapsed := time.Since(start); elapsed < timeout {
+			t.Errorf("disconnected after %v, want at least %v", elapsed, timeout)
+		}
+		if _, err := c.ReadLine(); err != io.EOF {
+			t.Errorf("got %v, want the connection closed", err)
+		}
+	}
+}
+
+func TestConnDataBufferSize(t *testing.T) {
+	content := make([]byte, 300*1024+17)
+	rand.Read(content)
+	for _, size := range []int{minDataBufferSize, 1 << 20} {
+		s, driver := newTestServer(t, &ServerOpts{DataBufferSize: size})
+		c := dialTestServer(t, s)
+		login(t, c)
+		upload(t, c, "/a.bin", string(content))
+		if got := driver.testFile("/a.bin"); got != string(content) {
+			t.Errorf("buffer of %d: upload corrupted, got %d bytes", size, len(got))
+		}
+		if got := download(t, c, "RETR /a.bin"); got != string(content) {
+			t.Errorf("buffer of %d: download corrupted, got %d bytes", size, len(got))
+		}
+	}
+
+	s := NewServer(&ServerOpts{Factory: newTestDriverFactory(), DataBufferSize: minDataBufferSize - 1, Logger: new(DiscardLogger)})
+	if err := s.prepare(); err == nil {
+		t.Error("expected an error for a buffer below the minimum")
+	}
+}
+
+func TestConnDataReset(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/big.bin"] = make([]byte, 64<<20)
+	c := dialTestServer(t, s)
+	login(t, c)
+	goroutines := runtime.NumGoroutine()
+
+	data := openPassive(t, c)
+	expect(t, c, 150, "RETR /big.bin")
+	if _, err := io.ReadFull(data, make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	// Close with a RST rather than a FIN.
+	data.(*net.TCPConn).SetLinger(0)
+	data.Close()
+	if _, _, err := c.ReadResponse(426); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 200, "NOOP")
+
+	waitFor(t, "the transfer goroutines to exit", func() bool {
+		return runtime.NumGoroutine() <= goroutines
+	})
+}
+
+func TestConnClientGoneDuringDownload(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/big.bin"] = make([]byte, 64<<20)
+	driver.files["/a.txt"] = []byte("still serving")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	data := openPassive(t, c)
+	expect(t, c, 150, "RETR /big.bin")
+	if _, err := io.ReadFull(data, make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	// The client vanishes: writes to both connections fail.
+	data.(*net.TCPConn).SetLinger(0)
+	data.Close()
+	c.Close()
+	waitFor(t, "the session to end", func() bool { return s.ActiveConnCount() == 0 })
+
+	c = dialTestServer(t, s)
+	login(t, c)
+	if got := download(t, c, "RETR /a.txt"); got != "still serving" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// panicDriver is a testDriver whose files panic when read.
+type panicDriver struct {
+	*testDriver
+}
+
+func (driver panicDriver) GetFile(p string, offset int64) (int64, io.ReadCloser, error) {
+	return 1, ioutil.NopCloser(panicReader{}), nil
+}
+
+type panicReader struct{}
+
+func (panicReader) Read(p []byte) (int, error) {
+	panic("driver bug")
+}
+
+type panicDriverFactory struct {
+	driver panicDriver
+}
+
+func (factory panicDriverFactory) NewDriver() (Driver, error) {
+	return factory.driver, nil
+}
+
+func TestConnRecoversPanic(t *testing.T) {
+	factory := panicDriverFactory{panicDriver{newTestDriverFactory().driver}}
+	s, _ := newTestServer(t, &ServerOpts{Factory: factory})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	data := openPassive(t, c)
+	defer data.Close()
+	expect(t, c, 150, "RETR /a.txt")
+	// The session is closed, the server keeps running.
+	if _, _, err := c.ReadResponse(421); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the session to end", func() bool { return s.ActiveConnCount() == 0 })
+	c = dialTestServer(t, s)
+	login(t, c)
+}
+
+func TestConnClosedDuringAccept(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{PassiveAcceptTimeout: time.Minute})
+	driver.files["/a.txt"] = []byte("hello")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	port := epsvPort(t, expect(t, c, 229, "EPSV"))
+	expect(t, c, 150, "RETR /a.txt")
+	c.Close()
+
+	// The transfer gives up on the client without waiting for the timeout.
+	waitFor(t, "the session to end", func() bool { return s.ActiveConnCount() == 0 })
+	if data, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		data.Close()
+		t.Error("the passive listener is still open")
+	}
+}
+
+func BenchmarkConnDataBufferSize(b *testing.B) {
+	content := string(make([]byte, 8<<20))
+	for _, size := range []int{minDataBufferSize, defaultDataBufferSize, 1 << 20} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			s, driver := newTestServer(b, &ServerOpts{DataBufferSize: size})
+			driver.files["/a.bin"] = []byte(content)
+			c := dialTestServer(b, s)
+			login(b, c)
+			b.SetBytes(int64(len(content)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				download(b, c, "RETR /a.bin")
+			}
+		})
+	}
+}
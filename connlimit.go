@@ -0,0 +1,76 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// ipConnCounter counts the open control connections per client IP.
+type ipConnCounter struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+// acquire counts a new connection from ip, unless there already are max
+// connections from it. A max of 0 means no limit.
+func (c *ipConnCounter) acquire(ip string, max int) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if max > 0 && c.counts[ip] >= max {
+		return false
+	}
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[ip]++
+	return true
+}
+
+// release forgets a connection counted by acquire.
+func (c *ipConnCounter) release(ip string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counts[ip] <= 1 {
+		delete(c.counts, ip)
+	} else {
+		c.counts[ip]--
+	}
+}
+
+// connCounter counts the open control connections of the server.
+type connCounter struct {
+	lock  sync.Mutex
+	count int
+}
+
+// acquire counts a new connection, unless there already are max. A max of
+// 0 means no limit.
+func (c *connCounter) acquire(max int) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if max > 0 && c.count >= max {
+		return false
+	}
+	c.count++
+	return true
+}
+
+// release forgets a connection counted by acquire.
+func (c *connCounter) release() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.count--
+}
+
+// remoteIP returns the IP address of the client of conn.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
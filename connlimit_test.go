@@ -0,0 +1,101 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// dialFrom connects to s from the local address ip and returns the reply
+// code of the greeting.
+func dialFrom(t *testing.T, s *Server, ip string) (*textproto.Conn, int) {
+	t.Helper()
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+	nc, err := dialer.Dial("tcp", s.listenTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := textproto.NewConn(nc)
+	t.Cleanup(func() { c.Close() })
+	code, _, err := c.ReadResponse(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, code
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	const max = 3
+	s, _ := newTestServer(t, &ServerOpts{MaxConnsPerIP: max})
+
+	var conns []*textproto.Conn
+	for i := 0; i < max; i++ {
+		c, code := dialFrom(t, s, "127.0.0.1")
+		if code != 220 {
+			t.Fatalf("connection %d: got %d, want 220", i, code)
+		}
+		conns = append(conns, c)
+	}
+	if _, code := dialFrom(t, s, "127.0.0.1"); code != 421 {
+		t.Errorf("got %d, want 421", code)
+	}
+	if _, code := dialFrom(t, s, "127.0.0.2"); code != 220 {
+		t.Errorf("other IP: got %d, want 220", code)
+	}
+
+	// A disconnect frees a slot.
+	expect(t, conns[0], 221, "QUIT")
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, code := dialFrom(t, s, "127.0.0.1")
+		if code == 220 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d after a disconnect, want 220", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	const max = 3
+	s, _ := newTestServer(t, &ServerOpts{MaxConnections: max})
+
+	var conns []*textproto.Conn
+	for i := 0; i < max; i++ {
+		// spread over IPs, the limit is for all of them
+		c, code := dialFrom(t, s, fmt.Sprintf("127.0.0.%d", i+1))
+		if code != 220 {
+			t.Fatalf("connection %d: got %d, want 220", i, code)
+		}
+		conns = append(conns, c)
+	}
+	c, code := dialFrom(t, s, "127.0.0.9")
+	if code != 421 {
+		t.Errorf("got %d, want 421", code)
+	}
+	if _, err := c.R.ReadByte(); err == nil {
+		t.Error("expected the rejected connection to be closed")
+	}
+
+	// A disconnect frees a slot.
+	conns[0].Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, code := dialFrom(t, s, "127.0.0.9")
+		if code == 220 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d after a disconnect, want 220", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
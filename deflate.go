@@ -0,0 +1,54 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"compress/zlib"
+	"io"
+)
+
+// deflateSocket compresses the data of transfers in MODE Z as a zlib
+// stream, and decompresses the stream read from the client.
+type deflateSocket struct {
+	DataSocket
+	reader   io.ReadCloser // opened by the first Read, as it reads the header
+	writer   *zlib.Writer
+	finished bool
+}
+
+func newDeflateSocket(socket DataSocket) *deflateSocket {
+	return &deflateSocket{DataSocket: socket}
+}
+
+func (socket *deflateSocket) Read(p []byte) (int, error) {
+	if socket.reader == nil {
+		reader, err := zlib.NewReader(socket.DataSocket)
+		if err != nil {
+			return 0, err
+		}
+		socket.reader = reader
+	}
+	return socket.reader.Read(p)
+}
+
+func (socket *deflateSocket) Write(p []byte) (int, error) {
+	if socket.writer == nil {
+		socket.writer = zlib.NewWriter(socket.DataSocket)
+	}
+	return socket.writer.Write(p)
+}
+
+// finish writes the end of the compressed stream, which is a valid empty
+// stream if nothing was written. The socket itself is left open.
+func (socket *deflateSocket) finish() error {
+	if socket.finished {
+		return nil
+	}
+	socket.finished = true
+	if socket.writer == nil {
+		socket.writer = zlib.NewWriter(socket.DataSocket)
+	}
+	return socket.writer.Close()
+}
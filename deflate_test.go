@@ -0,0 +1,86 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"math/rand"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// deflated returns data compressed as a zlib stream.
+func deflated(data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// downloadDeflated is download for MODE Z, returning the decompressed data.
+func downloadDeflated(t *testing.T, c *textproto.Conn, format string, args ...interface{}) []byte {
+	t.Helper()
+	r, err := zlib.NewReader(strings.NewReader(download(t, c, format, args...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCmdModeZ(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	c := dialTestServer(t, s)
+	login(t, c)
+	if msg := expect(t, c, 211, "FEAT"); !strings.Contains(msg, "MODE Z") {
+		t.Errorf("MODE Z missing from FEAT: %q", msg)
+	}
+
+	compressible := bytes.Repeat([]byte("all work and no play "), 50000)
+	incompressible := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+	expect(t, c, 200, "TYPE I")
+	expect(t, c, 200, "MODE Z")
+	for name, content := range map[string][]byte{"/text": compressible, "/random": incompressible, "/empty": nil} {
+		upload(t, c, name, string(deflated(content)))
+		if got := driver.testFile(name); got != string(content) {
+			t.Errorf("%s: stored %d bytes, want %d", name, len(got), len(content))
+		}
+		if got := downloadDeflated(t, c, "RETR %s", name); !bytes.Equal(got, content) {
+			t.Errorf("%s: downloaded %d bytes, want %d", name, len(got), len(content))
+		}
+	}
+	// The compressed text goes over the wire, not the original.
+	upload(t, c, "/text", string(deflated(compressible)))
+	if in := driver.lastConn().LastTransfer().BytesIn; in >= int64(len(compressible))/10 {
+		t.Errorf("received %d bytes for %d bytes of text", in, len(compressible))
+	}
+	if got := downloadDeflated(t, c, "NLST /"); string(got) != "empty\r\nrandom\r\ntext\r\n" {
+		t.Errorf("got listing %q", got)
+	}
+
+	expect(t, c, 200, "MODE S")
+	if got := download(t, c, "RETR /text"); got != string(compressible) {
+		t.Errorf("downloaded %d bytes in stream mode, want %d", len(got), len(compressible))
+	}
+	expect(t, c, 504, "MODE B")
+
+	// A stream that isn't zlib fails the upload.
+	expect(t, c, 200, "MODE Z")
+	data := openPassive(t, c)
+	expect(t, c, 150, "STOR /bad")
+	data.Write([]byte("not deflated"))
+	data.Close()
+	if _, _, err := c.ReadResponse(450); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// socketRegistry keeps track of the open data sockets of a server, so a
+// shutdown can wait for their transfers to complete.
+type socketRegistry struct {
+	lock    sync.Mutex
+	sockets map[*trackedSocket]bool // whether a transfer started on them
+	empty   chan struct{}           // closed once no transfers are left
+}
+
+func (r *socketRegistry) add(socket *trackedSocket) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.sockets == nil {
+		r.sockets = make(map[*trackedSocket]bool)
+	}
+	r.sockets[socket] = false
+}
+
+// start records that a transfer started on socket.
+func (r *socketRegistry) start(socket *trackedSocket) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.sockets[socket]; ok {
+		r.sockets[socket] = true
+	}
+}
+
+func (r *socketRegistry) remove(socket *trackedSocket) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.sockets, socket)
+	if !r.transferring() && r.empty != nil {
+		close(r.empty)
+		r.empty = nil
+	}
+}
+
+// transferring reports whether a transfer is in progress on any socket. It
+// must be called with the lock held.
+func (r *socketRegistry) transferring() bool {
+	for _, started := range r.sockets {
+		if started {
+			return true
+		}
+	}
+	return false
+}
+
+// wait blocks until all transfers completed or the timeout expired, and
+// reports whether they completed.
+func (r *socketRegistry) wait(timeout time.Duration) bool {
+	r.lock.Lock()
+	if !r.transferring() {
+		r.lock.Unlock()
+		return true
+	}
+	if r.empty == nil {
+		r.empty = make(chan struct{})
+	}
+	empty := r.empty
+	r.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-empty:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// closeIdle closes the sockets no transfer started on, like passive
+// listeners the client never used.
+func (r *socketRegistry) closeIdle() {
+	r.close(false)
+}
+
+// closeAll closes all open sockets.
+func (r *socketRegistry) closeAll() {
+	r.close(true)
+}
+
+func (r *socketRegistry) close(transferring bool) {
+	r.lock.Lock()
+	sockets := make([]*trackedSocket, 0, len(r.sockets))
+	for socket, started := range r.sockets {
+		if transferring || !started {
+			sockets = append(sockets, socket)
+			delete(r.sockets, socket)
+		}
+	}
+	r.lock.Unlock()
+
+	for _, socket := range sockets {
+		socket.Close()
+	}
+}
+
+// trackedSocket is a data socket registered with a socketRegistry until
+// it is closed.
+type trackedSocket struct {
+	DataSocket
+	registry *socketRegistry
+	once     sync.Once
+}
+
+func newTrackedSocket(socket DataSocket, registry *socketRegistry) *trackedSocket {
+	tracked := &trackedSocket{DataSocket: socket, registry: registry}
+	registry.add(tracked)
+	return tracked
+}
+
+// start records that a transfer started on socket.
+func (socket *trackedSocket) start() {
+	socket.registry.start(socket)
+}
+
+func (socket *trackedSocket) Close() error {
+	socket.once.Do(func() { socket.registry.remove(socket) })
+	return socket.DataSocket.Close()
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	content := bytes.Repeat([]byte("x"), 8<<20)
+	driver.files["/big.bin"] = content
+
+	c := dialTestServer(t, s)
+	login(t, c)
+	data := openPassive(t, c)
+	defer data.Close()
+	expect(t, c, 150, "RETR /big.bin")
+
+	done := make(chan error, 1)
+	go func() { done <- s.GracefulShutdown(5 * time.Second) }()
+
+	// New connections are refused while the transfer drains.
+	time.Sleep(50 * time.Millisecond)
+	if nc, err := net.Dial("tcp", s.listenTo); err == nil {
+		nc.Close()
+		t.Error("expected new connections to be refused")
+	}
+
+	got, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes, want %d", len(got), len(content))
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	driver.files["/big.bin"] = bytes.Repeat([]byte("x"), 8<<20)
+
+	c := dialTestServer(t, s)
+	login(t, c)
+	data := openPassive(t, c)
+	defer data.Close()
+	expect(t, c, 150, "RETR /big.bin")
+
+	// The client never reads, so the transfer is aborted after the timeout.
+	if err := s.GracefulShutdown(100 * time.Millisecond); err != ErrShutdownTimeout {
+		t.Fatalf("got error %v, want %v", err, ErrShutdownTimeout)
+	}
+	if _, _, err := c.ReadResponse(426); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGracefulShutdownIdlePassive(t *testing.T) {
+	s, _ := newTestServer(t, &ServerOpts{})
+	c := dialTestServer(t, s)
+	login(t, c)
+	port := epsvPort(t, expect(t, c, 229, "EPSV"))
+
+	// The passive listener the client never used doesn't hold up the
+	// shutdown, and is closed.
+	start := time.Now()
+	if err := s.GracefulShutdown(5 * time.Second); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+	if nc, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		nc.Close()
+		t.Error("expected the passive listener to be closed")
+	}
+}
+
+func TestGracefulShutdownModeZ(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	c := dialTestServer(t, s)
+	login(t, c)
+	expect(t, c, 200, "MODE Z")
+	data := openPassive(t, c)
+	defer data.Close()
+	expect(t, c, 150, "STOR /z.txt")
+
+	// The compressed upload in progress is waited for.
+	done := make(chan error, 1)
+	go func() { done <- s.GracefulShutdown(5 * time.Second) }()
+	time.Sleep(50 * time.Millisecond)
+	data.Write(deflated([]byte("compressed")))
+	data.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+	if got := driver.testFile("/z.txt"); got != "compressed" {
+		t.Errorf("got %q, want %q", got, "compressed")
+	}
+}
@@ -4,7 +4,11 @@
 
 package server
 
-import "io"
+import (
+	"io"
+	"os"
+	"time"
+)
 
 // DriverFactory is a driver factory to create driver. For each client that connects to the server, a new FTPDriver is required.
 // Create an implementation if this interface and provide it to FTPServer.
@@ -55,7 +59,44 @@ type Driver interface {
 	// returns - a string containing the file data to send to the client
 	GetFile(string, int64) (int64, io.ReadCloser, error)
 
-	// params  - destination path, an io.Reader containing the file data
+	// params  - destination path, an io.Reader containing the file data,
+	//           whether to append to the file (APPE), creating it if missing
 	// returns - the number of bytes writen and the first error encountered while writing, if any.
 	PutFile(string, io.Reader, bool) (int64, error)
 }
+
+// RestartDriver is an optional interface a Driver can implement to resume
+// uploads at an arbitrary offset after a REST command. Without it, an upload
+// can only be resumed at the current end of the file.
+type RestartDriver interface {
+	// params  - destination path, an io.Reader containing the file data,
+	//           the offset to start writing at
+	// returns - the number of bytes writen and the first error encountered while writing, if any.
+	PutFileAt(string, io.Reader, int64) (int64, error)
+}
+
+// ChtimesDriver is an optional interface a Driver can implement to let
+// clients set the modification time of files with MFMT.
+type ChtimesDriver interface {
+	// params  - path, the new modification time
+	// returns - nil if the time was changed or any error encountered
+	Chtimes(string, time.Time) error
+}
+
+// ChmodDriver is an optional interface a Driver can implement to let clients
+// change the mode of files and directories with SITE CHMOD.
+type ChmodDriver interface {
+	// params  - path, the new permission bits and setuid, setgid and sticky
+	//           bits
+	// returns - nil if the mode was changed or any error encountered
+	Chmod(string, os.FileMode) error
+}
+
+// FreeSpaceDriver is an optional interface a Driver can implement to let
+// ALLO refuse uploads there is no room for.
+type FreeSpaceDriver interface {
+	// params  - path of a directory
+	// returns - the number of bytes that can still be stored in it or any
+	//           error encountered
+	FreeSpace(string) (int64, error)
+}
@@ -0,0 +1,361 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDriver is a minimal in-memory Driver used to exercise the protocol
+// without touching the disk.
+type testDriver struct {
+	lock   sync.Mutex
+	files  map[string][]byte
+	dirs   map[string]bool
+	mtimes map[string]time.Time   // defaults to testModTime
+	modes  map[string]os.FileMode // set by Chmod
+	conn   *Conn                  // the most recent connection
+}
+
+type testDriverFactory struct {
+	driver *testDriver
+}
+
+func newTestDriverFactory() *testDriverFactory {
+	return &testDriverFactory{driver: &testDriver{
+		files:  map[string][]byte{},
+		dirs:   map[string]bool{"/": true},
+		mtimes: map[string]time.Time{},
+		modes:  map[string]os.FileMode{},
+	}}
+}
+
+func (factory *testDriverFactory) NewDriver() (Driver, error) {
+	return factory.driver, nil
+}
+
+// testModTime is the modification time of files by default.
+var testModTime = time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+
+type testFileInfo struct {
+	name    string
+	size    int64
+	isDir   bool
+	modTime time.Time
+}
+
+func (f testFileInfo) Name() string { return f.name }
+func (f testFileInfo) Size() int64  { return f.size }
+func (f testFileInfo) IsDir() bool  { return f.isDir }
+
+func (f testFileInfo) ModTime() time.Time {
+	if f.modTime.IsZero() {
+		return testModTime
+	}
+	return f.modTime
+}
+
+func (f testFileInfo) Sys() interface{} { return nil }
+func (f testFileInfo) Owner() string    { return "test" }
+func (f testFileInfo) Group() string    { return "test" }
+
+func (f testFileInfo) Mode() os.FileMode {
+	if f.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (driver *testDriver) Init(conn *Conn) {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	driver.conn = conn
+}
+
+// lastConn returns the connection the driver was most recently used by.
+func (driver *testDriver) lastConn() *Conn {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	return driver.conn
+}
+
+func (driver *testDriver) Stat(p string) (FileInfo, error) {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	if driver.dirs[p] {
+		return testFileInfo{name: path.Base(p), isDir: true}, nil
+	}
+	if data, ok := driver.files[p]; ok {
+		return testFileInfo{name: path.Base(p), size: int64(len(data)), modTime: driver.mtimes[p]}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (driver *testDriver) ChangeDir(p string) error {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	if !driver.dirs[p] {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (driver *testDriver) ListDir(p string, callback func(FileInfo) error) error {
+	driver.lock.Lock()
+	var infos []FileInfo
+	for name := range driver.dirs {
+		if name != "/" && path.Dir(name) == p {
+			infos = append(infos, testFileInfo{name: path.Base(name), isDir: true})
+		}
+	}
+	for name, data := range driver.files {
+		if path.Dir(name) == p {
+			infos = append(infos, testFileInfo{name: path.Base(name), size: int64(len(data))})
+		}
+	}
+	driver.lock.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	for _, info := range infos {
+		if err := callback(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (driver *testDriver) DeleteDir(p string) error {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	if !driver.dirs[p] {
+		return os.ErrNotExist
+	}
+	delete(driver.dirs, p)
+	return nil
+}
+
+func (driver *testDriver) DeleteFile(p string) error {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	if _, ok := driver.files[p]; !ok {
+		return os.ErrNotExist
+	}
+	delete(driver.files, p)
+	return nil
+}
+
+func (driver *testDriver) Rename(from, to string) error {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	data, ok := driver.files[from]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if !driver.dirs[path.Dir(to)] {
+		return os.ErrNotExist
+	}
+	delete(driver.files, from)
+	driver.files[to] = data
+	return nil
+}
+
+func (driver *testDriver) MakeDir(p string) error {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	if driver.dirs[p] {
+		return os.ErrExist
+	}
+	driver.dirs[p] = true
+	return nil
+}
+
+func (driver *testDriver) GetFile(p string, offset int64) (int64, io.ReadCloser, error) {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	data, ok := driver.files[p]
+	if !ok {
+		return 0, nil, os.ErrNotExist
+	}
+	if offset > int64(len(data)) {
+		return 0, nil, errors.New("offset beyond end of file")
+	}
+	return int64(len(data)) - offset, ioutil.NopCloser(bytes.NewReader(data[offset:])), nil
+}
+
+func (driver *testDriver) PutFile(p string, data io.Reader, appendData bool) (int64, error) {
+	driver.lock.Lock()
+	parentExists := driver.dirs[path.Dir(p)]
+	driver.lock.Unlock()
+	if !parentExists {
+		return 0, os.ErrNotExist
+	}
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, data)
+	if err != nil {
+		return n, err
+	}
+
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	if appendData {
+		driver.files[p] = append(driver.files[p], buf.Bytes()...)
+	} else {
+		driver.files[p] = buf.Bytes()
+	}
+	return n, nil
+}
+
+func (driver *testDriver) Chtimes(p string, mtime time.Time) error {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	if _, ok := driver.files[p]; !ok {
+		return os.ErrNotExist
+	}
+	driver.mtimes[p] = mtime
+	return nil
+}
+
+func (driver *testDriver) Chmod(p string, mode os.FileMode) error {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	if _, ok := driver.files[p]; !ok && !driver.dirs[p] {
+		return os.ErrNotExist
+	}
+	driver.modes[p] = mode
+	return nil
+}
+
+// testFile returns the content of the file at p, for assertions.
+func (driver *testDriver) testFile(p string) string {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	return string(driver.files[p])
+}
+
+// newTestServer starts a server backed by a testDriver on a random port of
+// opts.Hostname, or 127.0.0.1. The server is shut down when the test ends.
+func newTestServer(t testing.TB, opts *ServerOpts) (*Server, *testDriver) {
+	factory := newTestDriverFactory()
+	if opts.Factory == nil {
+		opts.Factory = factory
+	}
+	if opts.Auth == nil {
+		opts.Auth = &SimpleAuth{Name: "admin", Password: "admin"}
+	}
+	if opts.Logger == nil {
+		opts.Logger = new(DiscardLogger)
+	}
+	s := NewServer(opts)
+	host := "127.0.0.1"
+	if opts.Hostname != "" {
+		host = opts.Hostname
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listenTo = l.Addr().String()
+
+	// Serve, with the setup done synchronously so Shutdown can't race it.
+	if err := s.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	s.listener = l
+	go s.serve(l, s.TLS && !s.ExplicitFTPS)
+	t.Cleanup(func() { s.Shutdown() })
+	return s, factory.driver
+}
+
+// dialTestServer opens a control connection to s and consumes the banner.
+func dialTestServer(t testing.TB, s *Server) *textproto.Conn {
+	c, err := textproto.Dial("tcp", s.listenTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// expect sends a command on c and checks the reply code.
+func expect(t testing.TB, c *textproto.Conn, code int, format string, args ...interface{}) string {
+	t.Helper()
+	if _, err := c.Cmd(format, args...); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := c.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%s: %v", fmt.Sprintf(format, args...), err)
+	}
+	return msg
+}
+
+// login authenticates c with the credentials used by newTestServer.
+func login(t testing.TB, c *textproto.Conn) {
+	t.Helper()
+	expect(t, c, 331, "USER admin")
+	expect(t, c, 230, "PASS admin")
+}
+
+// openPassive sends PASV on c and connects to the advertised data port.
+func openPassive(t testing.TB, c *textproto.Conn) net.Conn {
+	t.Helper()
+	msg := expect(t, c, 227, "PASV")
+	var h1, h2, h3, h4, p1, p2 int
+	start := strings.Index(msg, "(")
+	if _, err := fmt.Sscanf(msg[start:], "(%d,%d,%d,%d,%d,%d)", &h1, &h2, &h3, &h4, &p1, &p2); err != nil {
+		t.Fatalf("malformed PASV reply %q: %v", msg, err)
+	}
+	data, err := net.Dial("tcp", fmt.Sprintf("%d.%d.%d.%d:%d", h1, h2, h3, h4, p1*256+p2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// upload stores content at path over a passive data connection.
+func upload(t testing.TB, c *textproto.Conn, path, content string) {
+	t.Helper()
+	data := openPassive(t, c)
+	expect(t, c, 150, "STOR %s", path)
+	data.Write([]byte(content))
+	data.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// download retrieves the reply to cmd over a passive data connection, e.g.
+// a file for RETR or a listing for LIST.
+func download(t testing.TB, c *textproto.Conn, format string, args ...interface{}) string {
+	t.Helper()
+	data := openPassive(t, c)
+	defer data.Close()
+	expect(t, c, 150, format, args...)
+	content, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// maxDSCP is the largest DSCP value, which has 6 bits.
+const maxDSCP = 63
+
+// setDSCP marks the traffic of conn with the DSCP value dscp, unless it's 0
+// or conn isn't TCP.
+func setDSCP(conn net.Conn, dscp int) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || dscp == 0 {
+		return nil
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	network := "tcp6"
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() != nil {
+		network = "tcp4"
+	}
+	return dscpControl(dscp)(network, "", raw)
+}
+
+// dscpControl returns a net.Dialer Control function marking traffic with
+// the DSCP value dscp.
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			// the DSCP is the upper 6 bits of the TOS or traffic class
+			sockErr = setTOS(fd, network == "tcp6", dscp<<2)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// dscpListener marks the traffic of the connections it accepts with a DSCP
+// value.
+type dscpListener struct {
+	net.Listener
+	dscp int
+}
+
+func (l dscpListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := setDSCP(conn, l.dscp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tos returns the IPv4 TOS of conn.
+func tos(t *testing.T, conn net.Conn) int {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tos int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		tos, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tos
+}
+
+func TestDataDSCP(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// Active connections are marked when dialed.
+	conn := &Conn{server: &Server{ServerOpts: &ServerOpts{ActiveDialTimeout: time.Second, DataDSCP: 10}}}
+	active, err := conn.activeDialer().Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	if got := tos(t, active); got != 10<<2 {
+		t.Errorf("active: got TOS %#x, want %#x", got, 10<<2)
+	}
+
+	// Passive connections are marked when accepted.
+	socket, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{}, time.Second, 0, 0, 46, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	client, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.Port())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	passive := socket.(*ftpPassiveSocket)
+	if err := passive.waitForOpenSocket(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tos(t, passive.conn.(*deadlineConn).Conn); got != 46<<2 {
+		t.Errorf("passive: got TOS %#x, want %#x", got, 46<<2)
+	}
+
+	// Unmarked by default.
+	conn = &Conn{server: &Server{ServerOpts: &ServerOpts{ActiveDialTimeout: time.Second}}}
+	plain, err := conn.activeDialer().Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if got := tos(t, plain); got != 0 {
+		t.Errorf("got TOS %#x, want none", got)
+	}
+
+	bad := NewServer(&ServerOpts{Factory: newTestDriverFactory(), DataDSCP: 64, Logger: new(DiscardLogger)})
+	if err := bad.prepare(); err == nil {
+		t.Error("expected an error for an invalid DSCP")
+	}
+}
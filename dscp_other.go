@@ -0,0 +1,16 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package server
+
+// dscpSupported tells whether DataDSCP has an effect on this platform.
+const dscpSupported = false
+
+// setTOS does nothing, as this platform doesn't let traffic be marked.
+func setTOS(fd uintptr, ipv6 bool, tos int) error {
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// defaultHashAlgorithm is used by HASH until OPTS HASH selects another one.
+const defaultHashAlgorithm = "SHA-256"
+
+// hashAlgorithms are the algorithms supported by HASH, in the order they
+// are listed in FEAT.
+var hashAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"SHA-1", sha1.New},
+	{"SHA-256", sha256.New},
+	{"SHA-512", sha512.New},
+	{"MD5", md5.New},
+	{"CRC32", func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// hashAlgorithm returns the canonical name of the algorithm called name and
+// a constructor for it, or false if it isn't supported.
+func hashAlgorithm(name string) (string, func() hash.Hash, bool) {
+	for _, algo := range hashAlgorithms {
+		if strings.EqualFold(algo.name, name) {
+			return algo.name, algo.new, true
+		}
+	}
+	return "", nil, false
+}
+
+// hashFeature returns the HASH line of the FEAT reply, marking the selected
+// algorithm with a "*".
+func hashFeature(selected string) string {
+	names := make([]string, len(hashAlgorithms))
+	for i, algo := range hashAlgorithms {
+		names[i] = algo.name
+		if algo.name == selected {
+			names[i] += "*"
+		}
+	}
+	return " HASH " + strings.Join(names, ";") + "\n"
+}
+
+// hashReader returns the hex digest of the first n bytes of r, or of all of
+// r if n is negative, and the number of bytes hashed. The content is
+// streamed, never held in memory.
+func hashReader(newHash func() hash.Hash, r io.Reader, n int64) (string, int64, error) {
+	if n >= 0 {
+		r = io.LimitReader(r, n)
+	}
+	h := newHash()
+	hashed, err := io.Copy(h, r)
+	if err != nil {
+		return "", hashed, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), hashed, nil
+}
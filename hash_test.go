@@ -0,0 +1,37 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashReader(t *testing.T) {
+	var hashTests = []struct {
+		algorithm string
+		digest    string
+	}{
+		{"SHA-1", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{"sha-256", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"SHA-512", "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+		{"MD5", "900150983cd24fb0d6963f7d28e17f72"},
+		{"CRC32", "352441c2"},
+	}
+	for _, tt := range hashTests {
+		_, newHash, ok := hashAlgorithm(tt.algorithm)
+		if !ok {
+			t.Errorf("%s: not supported", tt.algorithm)
+			continue
+		}
+		digest, n, err := hashReader(newHash, strings.NewReader("abc"), -1)
+		if err != nil || n != 3 || digest != tt.digest {
+			t.Errorf("%s: got %s (%d bytes, %v), want %s", tt.algorithm, digest, n, err, tt.digest)
+		}
+	}
+	if _, _, ok := hashAlgorithm("SHA-3"); ok {
+		t.Error("expected SHA-3 to be unsupported")
+	}
+}
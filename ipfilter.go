@@ -0,0 +1,77 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipFilter decides which client IPs may connect.
+type ipFilter struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// newIPFilter parses the allowed and denied networks, given in CIDR notation
+// or as single IPs.
+func newIPFilter(allowed, denied []string) (*ipFilter, error) {
+	var filter ipFilter
+	var err error
+	if filter.allowed, err = parseNetworks(allowed); err != nil {
+		return nil, err
+	}
+	if filter.denied, err = parseNetworks(denied); err != nil {
+		return nil, err
+	}
+	return &filter, nil
+}
+
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("ftp: invalid network %q", network)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("ftp: invalid network %q", network)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// allows reports whether ip may connect: it must not be in a denied network
+// and, if there are allowed networks, be in one of them. Clients without an
+// IP, like those of Unix sockets, are only allowed if all networks are.
+func (filter *ipFilter) allows(ip net.IP) bool {
+	if ip == nil {
+		return len(filter.allowed) == 0
+	}
+	if containsIP(filter.denied, ip) {
+		return false
+	}
+	return len(filter.allowed) == 0 || containsIP(filter.allowed, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	var tests = []struct {
+		allowed, denied []string
+		ip              string
+		want            bool
+	}{
+		{nil, nil, "192.0.2.1", true},
+		{nil, nil, "2001:db8::1", true},
+		{[]string{"192.0.2.1"}, nil, "192.0.2.1", true},
+		{[]string{"192.0.2.1"}, nil, "192.0.2.2", false},
+		{[]string{"192.0.2.0/24"}, nil, "192.0.2.200", true},
+		{[]string{"192.0.2.0/24"}, nil, "198.51.100.1", false},
+		{[]string{"192.0.2.0/24"}, nil, "::ffff:192.0.2.1", true},
+		{nil, []string{"192.0.2.1"}, "192.0.2.1", false},
+		{nil, []string{"192.0.2.1"}, "192.0.2.2", true},
+		{nil, []string{"192.0.2.0/24"}, "192.0.2.7", false},
+		{[]string{"192.0.2.0/24"}, []string{"192.0.2.7"}, "192.0.2.7", false},
+		{[]string{"192.0.2.0/24"}, []string{"192.0.2.7"}, "192.0.2.8", true},
+		{[]string{"2001:db8::/32"}, nil, "2001:db8:1::1", true},
+		{[]string{"2001:db8::/32"}, nil, "2001:db9::1", false},
+		{[]string{"2001:db8::1"}, nil, "2001:db8::1", true},
+		{[]string{"2001:db8::1"}, nil, "2001:db8::2", false},
+		{nil, []string{"2001:db8::/48"}, "2001:db8::5", false},
+		{nil, []string{"2001:db8::/48"}, "192.0.2.1", true},
+		{[]string{"2001:db8::/32"}, []string{"2001:db8:bad::/48"}, "2001:db8:bad::1", false},
+		// clients of Unix sockets have no IP
+		{nil, nil, "", true},
+		{nil, []string{"192.0.2.0/24"}, "", true},
+		{[]string{"192.0.2.0/24"}, nil, "", false},
+	}
+	for _, tt := range tests {
+		filter, err := newIPFilter(tt.allowed, tt.denied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filter.allows(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("allowed %v, denied %v: %s allowed = %v, want %v", tt.allowed, tt.denied, tt.ip, got, tt.want)
+		}
+	}
+
+	for _, network := range []string{"", "192.0.2", "192.0.2.0/33", "example.com"} {
+		if _, err := newIPFilter([]string{network}, nil); err == nil {
+			t.Errorf("%q: expected an error", network)
+		}
+	}
+}
+
+func TestIPFilterConnections(t *testing.T) {
+	s, _ := newTestServer(t, &ServerOpts{
+		AllowedNetworks: []string{"127.0.0.0/8"},
+		DeniedNetworks:  []string{"127.0.0.2"},
+	})
+	if _, code := dialFrom(t, s, "127.0.0.1"); code != 220 {
+		t.Errorf("allowed IP: got %d, want 220", code)
+	}
+	if _, code := dialFrom(t, s, "127.0.0.2"); code != 421 {
+		t.Errorf("denied IP: got %d, want 421", code)
+	}
+}
+
+func TestIPFilterConnectionsIPv6(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("IPv6 loopback not available: ", err)
+	} else {
+		l.Close()
+	}
+	s, _ := newTestServer(t, &ServerOpts{Hostname: "::1", AllowedNetworks: []string{"192.0.2.0/24"}})
+	if _, code := dialFrom(t, s, "::1"); code != 421 {
+		t.Errorf("got %d, want 421", code)
+	}
+	s, _ = newTestServer(t, &ServerOpts{Hostname: "::1", AllowedNetworks: []string{"::1/128"}})
+	if _, code := dialFrom(t, s, "::1"); code != 220 {
+		t.Errorf("got %d, want 220", code)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// JSONLogger writes one JSON object per line for each message, with the
+// fields time, session, level and msg plus any context added by With. It
+// is safe for concurrent use.
+type JSONLogger struct {
+	// Messages below Level are dropped.
+	Level Level
+
+	lock    *sync.Mutex
+	out     io.Writer
+	context []interface{}
+}
+
+// NewJSONLogger returns a JSONLogger writing to out.
+func NewJSONLogger(out io.Writer) *JSONLogger {
+	return &JSONLogger{lock: new(sync.Mutex), out: out}
+}
+
+// With returns a logger adding the given key/value pairs to every message.
+// It shares its output with logger.
+func (logger *JSONLogger) With(keysAndValues ...interface{}) *JSONLogger {
+	l := *logger
+	l.context = append(append([]interface{}{}, logger.context...), keysAndValues...)
+	return &l
+}
+
+func (logger *JSONLogger) log(level Level, sessionId string, msg string, keysAndValues ...interface{}) {
+	if level < logger.Level {
+		return
+	}
+	event := map[string]interface{}{}
+	addFields(event, logger.context)
+	addFields(event, keysAndValues)
+	event["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	event["session"] = sessionId
+	event["level"] = level.String()
+	event["msg"] = msg
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":    event["time"],
+			"session": sessionId,
+			"level":   LevelError.String(),
+			"msg":     fmt.Sprintf("ftp: unable to encode log message %q: %v", msg, err),
+		})
+	}
+	line = append(line, '\n')
+
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	logger.out.Write(line)
+}
+
+// addFields copies key/value pairs into event. A trailing key without a
+// value is kept under "!BADKEY".
+func addFields(event map[string]interface{}, keysAndValues []interface{}) {
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 == len(keysAndValues) {
+			event["!BADKEY"] = fieldValue(keysAndValues[i])
+			break
+		}
+		event[fmt.Sprint(keysAndValues[i])] = fieldValue(keysAndValues[i+1])
+	}
+}
+
+func fieldValue(v interface{}) interface{} {
+	if err, ok := v.(error); ok {
+		return err.Error()
+	}
+	return v
+}
+
+func (logger *JSONLogger) Print(sessionId string, message interface{}) {
+	logger.log(LevelInfo, sessionId, fmt.Sprint(message))
+}
+
+func (logger *JSONLogger) Printf(sessionId string, format string, v ...interface{}) {
+	logger.log(LevelInfo, sessionId, fmt.Sprintf(format, v...))
+}
+
+func (logger *JSONLogger) PrintCommand(sessionId string, command string, params string) {
+	if command == "PASS" {
+		params = "****"
+	}
+	logger.log(LevelDebug, sessionId, "command", "command", command, "params", params)
+}
+
+func (logger *JSONLogger) PrintResponse(sessionId string, code int, message string) {
+	logger.log(LevelDebug, sessionId, "response", "code", code, "response", message)
+}
+
+func (logger *JSONLogger) Debugf(sessionId string, format string, v ...interface{}) {
+	logger.log(LevelDebug, sessionId, fmt.Sprintf(format, v...))
+}
+
+func (logger *JSONLogger) Infof(sessionId string, format string, v ...interface{}) {
+	logger.log(LevelInfo, sessionId, fmt.Sprintf(format, v...))
+}
+
+func (logger *JSONLogger) Warnf(sessionId string, format string, v ...interface{}) {
+	logger.log(LevelWarn, sessionId, fmt.Sprintf(format, v...))
+}
+
+func (logger *JSONLogger) Errorf(sessionId string, format string, v ...interface{}) {
+	logger.log(LevelError, sessionId, fmt.Sprintf(format, v...))
+}
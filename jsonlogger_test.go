@@ -0,0 +1,76 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf)
+	logger.Level = LevelInfo
+
+	logger.Debugf("s1", "dropped")
+	logger.With("user", "admin", "err", errors.New("boom")).Warnf("s1", "upload %s failed", "/a.txt")
+	logger.PrintCommand("s1", "PASS", "secret")
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"session": "s1",
+		"level":   "WARN",
+		"msg":     "upload /a.txt failed",
+		"user":    "admin",
+		"err":     "boom",
+	}
+	for k, v := range want {
+		if event[k] != v {
+			t.Errorf("got %s %v, want %v", k, event[k], v)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, event["time"].(string)); err != nil {
+		t.Errorf("bad time: %v", err)
+	}
+}
+
+func TestJSONLoggerConcurrent(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l := logger.With("worker", i)
+			for j := 0; j < 100; j++ {
+				l.Infof("s", "message %d", j)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lines := 0
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var event map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid JSON %q: %v", scanner.Text(), err)
+		}
+		lines++
+	}
+	if lines != 1000 {
+		t.Errorf("got %d lines, want 1000", lines)
+	}
+}
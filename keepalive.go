@@ -0,0 +1,47 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"time"
+)
+
+const defaultKeepAlivePeriod = 15 * time.Second
+
+// setKeepAlive enables TCP keepalive on conn with the given period, or the
+// system's if zero, or disables it if period is negative. Connections other
+// than TCP are left alone.
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if period < 0 {
+		return tcpConn.SetKeepAlive(false)
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil || period == 0 {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(period)
+}
+
+// keepAliveListener sets TCP keepalive on the connections it accepts.
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := setKeepAlive(conn, l.period); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// keepAlive returns whether keepalive is enabled on conn and its idle time in
+// seconds.
+func keepAlive(t *testing.T, conn net.Conn) (bool, int) {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enabled, idle int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		enabled, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		if sockErr == nil {
+			idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enabled != 0, idle
+}
+
+func TestKeepAliveControlConn(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{KeepAlivePeriod: 42 * time.Second})
+	c := dialTestServer(t, s)
+	login(t, c)
+	if enabled, idle := keepAlive(t, driver.lastConn().conn); !enabled || idle != 42 {
+		t.Errorf("got keepalive %v every %ds, want every 42s", enabled, idle)
+	}
+
+	s, driver = newTestServer(t, &ServerOpts{KeepAlivePeriod: -1})
+	c = dialTestServer(t, s)
+	login(t, c)
+	if enabled, _ := keepAlive(t, driver.lastConn().conn); enabled {
+		t.Error("keepalive enabled, want disabled")
+	}
+}
+
+func TestKeepAliveDataConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// Active connections are dialed with the configured period.
+	conn := &Conn{server: &Server{ServerOpts: &ServerOpts{ActiveDialTimeout: time.Second, KeepAlivePeriod: 43 * time.Second}}}
+	active, err := conn.activeDialer().Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	if enabled, idle := keepAlive(t, active); !enabled || idle != 43 {
+		t.Errorf("active: got keepalive %v every %ds, want every 43s", enabled, idle)
+	}
+
+	// Passive connections get it when accepted.
+	socket, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{}, time.Second, 0, 44*time.Second, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	client, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.Port())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	passive := socket.(*ftpPassiveSocket)
+	if err := passive.waitForOpenSocket(); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, idle := keepAlive(t, passive.conn.(*deadlineConn).Conn); !enabled || idle != 44 {
+		t.Errorf("passive: got keepalive %v every %ds, want every 44s", enabled, idle)
+	}
+}
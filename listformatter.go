@@ -7,34 +7,152 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 )
 
 type listFormatter []FileInfo
 
-// Short returns a string that lists the collection of files by name only,
-// one per line
-func (formatter listFormatter) Short() []byte {
+// format lists the collection with one line per file, formatted by entry.
+func (formatter listFormatter) format(entry func(FileInfo) string) []byte {
 	var buf bytes.Buffer
 	for _, file := range formatter {
-		fmt.Fprintf(&buf, "%s\r\n", file.Name())
+		buf.WriteString(entry(file))
 	}
 	return buf.Bytes()
 }
 
+// Short returns a string that lists the collection of files by name only,
+// one per line
+func (formatter listFormatter) Short() []byte {
+	return formatter.format(shortEntry)
+}
+
 // Detailed returns a string that lists the collection of files with extra
 // detail, one per line
 func (formatter listFormatter) Detailed() []byte {
+	return formatter.format(detailedEntry)
+}
+
+// shortEntry is the line of file in NLST listings.
+func shortEntry(file FileInfo) string {
+	return file.Name() + "\r\n"
+}
+
+// detailedEntry is the line of file in LIST listings.
+func detailedEntry(file FileInfo) string {
+	return file.Mode().String() +
+		fmt.Sprintf(" 1 %s %s ", file.Owner(), file.Group()) +
+		lpad(strconv.FormatInt(file.Size(), 10), 12) +
+		file.ModTime().Format(" Jan _2 15:04 ") +
+		file.Name() + "\r\n"
+}
+
+// mlstFacts are the facts supported by MLSD, in the order they are listed.
+var mlstFacts = []string{"type", "size", "modify", "perm"}
+
+// MLSD returns the listing of the collection in the machine-readable format
+// of RFC 3659, with only the given facts.
+func (formatter listFormatter) MLSD(facts []string) []byte {
+	return formatter.format(mlsdEntry(facts))
+}
+
+// mlsdEntry returns the formatter of MLSD lines with the given facts.
+func mlsdEntry(facts []string) func(FileInfo) string {
+	return func(file FileInfo) string {
+		return mlstEntry(file, facts) + " " + file.Name() + "\r\n"
+	}
+}
+
+// mlstEntry formats the facts of file, such as
+// "type=file;size=42;modify=20180102030405;perm=adfrw;".
+func mlstEntry(file FileInfo, facts []string) string {
 	var buf bytes.Buffer
-	for _, file := range formatter {
-		fmt.Fprintf(&buf, file.Mode().String())
-		fmt.Fprintf(&buf, " 1 %s %s ", file.Owner(), file.Group())
-		fmt.Fprintf(&buf, lpad(strconv.FormatInt(file.Size(), 10), 12))
-		fmt.Fprintf(&buf, file.ModTime().Format(" Jan _2 15:04 "))
-		fmt.Fprintf(&buf, "%s\r\n", file.Name())
+	for _, fact := range facts {
+		switch fact {
+		case "type":
+			fmt.Fprintf(&buf, "type=%s;", mlstType(file))
+		case "size":
+			if !file.IsDir() {
+				fmt.Fprintf(&buf, "size=%d;", file.Size())
+			}
+		case "modify":
+			fmt.Fprintf(&buf, "modify=%s;", file.ModTime().UTC().Format("20060102150405"))
+		case "perm":
+			fmt.Fprintf(&buf, "perm=%s;", mlstPerm(file))
+		}
 	}
-	return buf.Bytes()
+	return buf.String()
+}
+
+func mlstType(file FileInfo) string {
+	switch {
+	case file.Mode()&os.ModeSymlink != 0:
+		return "OS.unix=symlink"
+	case file.IsDir():
+		return "dir"
+	}
+	return "file"
+}
+
+// mlstPerm derives the perm fact from the owner permission bits.
+func mlstPerm(file FileInfo) string {
+	mode := file.Mode()
+	perm := ""
+	if file.IsDir() {
+		if mode&0200 != 0 {
+			perm += "cdfmp"
+		}
+		if mode&0100 != 0 {
+			perm += "e"
+		}
+		if mode&0400 != 0 {
+			perm += "l"
+		}
+		return perm
+	}
+	if mode&0200 != 0 {
+		perm += "adfw"
+	}
+	if mode&0400 != 0 {
+		perm += "r"
+	}
+	return perm
+}
+
+// mlstFeature returns the MLST line of the FEAT reply, listing all supported
+// facts and marking the selected ones with a "*".
+func mlstFeature(selected []string) string {
+	var buf bytes.Buffer
+	buf.WriteString(" MLST ")
+	for _, fact := range mlstFacts {
+		buf.WriteString(fact)
+		for _, s := range selected {
+			if s == fact {
+				buf.WriteString("*")
+				break
+			}
+		}
+		buf.WriteString(";")
+	}
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+// parseMlstFacts parses the fact list of OPTS MLST, like "type;size;",
+// ignoring unsupported facts.
+func parseMlstFacts(param string) []string {
+	facts := []string{}
+	for _, fact := range mlstFacts {
+		for _, requested := range strings.Split(param, ";") {
+			if strings.EqualFold(strings.TrimSpace(requested), fact) {
+				facts = append(facts, fact)
+				break
+			}
+		}
+	}
+	return facts
 }
 
 func lpad(input string, length int) (result string) {
@@ -0,0 +1,65 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"os"
+	"testing"
+)
+
+// modeFileInfo is a testFileInfo with an explicit mode.
+type modeFileInfo struct {
+	testFileInfo
+	mode os.FileMode
+}
+
+func (f modeFileInfo) Mode() os.FileMode { return f.mode }
+
+func TestListFormatterMLSD(t *testing.T) {
+	files := listFormatter{
+		testFileInfo{name: "a.txt", size: 42},
+		testFileInfo{name: "docs", isDir: true},
+		modeFileInfo{testFileInfo{name: "link", size: 7}, os.ModeSymlink | 0777},
+		modeFileInfo{testFileInfo{name: "ro.txt", size: 1}, 0444},
+	}
+	want := "type=file;size=42;modify=20180102030405;perm=adfwr; a.txt\r\n" +
+		"type=dir;modify=20180102030405;perm=cdfmpel; docs\r\n" +
+		"type=OS.unix=symlink;size=7;modify=20180102030405;perm=adfwr; link\r\n" +
+		"type=file;size=1;modify=20180102030405;perm=r; ro.txt\r\n"
+	if got := string(files.MLSD(mlstFacts)); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	if got := string(files[:1].MLSD([]string{"type", "size"})); got != "type=file;size=42; a.txt\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := string(files[:1].MLSD(nil)); got != " a.txt\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestParseMlstFacts(t *testing.T) {
+	var factTests = []struct {
+		in  string
+		out string
+	}{
+		{"type;size;modify;perm;", "type;size;modify;perm"},
+		{"Size;TYPE;", "type;size"},
+		{"size;unique;", "size"},
+		{"", ""},
+	}
+	for _, tt := range factTests {
+		got := ""
+		for i, fact := range parseMlstFacts(tt.in) {
+			if i > 0 {
+				got += ";"
+			}
+			got += fact
+		}
+		if got != tt.out {
+			t.Errorf("%q: got %q, want %q", tt.in, got, tt.out)
+		}
+	}
+}
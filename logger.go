@@ -16,10 +16,79 @@ type Logger interface {
 	PrintResponse(sessionId string, code int, message string)
 }
 
-// Use an instance of this to log in a standard format
-type StdLogger struct{}
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(level))
+}
+
+// LeveledLogger is a Logger that knows the severity of its messages. A
+// Logger that doesn't implement it has all leveled messages sent to Printf.
+type LeveledLogger interface {
+	Logger
+	Debugf(sessionId string, format string, v ...interface{})
+	Infof(sessionId string, format string, v ...interface{})
+	Warnf(sessionId string, format string, v ...interface{})
+	Errorf(sessionId string, format string, v ...interface{})
+}
+
+// leveledLogger returns logger as a LeveledLogger, adapting it if needed.
+func leveledLogger(logger Logger) LeveledLogger {
+	if l, ok := logger.(LeveledLogger); ok {
+		return l
+	}
+	return printfLogger{logger}
+}
+
+// printfLogger adapts a plain Logger, ignoring levels.
+type printfLogger struct {
+	Logger
+}
+
+func (logger printfLogger) Debugf(sessionId string, format string, v ...interface{}) {
+	logger.Printf(sessionId, format, v...)
+}
+
+func (logger printfLogger) Infof(sessionId string, format string, v ...interface{}) {
+	logger.Printf(sessionId, format, v...)
+}
+
+func (logger printfLogger) Warnf(sessionId string, format string, v ...interface{}) {
+	logger.Printf(sessionId, format, v...)
+}
+
+func (logger printfLogger) Errorf(sessionId string, format string, v ...interface{}) {
+	logger.Printf(sessionId, format, v...)
+}
+
+// Use an instance of this to log in a standard format. Messages below Level
+// are dropped; commands and responses are logged at LevelDebug.
+type StdLogger struct {
+	Level Level
+}
 
 func (logger *StdLogger) Print(sessionId string, message interface{}) {
+	if logger.Level > LevelInfo {
+		return
+	}
 	log.Printf("%s  %s", sessionId, message)
 }
 
@@ -28,6 +97,9 @@ func (logger *StdLogger) Printf(sessionId string, format string, v ...interface{
 }
 
 func (logger *StdLogger) PrintCommand(sessionId string, command string, params string) {
+	if logger.Level > LevelDebug {
+		return
+	}
 	if command == "PASS" {
 		log.Printf("%s > PASS ****", sessionId)
 	} else {
@@ -36,9 +108,35 @@ func (logger *StdLogger) PrintCommand(sessionId string, command string, params s
 }
 
 func (logger *StdLogger) PrintResponse(sessionId string, code int, message string) {
+	if logger.Level > LevelDebug {
+		return
+	}
 	log.Printf("%s < %d %s", sessionId, code, message)
 }
 
+func (logger *StdLogger) logf(level Level, sessionId string, format string, v ...interface{}) {
+	if level < logger.Level {
+		return
+	}
+	log.Printf("%s  %s %s", sessionId, level, fmt.Sprintf(format, v...))
+}
+
+func (logger *StdLogger) Debugf(sessionId string, format string, v ...interface{}) {
+	logger.logf(LevelDebug, sessionId, format, v...)
+}
+
+func (logger *StdLogger) Infof(sessionId string, format string, v ...interface{}) {
+	logger.logf(LevelInfo, sessionId, format, v...)
+}
+
+func (logger *StdLogger) Warnf(sessionId string, format string, v ...interface{}) {
+	logger.logf(LevelWarn, sessionId, format, v...)
+}
+
+func (logger *StdLogger) Errorf(sessionId string, format string, v ...interface{}) {
+	logger.logf(LevelError, sessionId, format, v...)
+}
+
 // Silent logger, produces no output
 type DiscardLogger struct{}
 
@@ -46,3 +144,7 @@ func (logger *DiscardLogger) Print(sessionId string, message interface{})
 func (logger *DiscardLogger) Printf(sessionId string, format string, v ...interface{})     {}
 func (logger *DiscardLogger) PrintCommand(sessionId string, command string, params string) {}
 func (logger *DiscardLogger) PrintResponse(sessionId string, code int, message string)     {}
+func (logger *DiscardLogger) Debugf(sessionId string, format string, v ...interface{})     {}
+func (logger *DiscardLogger) Infof(sessionId string, format string, v ...interface{})      {}
+func (logger *DiscardLogger) Warnf(sessionId string, format string, v ...interface{})      {}
+func (logger *DiscardLogger) Errorf(sessionId string, format string, v ...interface{})     {}
@@ -0,0 +1,74 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStdLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	logger := &StdLogger{Level: LevelWarn}
+	logger.Debugf("id", "debug %d", 1)
+	logger.Infof("id", "info %d", 2)
+	logger.PrintCommand("id", "NOOP", "")
+	logger.Print("id", "print")
+	logger.Warnf("id", "warn %d", 3)
+	logger.Errorf("id", "error %d", 4)
+
+	want := "id  WARN warn 3\nid  ERROR error 4\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// printLogger is a Logger predating levels, recording what it is given.
+type printLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (logger *printLogger) Print(sessionId string, message interface{}) {
+	logger.Printf(sessionId, "%v", message)
+}
+
+func (logger *printLogger) Printf(sessionId string, format string, v ...interface{}) {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	logger.lines = append(logger.lines, sessionId+" "+fmt.Sprintf(format, v...))
+}
+
+func (logger *printLogger) PrintCommand(sessionId string, command string, params string) {
+	logger.Printf(sessionId, "> %s %s", command, params)
+}
+
+func (logger *printLogger) PrintResponse(sessionId string, code int, message string) {}
+
+func TestLeveledLoggerAdapter(t *testing.T) {
+	if _, ok := leveledLogger(new(DiscardLogger)).(*DiscardLogger); !ok {
+		t.Error("expected a LeveledLogger to be used as is")
+	}
+
+	logger := new(printLogger)
+	leveled := leveledLogger(logger)
+	leveled.Debugf("id", "debug")
+	leveled.Errorf("id", "error %d", 1)
+	if got := strings.Join(logger.lines, "\n"); got != "id debug\nid error 1" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultLoginFailureWindow = 15 * time.Minute
+	defaultLoginLockout       = 15 * time.Minute
+	maxLoginDelay             = 30 * time.Second
+)
+
+// loginFailures are the recent failed logins from one IP.
+type loginFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// loginLimiter tracks failed logins per client IP to slow down and lock out
+// password guessing.
+type loginLimiter struct {
+	lock     sync.Mutex
+	failures map[string]*loginFailures
+	now      func() time.Time // time.Now, replaced in tests
+}
+
+func (l *loginLimiter) time() time.Time {
+	if l.now == nil {
+		return time.Now()
+	}
+	return l.now()
+}
+
+// locked reports whether logins from ip are locked out.
+func (l *loginLimiter) locked(ip string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	f, ok := l.failures[ip]
+	return ok && l.time().Before(f.lockedUntil)
+}
+
+// fail records a failed login from ip and returns how long to delay the
+// reply: delay for the first failure within window, doubled for each further
+// one. After max failures within window, ip is locked out for lockout. A max
+// of 0 means no lockout.
+func (l *loginLimiter) fail(ip string, delay time.Duration, max int, window, lockout time.Duration) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.time()
+	l.expire(now, window)
+	if l.failures == nil {
+		l.failures = make(map[string]*loginFailures)
+	}
+	f, ok := l.failures[ip]
+	if !ok {
+		f = &loginFailures{first: now}
+		l.failures[ip] = f
+	}
+	f.count++
+	if max > 0 && f.count >= max {
+		f.count = 0
+		f.first = now
+		f.lockedUntil = now.Add(lockout)
+		return 0
+	}
+	if delay <= 0 {
+		return 0
+	}
+	for i := 1; i < f.count && delay < maxLoginDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxLoginDelay {
+		delay = maxLoginDelay
+	}
+	return delay
+}
+
+// succeed forgets the failed logins from ip.
+func (l *loginLimiter) succeed(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.failures, ip)
+}
+
+// expire forgets the failures older than window of IPs not locked out.
+func (l *loginLimiter) expire(now time.Time, window time.Duration) {
+	for ip, f := range l.failures {
+		if now.Sub(f.first) > window && !now.Before(f.lockedUntil) {
+			delete(l.failures, ip)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := &loginLimiter{now: func() time.Time { return now }}
+	fail := func() time.Duration {
+		return l.fail("10.0.0.1", time.Second, 5, time.Minute, time.Hour)
+	}
+
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		if got := fail(); got != want {
+			t.Errorf("failure %d: got delay %v, want %v", i+1, got, want)
+		}
+		if l.locked("10.0.0.1") {
+			t.Fatalf("locked after %d failures", i+1)
+		}
+	}
+	fail()
+	if !l.locked("10.0.0.1") {
+		t.Fatal("not locked after 5 failures")
+	}
+	if l.locked("10.0.0.2") {
+		t.Error("other IP locked")
+	}
+	now = now.Add(time.Hour)
+	if l.locked("10.0.0.1") {
+		t.Error("still locked after the lockout")
+	}
+
+	// Failures expire after the window and reset on success.
+	if got := fail(); got != time.Second {
+		t.Errorf("got delay %v after the lockout, want 1s", got)
+	}
+	now = now.Add(2 * time.Minute)
+	if got := fail(); got != time.Second {
+		t.Errorf("got delay %v after the window, want 1s", got)
+	}
+	l.succeed("10.0.0.1")
+	if got := fail(); got != time.Second {
+		t.Errorf("got delay %v after a success, want 1s", got)
+	}
+
+	// The delay is capped.
+	for i := 0; i < 10; i++ {
+		l.fail("10.0.0.3", time.Second, 0, time.Minute, time.Hour)
+	}
+	if got := l.fail("10.0.0.3", time.Second, 0, time.Minute, time.Hour); got != maxLoginDelay {
+		t.Errorf("got delay %v, want %v", got, maxLoginDelay)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	s, _ := newTestServer(t, &ServerOpts{LoginDelay: delay, MaxLoginFailures: 3, LoginLockout: time.Hour})
+	c := dialTestServer(t, s)
+
+	var last time.Duration
+	for i := 0; i < 2; i++ {
+		expect(t, c, 331, "USER admin")
+		start := time.Now()
+		expect(t, c, 530, "PASS wrong")
+		elapsed := time.Since(start)
+		if elapsed < delay<<uint(i) || elapsed <= last {
+			t.Errorf("failure %d: replied after %v, want at least %v", i+1, elapsed, delay<<uint(i))
+		}
+		last = elapsed
+	}
+	expect(t, c, 331, "USER admin")
+	expect(t, c, 530, "PASS wrong")
+
+	// Locked out, even with the right password and on a new connection.
+	expect(t, c, 331, "USER admin")
+	expect(t, c, 530, "PASS admin")
+	c = dialTestServer(t, s)
+	expect(t, c, 331, "USER admin")
+	expect(t, c, 530, "PASS admin")
+
+	c, _ = dialFrom(t, s, "127.0.0.2")
+	expect(t, c, 331, "USER admin")
+	expect(t, c, 230, "PASS admin")
+}
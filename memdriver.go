@@ -0,0 +1,355 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errMemIsDir    = errors.New("ftp: is a directory")
+	errMemNotDir   = errors.New("ftp: not a directory")
+	errMemNotEmpty = errors.New("ftp: directory not empty")
+)
+
+// MemDriverFactory creates drivers sharing one in-memory file system, for
+// tests and ephemeral servers. The zero value is an empty file system.
+type MemDriverFactory struct {
+	lock  sync.Mutex
+	files map[string]*memFile // by path, without the root directory
+}
+
+type memFile struct {
+	data    []byte
+	isDir   bool
+	mode    os.FileMode // permission bits
+	modTime time.Time
+}
+
+// NewDriver returns a driver of the file system of factory.
+func (factory *MemDriverFactory) NewDriver() (Driver, error) {
+	return &memDriver{fs: factory}, nil
+}
+
+// WriteFile stores data at p, creating the missing parent directories.
+func (factory *MemDriverFactory) WriteFile(p string, data []byte) error {
+	p = path.Clean("/" + p)
+	factory.lock.Lock()
+	defer factory.lock.Unlock()
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		if f := factory.lookup(dir); f == nil {
+			factory.files[dir] = &memFile{isDir: true, mode: 0755, modTime: time.Now()}
+		} else if !f.isDir {
+			return errMemNotDir
+		}
+	}
+	if f := factory.lookup(p); f != nil && f.isDir {
+		return errMemIsDir
+	}
+	factory.files[p] = &memFile{data: append([]byte{}, data...), mode: 0644, modTime: time.Now()}
+	return nil
+}
+
+// ReadFile returns the content of the file at p.
+func (factory *MemDriverFactory) ReadFile(p string) ([]byte, error) {
+	factory.lock.Lock()
+	defer factory.lock.Unlock()
+	f := factory.lookup(path.Clean("/" + p))
+	if f == nil {
+		return nil, os.ErrNotExist
+	}
+	if f.isDir {
+		return nil, errMemIsDir
+	}
+	return append([]byte{}, f.data...), nil
+}
+
+// lookup returns the file at the clean path p, or nil. It must be called
+// with the lock held.
+func (factory *MemDriverFactory) lookup(p string) *memFile {
+	if factory.files == nil {
+		factory.files = map[string]*memFile{}
+	}
+	if p == "/" {
+		return &memFile{isDir: true, mode: 0755}
+	}
+	return factory.files[p]
+}
+
+// lookupDir returns the directory the file at p would be in, or an error.
+func (factory *MemDriverFactory) lookupDir(p string) error {
+	dir := factory.lookup(path.Dir(p))
+	if dir == nil {
+		return os.ErrNotExist
+	}
+	if !dir.isDir {
+		return errMemNotDir
+	}
+	return nil
+}
+
+// memDriver is a Driver of a MemDriverFactory file system.
+type memDriver struct {
+	fs *MemDriverFactory
+}
+
+type memFileInfo struct {
+	name string
+	file memFile
+}
+
+func (info memFileInfo) Name() string       { return info.name }
+func (info memFileInfo) Size() int64        { return int64(len(info.file.data)) }
+func (info memFileInfo) ModTime() time.Time { return info.file.modTime }
+func (info memFileInfo) IsDir() bool        { return info.file.isDir }
+func (info memFileInfo) Sys() interface{}   { return nil }
+func (info memFileInfo) Owner() string      { return "ftp" }
+func (info memFileInfo) Group() string      { return "ftp" }
+
+func (info memFileInfo) Mode() os.FileMode {
+	if info.file.isDir {
+		return os.ModeDir | info.file.mode
+	}
+	return info.file.mode
+}
+
+func (driver *memDriver) Init(*Conn) {}
+
+func (driver *memDriver) Stat(p string) (FileInfo, error) {
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	f := driver.fs.lookup(p)
+	if f == nil {
+		return nil, os.ErrNotExist
+	}
+	return memFileInfo{name: path.Base(p), file: *f}, nil
+}
+
+func (driver *memDriver) ChangeDir(p string) error {
+	info, err := driver.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errMemNotDir
+	}
+	return nil
+}
+
+func (driver *memDriver) ListDir(p string, callback func(FileInfo) error) error {
+	driver.fs.lock.Lock()
+	f := driver.fs.lookup(p)
+	if f == nil || !f.isDir {
+		driver.fs.lock.Unlock()
+		if f == nil {
+			return os.ErrNotExist
+		}
+		return errMemNotDir
+	}
+	var infos []FileInfo
+	for name, f := range driver.fs.files {
+		if path.Dir(name) == p {
+			infos = append(infos, memFileInfo{name: path.Base(name), file: *f})
+		}
+	}
+	driver.fs.lock.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	for _, info := range infos {
+		if err := callback(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (driver *memDriver) DeleteDir(p string) error {
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	f := driver.fs.lookup(p)
+	if f == nil || p == "/" {
+		return os.ErrNotExist
+	}
+	if !f.isDir {
+		return errMemNotDir
+	}
+	for name := range driver.fs.files {
+		if path.Dir(name) == p {
+			return errMemNotEmpty
+		}
+	}
+	delete(driver.fs.files, p)
+	return nil
+}
+
+func (driver *memDriver) DeleteFile(p string) error {
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	f := driver.fs.lookup(p)
+	if f == nil {
+		return os.ErrNotExist
+	}
+	if f.isDir {
+		return errMemIsDir
+	}
+	delete(driver.fs.files, p)
+	return nil
+}
+
+func (driver *memDriver) Rename(from, to string) error {
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	f := driver.fs.lookup(from)
+	if f == nil || from == "/" {
+		return os.ErrNotExist
+	}
+	if err := driver.fs.lookupDir(to); err != nil {
+		return err
+	}
+	if target := driver.fs.lookup(to); target != nil && (target.isDir || f.isDir) {
+		return os.ErrExist
+	}
+	if f.isDir && strings.HasPrefix(to, from+"/") {
+		return errors.New("ftp: cannot move a directory into itself")
+	}
+	delete(driver.fs.files, from)
+	driver.fs.files[to] = f
+	if f.isDir {
+		for name, child := range driver.fs.files {
+			if strings.HasPrefix(name, from+"/") {
+				delete(driver.fs.files, name)
+				driver.fs.files[to+strings.TrimPrefix(name, from)] = child
+			}
+		}
+	}
+	return nil
+}
+
+func (driver *memDriver) MakeDir(p string) error {
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	if driver.fs.lookup(p) != nil {
+		return os.ErrExist
+	}
+	if err := driver.fs.lookupDir(p); err != nil {
+		return err
+	}
+	driver.fs.files[p] = &memFile{isDir: true, mode: 0755, modTime: time.Now()}
+	return nil
+}
+
+func (driver *memDriver) GetFile(p string, offset int64) (int64, io.ReadCloser, error) {
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	f := driver.fs.lookup(p)
+	if f == nil {
+		return 0, nil, os.ErrNotExist
+	}
+	if f.isDir {
+		return 0, nil, errMemIsDir
+	}
+	if offset < 0 || offset > int64(len(f.data)) {
+		return 0, nil, errors.New("ftp: offset beyond end of file")
+	}
+	// the data of files is replaced rather than changed, so it can be read
+	// without the lock
+	data := f.data[offset:]
+	return int64(len(data)), ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (driver *memDriver) PutFile(p string, data io.Reader, appendData bool) (int64, error) {
+	return driver.put(p, data, func(old []byte) int64 {
+		if appendData {
+			return int64(len(old))
+		}
+		return -1
+	})
+}
+
+func (driver *memDriver) PutFileAt(p string, data io.Reader, offset int64) (int64, error) {
+	return driver.put(p, data, func([]byte) int64 { return offset })
+}
+
+// put stores data at p, after the first offset(old) bytes of the current
+// content old, or replacing it for a negative offset.
+func (driver *memDriver) put(p string, data io.Reader, offset func(old []byte) int64) (int64, error) {
+	if err := driver.checkPut(p); err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, data)
+	if err != nil {
+		return n, err
+	}
+
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	if err := driver.fs.lookupDir(p); err != nil {
+		return 0, err
+	}
+	f := driver.fs.lookup(p)
+	if f == nil {
+		f = &memFile{mode: 0644}
+	} else if f.isDir {
+		return 0, errMemIsDir
+	}
+	content := buf.Bytes()
+	if start := offset(f.data); start >= 0 {
+		if start > int64(len(f.data)) {
+			return 0, errors.New("ftp: offset beyond end of file")
+		}
+		content = append(append([]byte{}, f.data[:start]...), content...)
+		if end := start + n; end < int64(len(f.data)) {
+			content = append(content, f.data[end:]...)
+		}
+	}
+	driver.fs.files[p] = &memFile{data: content, mode: f.mode, modTime: time.Now()}
+	return n, nil
+}
+
+// checkPut returns the error storing a file at p would fail with, if any,
+// so it can be returned before the data is read.
+func (driver *memDriver) checkPut(p string) error {
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	if err := driver.fs.lookupDir(p); err != nil {
+		return err
+	}
+	if f := driver.fs.lookup(p); f != nil && f.isDir {
+		return errMemIsDir
+	}
+	return nil
+}
+
+func (driver *memDriver) Chtimes(p string, mtime time.Time) error {
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	f := driver.fs.lookup(p)
+	if f == nil || p == "/" {
+		return os.ErrNotExist
+	}
+	f.modTime = mtime
+	return nil
+}
+
+func (driver *memDriver) Chmod(p string, mode os.FileMode) error {
+	driver.fs.lock.Lock()
+	defer driver.fs.lock.Unlock()
+	f := driver.fs.lookup(p)
+	if f == nil || p == "/" {
+		return os.ErrNotExist
+	}
+	f.mode = mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	return nil
+}
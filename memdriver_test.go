@@ -0,0 +1,89 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemDriverSession(t *testing.T) {
+	fs := &MemDriverFactory{}
+	if err := fs.WriteFile("/pub/readme.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestServer(t, &ServerOpts{Factory: fs})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	if got := download(t, c, "RETR /pub/readme.txt"); got != "hello" {
+		t.Errorf("RETR: got %q, want %q", got, "hello")
+	}
+	expect(t, c, 350, "REST 1")
+	if got := download(t, c, "RETR /pub/readme.txt"); got != "ello" {
+		t.Errorf("RETR after REST 1: got %q, want %q", got, "ello")
+	}
+
+	expect(t, c, 257, "MKD /incoming")
+	expect(t, c, 550, "MKD /missing/dir")
+	expect(t, c, 250, "CWD /incoming")
+	upload(t, c, "a.txt", "hello world")
+	data := openPassive(t, c)
+	expect(t, c, 150, "APPE a.txt")
+	data.Write([]byte("!"))
+	data.Close()
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 350, "REST 6")
+	upload(t, c, "a.txt", "there")
+	if got, _ := fs.ReadFile("/incoming/a.txt"); string(got) != "hello there!" {
+		t.Errorf("after STOR, APPE and REST: got %q, want %q", got, "hello there!")
+	}
+	if msg := expect(t, c, 213, "SIZE a.txt"); msg != "12" {
+		t.Errorf("SIZE: got %q, want 12", msg)
+	}
+	upload(t, c, "b.txt", "b")
+	expect(t, c, 257, "MKD sub")
+
+	want := "a.txt\r\nb.txt\r\nsub\r\n"
+	if got := download(t, c, "NLST"); got != want {
+		t.Errorf("NLST: got %q, want %q", got, want)
+	}
+	list := download(t, c, "LIST")
+	if lines := strings.Split(strings.TrimSuffix(list, "\r\n"), "\r\n"); len(lines) != 3 || !strings.HasPrefix(lines[2], "d") {
+		t.Errorf("LIST: got %q", list)
+	}
+
+	expect(t, c, 213, "MFMT 20180102030405 b.txt")
+	if msg := expect(t, c, 213, "MDTM b.txt"); msg != "20180102030405" {
+		t.Errorf("MDTM: got %q", msg)
+	}
+	expect(t, c, 200, "SITE CHMOD 600 b.txt")
+
+	// Directories are renamed with their content.
+	expect(t, c, 250, "CWD /")
+	expect(t, c, 350, "RNFR /incoming")
+	expect(t, c, 250, "RNTO /done")
+	if got := download(t, c, "NLST /done"); got != want {
+		t.Errorf("NLST after RNTO: got %q, want %q", got, want)
+	}
+	expect(t, c, 550, "CWD /incoming")
+
+	expect(t, c, 550, "RMD /done")
+	expect(t, c, 250, "DELE /done/a.txt")
+	expect(t, c, 250, "DELE /done/b.txt")
+	expect(t, c, 550, "DELE /done/sub")
+	expect(t, c, 250, "RMD /done/sub")
+	expect(t, c, 250, "RMD /done")
+	expect(t, c, 550, "SIZE /done/a.txt")
+
+	// Sessions share the file system.
+	other := dialTestServer(t, s)
+	login(t, other)
+	if got := download(t, other, "NLST /"); got != "pub\r\n" {
+		t.Errorf("NLST of another session: got %q, want %q", got, "pub\r\n")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Metrics receives events about connections and transfers, e.g. to update
+// Prometheus counters. Its methods may be called concurrently and must not
+// block.
+type Metrics interface {
+	// ConnOpened is called for every accepted control connection.
+	ConnOpened()
+	// DataConnOpened and DataConnClosed are called when a data connection
+	// is dialed for PORT or EPRT, or accepted for PASV or EPSV, and when it
+	// is closed.
+	DataConnOpened()
+	DataConnClosed()
+	// BytesIn and BytesOut are called as data is received and sent on data
+	// connections.
+	BytesIn(n int64)
+	BytesOut(n int64)
+	// TransferError is called when reading from or writing to a data
+	// connection failed.
+	TransferError()
+	// PassiveListenerOpened and PassiveListenerClosed are called when a
+	// passive data port starts and stops listening.
+	PassiveListenerOpened()
+	PassiveListenerClosed()
+}
+
+// PassivePortMetrics is an optional interface Metrics can implement to
+// watch how much of the PassivePorts range is used, e.g. to alert before it
+// runs out.
+type PassivePortMetrics interface {
+	// PassivePortsInUse is called with the number of passive ports
+	// listening whenever it changes.
+	PassivePortsInUse(n int)
+	// PassivePortsExhausted is called when no port of the range was free
+	// for a passive data connection.
+	PassivePortsExhausted()
+}
+
+// passivePortGauge counts the passive listeners of a server for Metrics
+// implementing PassivePortMetrics.
+type passivePortGauge struct {
+	Metrics
+	ports PassivePortMetrics
+	lock  sync.Mutex // keeps the reported numbers in order
+	inUse int
+}
+
+func (g *passivePortGauge) PassiveListenerOpened() {
+	g.Metrics.PassiveListenerOpened()
+	g.add(1)
+}
+
+func (g *passivePortGauge) PassiveListenerClosed() {
+	g.Metrics.PassiveListenerClosed()
+	g.add(-1)
+}
+
+func (g *passivePortGauge) add(n int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.inUse += n
+	g.ports.PassivePortsInUse(g.inUse)
+}
+
+func (g *passivePortGauge) PassivePortsInUse(n int) {
+	g.ports.PassivePortsInUse(n)
+}
+
+func (g *passivePortGauge) PassivePortsExhausted() {
+	g.ports.PassivePortsExhausted()
+}
+
+// nopMetrics is used when no Metrics are configured.
+type nopMetrics struct{}
+
+func (nopMetrics) ConnOpened()            {}
+func (nopMetrics) DataConnOpened()        {}
+func (nopMetrics) DataConnClosed()        {}
+func (nopMetrics) BytesIn(n int64)        {}
+func (nopMetrics) BytesOut(n int64)       {}
+func (nopMetrics) TransferError()         {}
+func (nopMetrics) PassiveListenerOpened() {}
+func (nopMetrics) PassiveListenerClosed() {}
+
+// metricsSocket reports the traffic of a data socket.
+type metricsSocket struct {
+	DataSocket
+	metrics Metrics
+	errOnce sync.Once
+}
+
+func newMetricsSocket(socket DataSocket, metrics Metrics) *metricsSocket {
+	return &metricsSocket{DataSocket: socket, metrics: metrics}
+}
+
+func (socket *metricsSocket) Read(p []byte) (n int, err error) {
+	n, err = socket.DataSocket.Read(p)
+	if n > 0 {
+		socket.metrics.BytesIn(int64(n))
+	}
+	if err != nil && err != io.EOF {
+		socket.errOnce.Do(socket.metrics.TransferError)
+	}
+	return n, err
+}
+
+func (socket *metricsSocket) Write(p []byte) (n int, err error) {
+	n, err = socket.DataSocket.Write(p)
+	if n > 0 {
+		socket.metrics.BytesOut(int64(n))
+	}
+	if err != nil {
+		socket.errOnce.Do(socket.metrics.TransferError)
+	}
+	return n, err
+}
+
+// metricsListener reports when a passive listener is closed.
+type metricsListener struct {
+	net.Listener
+	metrics Metrics
+	once    sync.Once
+}
+
+func newMetricsListener(l net.Listener, metrics Metrics) *metricsListener {
+	metrics.PassiveListenerOpened()
+	return &metricsListener{Listener: l, metrics: metrics}
+}
+
+func (l *metricsListener) Close() error {
+	l.once.Do(l.metrics.PassiveListenerClosed)
+	return l.Listener.Close()
+}
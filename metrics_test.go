@@ -0,0 +1,142 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testMetrics counts the events it receives.
+type testMetrics struct {
+	conns, dataOpened, dataClosed, bytesIn, bytesOut, errors, listenersOpened, listenersClosed int64
+}
+
+func (m *testMetrics) ConnOpened()            { atomic.AddInt64(&m.conns, 1) }
+func (m *testMetrics) DataConnOpened()        { atomic.AddInt64(&m.dataOpened, 1) }
+func (m *testMetrics) DataConnClosed()        { atomic.AddInt64(&m.dataClosed, 1) }
+func (m *testMetrics) BytesIn(n int64)        { atomic.AddInt64(&m.bytesIn, n) }
+func (m *testMetrics) BytesOut(n int64)       { atomic.AddInt64(&m.bytesOut, n) }
+func (m *testMetrics) TransferError()         { atomic.AddInt64(&m.errors, 1) }
+func (m *testMetrics) PassiveListenerOpened() { atomic.AddInt64(&m.listenersOpened, 1) }
+func (m *testMetrics) PassiveListenerClosed() { atomic.AddInt64(&m.listenersClosed, 1) }
+
+func (m *testMetrics) assert(t *testing.T, name string, counter *int64, want int64) {
+	t.Helper()
+	if got := atomic.LoadInt64(counter); got != want {
+		t.Errorf("got %d %s, want %d", got, name, want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := new(testMetrics)
+	s, _ := newTestServer(t, &ServerOpts{Metrics: metrics})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	upload(t, c, "/metrics.txt", "0123456789")
+	download(t, c, "RETR /metrics.txt")
+	// passive listeners the client never connects to open no data connection
+	expect(t, c, 229, "EPSV")
+	expect(t, c, 229, "EPSV")
+	expect(t, c, 200, "NOOP")
+
+	metrics.assert(t, "connections", &metrics.conns, 1)
+	metrics.assert(t, "opened data connections", &metrics.dataOpened, 2)
+	metrics.assert(t, "closed data connections", &metrics.dataClosed, 2)
+	metrics.assert(t, "bytes in", &metrics.bytesIn, 10)
+	metrics.assert(t, "bytes out", &metrics.bytesOut, 10)
+	metrics.assert(t, "transfer errors", &metrics.errors, 0)
+	metrics.assert(t, "opened passive listeners", &metrics.listenersOpened, 4)
+	metrics.assert(t, "closed passive listeners", &metrics.listenersClosed, 3)
+}
+
+func TestMetricsTransferError(t *testing.T) {
+	metrics := new(testMetrics)
+	passive, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{}, 50*time.Millisecond, 0, 0, 0, 0, new(DiscardLogger), "test", nil, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := newMetricsSocket(passive, metrics)
+
+	// Nobody connects, so the transfer fails once the accept timed out.
+	if _, err := socket.Read(make([]byte, 1)); !errors.Is(err, ErrAcceptTimeout) {
+		t.Fatalf("got error %v, want %v", err, ErrAcceptTimeout)
+	}
+	socket.Close()
+	socket.Close()
+
+	metrics.assert(t, "transfer errors", &metrics.errors, 1)
+	metrics.assert(t, "opened data connections", &metrics.dataOpened, 0)
+	metrics.assert(t, "closed data connections", &metrics.dataClosed, 0)
+	metrics.assert(t, "closed passive listeners", &metrics.listenersClosed, 1)
+}
+
+// portMetrics are testMetrics recording the use of passive ports.
+type portMetrics struct {
+	testMetrics
+	inUse, maxInUse, exhausted int64
+}
+
+func (m *portMetrics) PassivePortsInUse(n int) {
+	atomic.StoreInt64(&m.inUse, int64(n))
+	if int64(n) > atomic.LoadInt64(&m.maxInUse) {
+		atomic.StoreInt64(&m.maxInUse, int64(n))
+	}
+}
+
+func (m *portMetrics) PassivePortsExhausted() { atomic.AddInt64(&m.exhausted, 1) }
+
+func TestMetricsPassivePorts(t *testing.T) {
+	// Find a free port to use as a range of one.
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	metrics := new(portMetrics)
+	logger := new(printLogger)
+	s, driver := newTestServer(t, &ServerOpts{PassivePorts: fmt.Sprintf("%d-%d", port, port), Metrics: metrics, Logger: logger})
+	driver.files["/a.txt"] = []byte("hello")
+	c1 := dialTestServer(t, s)
+	login(t, c1)
+	c2 := dialTestServer(t, s)
+	login(t, c2)
+
+	// The first session holds the only port, so there is none for the second.
+	expect(t, c1, 229, "EPSV")
+	metrics.assert(t, "passive ports in use", &metrics.inUse, 1)
+	expect(t, c2, 425, "EPSV")
+	expect(t, c2, 425, "PASV")
+	metrics.assert(t, "passive port exhaustions", &metrics.exhausted, 2)
+	logger.lock.Lock()
+	logged := strings.Count(strings.Join(logger.lines, "\n"), "no free passive port")
+	logger.lock.Unlock()
+	if logged != 2 {
+		t.Errorf("logged %d exhaustions, want 2 for EPSV and PASV", logged)
+	}
+
+	data, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	expect(t, c1, 150, "RETR /a.txt")
+	if _, _, err := c1.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	metrics.assert(t, "passive ports in use", &metrics.inUse, 0)
+	metrics.assert(t, "most passive ports in use", &metrics.maxInUse, 1)
+	metrics.assert(t, "opened passive listeners", &metrics.listenersOpened, 1)
+}
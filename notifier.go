@@ -0,0 +1,32 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+// Notifier is called around file transfers, e.g. to scan uploads or send
+// notifications. Paths are the ones passed to the Driver. Its methods may be
+// called concurrently by different connections.
+type Notifier interface {
+	// BeforeUpload is called before an upload by STOR, APPE or STOU
+	// starts. Returning an error refuses it with 550.
+	BeforeUpload(conn *Conn, path string) error
+	// AfterUpload is called once an upload allowed by BeforeUpload is done,
+	// with the number of bytes stored and the error it failed with, if any.
+	AfterUpload(conn *Conn, path string, size int64, err error)
+	// BeforeDownload is called before a download by RETR starts. Returning
+	// an error refuses it with 550.
+	BeforeDownload(conn *Conn, path string) error
+	// AfterDownload is called once a download allowed by BeforeDownload is
+	// done, with the number of bytes sent and the error it failed with, if
+	// any.
+	AfterDownload(conn *Conn, path string, size int64, err error)
+}
+
+// nopNotifier is used when no Notifier is configured.
+type nopNotifier struct{}
+
+func (nopNotifier) BeforeUpload(conn *Conn, path string) error                   { return nil }
+func (nopNotifier) AfterUpload(conn *Conn, path string, size int64, err error)   {}
+func (nopNotifier) BeforeDownload(conn *Conn, path string) error                 { return nil }
+func (nopNotifier) AfterDownload(conn *Conn, path string, size int64, err error) {}
@@ -0,0 +1,124 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testNotifier records the calls it gets and refuses transfers of paths
+// containing "refused".
+type testNotifier struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (n *testNotifier) record(format string, args ...interface{}) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.events = append(n.events, fmt.Sprintf(format, args...))
+}
+
+func (n *testNotifier) take() []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	events := n.events
+	n.events = nil
+	return events
+}
+
+func (n *testNotifier) BeforeUpload(conn *Conn, path string) error {
+	n.record("BeforeUpload %s %s", conn.LoginUser(), path)
+	if strings.Contains(path, "refused") {
+		return errors.New("infected")
+	}
+	return nil
+}
+
+func (n *testNotifier) AfterUpload(conn *Conn, path string, size int64, err error) {
+	n.record("AfterUpload %s %d %v", path, size, err != nil)
+}
+
+func (n *testNotifier) BeforeDownload(conn *Conn, path string) error {
+	n.record("BeforeDownload %s %s", conn.LoginUser(), path)
+	if strings.Contains(path, "refused") {
+		return errors.New("restricted")
+	}
+	return nil
+}
+
+func (n *testNotifier) AfterDownload(conn *Conn, path string, size int64, err error) {
+	n.record("AfterDownload %s %d %v", path, size, err != nil)
+}
+
+func TestNotifier(t *testing.T) {
+	notifier := new(testNotifier)
+	s, driver := newTestServer(t, &ServerOpts{Notifier: notifier})
+	driver.files["/refused.txt"] = []byte("secret")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	check := func(what string, want ...string) {
+		t.Helper()
+		if got := notifier.take(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got events %q, want %q", what, got, want)
+		}
+	}
+
+	// Without a data connection, nothing happens.
+	expect(t, c, 425, "STOR /a.txt")
+	expect(t, c, 425, "RETR /refused.txt")
+	check("no data connection")
+
+	upload(t, c, "/a.txt", "hello")
+	check("STOR", "BeforeUpload admin /a.txt", "AfterUpload /a.txt 5 false")
+
+	data := openPassive(t, c)
+	expect(t, c, 150, "APPE /a.txt")
+	data.Write([]byte(" world"))
+	data.Close()
+	c.ReadResponse(226)
+	check("APPE", "BeforeUpload admin /a.txt", "AfterUpload /a.txt 6 false")
+
+	if got := download(t, c, "RETR /a.txt"); got != "hello world" {
+		t.Errorf("got %q", got)
+	}
+	check("RETR", "BeforeDownload admin /a.txt", "AfterDownload /a.txt 11 false")
+
+	// Refused transfers don't start.
+	data = openPassive(t, c)
+	if msg := expect(t, c, 550, "STOR /refused-upload.txt"); msg != "Upload refused: infected" {
+		t.Errorf("got %q", msg)
+	}
+	data.Close()
+	if _, ok := driver.files["/refused-upload.txt"]; ok {
+		t.Error("refused upload was stored")
+	}
+	check("refused STOR", "BeforeUpload admin /refused-upload.txt")
+
+	data = openPassive(t, c)
+	if msg := expect(t, c, 550, "RETR /refused.txt"); msg != "Download refused: restricted" {
+		t.Errorf("got %q", msg)
+	}
+	data.Close()
+	check("refused RETR", "BeforeDownload admin /refused.txt")
+
+	// Failures are reported after the fact.
+	data = openPassive(t, c)
+	expect(t, c, 150, "STOR /missing/b.txt")
+	data.Close()
+	c.ReadResponse(550)
+	check("failed STOR", "BeforeUpload admin /missing/b.txt", "AfterUpload /missing/b.txt 0 true")
+
+	data = openPassive(t, c)
+	expect(t, c, 550, "RETR /missing.txt")
+	data.Close()
+	check("failed RETR", "BeforeDownload admin /missing.txt", "AfterDownload /missing.txt 0 true")
+}
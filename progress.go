@@ -0,0 +1,49 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	defaultProgressBytes    = 1024 * 1024
+	defaultProgressInterval = time.Second
+)
+
+// progressReader calls the ProgressCallback of the server as the file it
+// reads is transferred.
+type progressReader struct {
+	r        io.Reader
+	conn     *Conn
+	path     string
+	bytes    int64
+	reported int64
+	last     time.Time
+}
+
+// newProgressReader returns r reporting the progress of the transfer of
+// path, or r itself if there is no ProgressCallback.
+func (conn *Conn) newProgressReader(path string, r io.Reader) io.Reader {
+	if conn.server.ProgressCallback == nil {
+		return r
+	}
+	return &progressReader{r: r, conn: conn, path: path, last: time.Now()}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	r.bytes += int64(n)
+	server := r.conn.server
+	if now := time.Now(); r.bytes-r.reported >= server.ProgressBytes || now.Sub(r.last) >= server.ProgressInterval {
+		r.reported, r.last = r.bytes, now
+		server.ProgressCallback(r.conn.sessionID, r.path, r.bytes)
+	}
+	return n, err
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProgressCallback(t *testing.T) {
+	var lock sync.Mutex
+	var counts []int64
+	s, _ := newTestServer(t, &ServerOpts{
+		ProgressCallback: func(sessionID, path string, bytes int64) {
+			lock.Lock()
+			defer lock.Unlock()
+			if path != "/big.bin" {
+				t.Errorf("got progress of %s", path)
+			}
+			counts = append(counts, bytes)
+		},
+		ProgressBytes:    64 * 1024,
+		ProgressInterval: time.Hour,
+	})
+	c := dialTestServer(t, s)
+	login(t, c)
+	expect(t, c, 200, "TYPE I")
+
+	check := func(op string) {
+		t.Helper()
+		lock.Lock()
+		defer lock.Unlock()
+		if len(counts) < 2 {
+			t.Fatalf("%s: got %d progress callbacks, want several", op, len(counts))
+		}
+		for i := 1; i < len(counts); i++ {
+			if counts[i] <= counts[i-1] {
+				t.Fatalf("%s: progress went from %d to %d", op, counts[i-1], counts[i])
+			}
+		}
+		if last := counts[len(counts)-1]; last > 1024*1024 {
+			t.Errorf("%s: got progress of %d bytes for a 1 MiB file", op, last)
+		}
+		counts = nil
+	}
+
+	content := strings.Repeat("x", 1024*1024)
+	upload(t, c, "/big.bin", content)
+	check("upload")
+	if got := download(t, c, "RETR /big.bin"); got != content {
+		t.Fatalf("downloaded %d bytes, want %d", len(got), len(content))
+	}
+	check("download")
+}
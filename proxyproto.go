@@ -0,0 +1,152 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout is how long a connection may take to send its PROXY
+// protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// maxProxyV1Length is the longest v1 header allowed by the specification,
+// including the CRLF.
+const maxProxyV1Length = 107
+
+var errProxyHeader = errors.New("ftp: invalid PROXY protocol header")
+
+// proxyV2Signature starts every v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection whose client address was read from a PROXY
+// protocol header.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (conn *proxyConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+// RemoteAddr returns the client address given by the proxy.
+func (conn *proxyConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header conn starts
+// with, and returns conn with the client address of the header. Headers
+// without an address, like health checks of the proxy, leave it unchanged.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	// the shortest v1 header is longer than the v2 signature
+	start, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr
+	if bytes.Equal(start, proxyV2Signature) {
+		remote, err = readProxyV2(reader)
+	} else if bytes.HasPrefix(start, []byte("PROXY ")) {
+		remote, err = readProxyV1(reader)
+	} else {
+		err = errProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+// readProxyV1 parses a header like "PROXY TCP4 192.0.2.1 192.0.2.2 1234 21".
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxProxyV1Length {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses a binary header.
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	if versionCommand>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	switch versionCommand & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errProxyHeader
+	}
+
+	var ipLength int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLength = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLength = net.IPv6len
+	default:
+		return nil, nil
+	}
+	// source and destination addresses, then ports, then optional TLVs
+	if len(body) < 2*ipLength+4 {
+		return nil, errProxyHeader
+	}
+	ip := make(net.IP, ipLength)
+	copy(ip, body)
+	port := binary.BigEndian.Uint16(body[2*ipLength:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a v2 header with the given command, address family
+// and address block.
+func proxyV2Header(command, family byte, addrs []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return string(append(header, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0x04, 0xd2, 0, 21}
+	v6 := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0x04, 0xd2, 0, 21)
+	var tests = []struct {
+		header string
+		remote string // empty for the address of the connection
+		err    bool
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 1234 21\r\n", "192.0.2.1:1234", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 1234 21\r\n", "[2001:db8::1]:1234", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", false},
+		{"PROXY TCP4 2001:db8::1 192.0.2.2 1234 21\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 70000 21\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 1234 21\n", "", true},
+		{"PROXY " + strings.Repeat("x", maxProxyV1Length) + "\r\n", "", true},
+		{"USER anonymous\r\n", "", true},
+		{proxyV2Header(1, 0x11, v4), "192.0.2.1:1234", false},
+		{proxyV2Header(1, 0x21, v6), "[2001:db8::1]:1234", false},
+		{proxyV2Header(1, 0x11, append(v4, 1, 0, 1, 'x')), "192.0.2.1:1234", false}, // with a TLV
+		{proxyV2Header(0, 0x00, nil), "", false},                                    // LOCAL
+		{proxyV2Header(1, 0x31, make([]byte, 216)), "", false},                      // unix socket
+		{proxyV2Header(1, 0x21, v4), "", true},
+		{proxyV2Header(2, 0x11, v4), "", true},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(test.header + "NOOP\r\n"))
+			client.Close()
+		}()
+		conn, err := readProxyHeader(server, time.Second)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.header)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.header, err)
+			server.Close()
+			continue
+		}
+		want := test.remote
+		if want == "" {
+			want = server.RemoteAddr().String()
+		}
+		if got := conn.RemoteAddr().String(); got != want {
+			t.Errorf("%q: got address %s, want %s", test.header, got, want)
+		}
+		// Data after the header is left for the FTP session.
+		if rest, _ := ioutil.ReadAll(conn); string(rest) != "NOOP\r\n" {
+			t.Errorf("%q: got %q after the header", test.header, rest)
+		}
+		conn.Close()
+	}
+}
+
+func TestReadProxyHeaderTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("PROXY TCP4"))
+	if _, err := readProxyHeader(server, 50*time.Millisecond); err == nil {
+		t.Error("expected an error for an incomplete header")
+	}
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	s, _ := newTestServer(t, &ServerOpts{ProxyProtocol: true, DeniedNetworks: []string{"203.0.113.7"}})
+	dial := func(header string) *textproto.Conn {
+		conn, err := net.Dial("tcp", s.listenTo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := textproto.NewConn(conn)
+		t.Cleanup(func() { c.Close() })
+		conn.Write([]byte(header))
+		return c
+	}
+
+	// The address of the header is subject to the IP filter.
+	c := dial("PROXY TCP4 203.0.113.7 127.0.0.1 4000 21\r\n")
+	if _, _, err := c.ReadResponse(421); err != nil {
+		t.Fatal(err)
+	}
+
+	c = dial("PROXY TCP4 198.51.100.1 127.0.0.1 4000 21\r\n")
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	login(t, c)
+	conns := s.ActiveConns()
+	if len(conns) != 1 || conns[0].RemoteAddr != "198.51.100.1:4000" {
+		t.Errorf("got connections %+v, want one from 198.51.100.1:4000", conns)
+	}
+
+	// Connections without a header are dropped.
+	c = dial("USER admin\r\n")
+	if _, err := c.R.ReadByte(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
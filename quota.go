@@ -0,0 +1,104 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrQuotaExceeded is returned when reading an upload that would take the
+// user over their quota.
+var ErrQuotaExceeded = errors.New("ftp: quota exceeded")
+
+// Quota tracks how much storage each user uses. It is consulted before and
+// during uploads; implementations must be safe for concurrent use.
+type Quota interface {
+	// GetUsage returns the number of bytes stored by the user.
+	GetUsage(user string) (int64, error)
+
+	// Limit returns the number of bytes the user may store, or 0 for no
+	// limit.
+	Limit(user string) int64
+
+	// Add records n more bytes stored by the user. n is negative when an
+	// overwrite made a file smaller.
+	Add(user string, n int64) error
+}
+
+// uploadQuota returns a reader limiting r to the remaining quota of the
+// logged in user, plus the freed bytes of a file the upload replaces, or nil
+// if there is no limit. It fails with ErrQuotaExceeded if no quota is left.
+func (conn *Conn) uploadQuota(r io.Reader, freed int64) (*quotaReader, error) {
+	quota := conn.server.Quota
+	if quota == nil {
+		return nil, nil
+	}
+	limit := quota.Limit(conn.user)
+	if limit <= 0 {
+		return nil, nil
+	}
+	usage, err := quota.GetUsage(conn.user)
+	if err != nil {
+		return nil, err
+	}
+	if usage-freed >= limit {
+		return nil, ErrQuotaExceeded
+	}
+	return &quotaReader{r: r, remaining: limit - usage + freed}, nil
+}
+
+// storedGrowth returns by how much storing n bytes changed the size of a
+// file of oldSize bytes: replacing it, appending to it or writing at offset.
+func storedGrowth(oldSize, offset, n int64, overwrite, appendData bool) int64 {
+	switch {
+	case overwrite:
+		return n - oldSize
+	case appendData:
+		return n
+	case offset+n > oldSize:
+		return offset + n - oldSize
+	}
+	return 0
+}
+
+// uploadGrowth returns by how much an upload changed the size of the file
+// at p from oldSize, as found by the driver, or expected if the driver
+// can't tell.
+func (conn *Conn) uploadGrowth(p string, oldSize, expected int64) int64 {
+	info, err := conn.driver.Stat(p)
+	switch {
+	case err == nil && !info.IsDir():
+		return info.Size() - oldSize
+	case errors.Is(err, os.ErrNotExist):
+		return -oldSize
+	}
+	return expected
+}
+
+// quotaReader fails with ErrQuotaExceeded once more than remaining bytes
+// are read.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	// read one byte more than allowed to tell whether the upload is larger
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.r.Read(p)
+	if int64(n) > r.remaining {
+		n = int(r.remaining)
+		r.remaining = 0
+		r.exceeded = true
+		return n, ErrQuotaExceeded
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
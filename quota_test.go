@@ -0,0 +1,185 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testQuota is an in-memory Quota with the same limit for all users.
+type testQuota struct {
+	lock  sync.Mutex
+	limit int64
+	usage map[string]int64
+}
+
+func (q *testQuota) GetUsage(user string) (int64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.usage[user], nil
+}
+
+func (q *testQuota) Limit(user string) int64 {
+	return q.limit
+}
+
+func (q *testQuota) Add(user string, n int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.usage[user] += n
+	return nil
+}
+
+func TestQuota(t *testing.T) {
+	quota := &testQuota{limit: 100, usage: map[string]int64{}}
+	s, driver := newTestServer(t, &ServerOpts{Quota: quota})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	// Under quota, the upload is counted.
+	upload(t, c, "/a.txt", strings.Repeat("a", 60))
+	if usage, _ := quota.GetUsage("admin"); usage != 60 {
+		t.Errorf("got usage %d, want 60", usage)
+	}
+
+	// Going over the limit mid-transfer aborts and rolls back the upload.
+	data := openPassive(t, c)
+	expect(t, c, 150, "STOR /b.txt")
+	data.Write([]byte(strings.Repeat("b", 41)))
+	data.Close()
+	if _, _, err := c.ReadResponse(552); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.Stat("/b.txt"); err == nil {
+		t.Error("expected the partial upload to be removed")
+	}
+	if usage, _ := quota.GetUsage("admin"); usage != 60 {
+		t.Errorf("got usage %d after the aborted upload, want 60", usage)
+	}
+
+	// Exactly filling the quota is allowed, after that uploads are refused.
+	upload(t, c, "/c.txt", strings.Repeat("c", 40))
+	if got := driver.testFile("/c.txt"); len(got) != 40 {
+		t.Errorf("got %d bytes, want 40", len(got))
+	}
+	data = openPassive(t, c)
+	defer data.Close()
+	expect(t, c, 552, "STOR /d.txt")
+}
+
+func TestQuotaOverwrite(t *testing.T) {
+	quota := &testQuota{limit: 100, usage: map[string]int64{}}
+	s, driver := newTestServer(t, &ServerOpts{Quota: quota})
+	c := dialTestServer(t, s)
+	login(t, c)
+	upload(t, c, "/a.txt", strings.Repeat("a", 60))
+
+	// Only the difference in size is counted, and the space of the
+	// replaced file is available.
+	upload(t, c, "/a.txt", strings.Repeat("b", 90))
+	if usage, _ := quota.GetUsage("admin"); usage != 90 {
+		t.Errorf("got usage %d, want 90", usage)
+	}
+	upload(t, c, "/a.txt", strings.Repeat("c", 50))
+	if usage, _ := quota.GetUsage("admin"); usage != 50 {
+		t.Errorf("got usage %d, want 50", usage)
+	}
+
+	// An overwrite going over the quota leaves the original file.
+	data := openPassive(t, c)
+	expect(t, c, 150, "STOR /a.txt")
+	data.Write([]byte(strings.Repeat("d", 101)))
+	data.Close()
+	if _, _, err := c.ReadResponse(552); err != nil {
+		t.Fatal(err)
+	}
+	if got := driver.testFile("/a.txt"); got != strings.Repeat("c", 50) {
+		t.Errorf("got %q after the aborted overwrite", got)
+	}
+	if usage, _ := quota.GetUsage("admin"); usage != 50 {
+		t.Errorf("got usage %d after the aborted overwrite, want 50", usage)
+	}
+}
+
+// streamingDriver is a testDriver storing uploads as it reads them, like a
+// file system driver, so failed uploads leave what was received.
+type streamingDriver struct {
+	*testDriver
+}
+
+func (driver streamingDriver) PutFile(p string, data io.Reader, appendData bool) (int64, error) {
+	driver.lock.Lock()
+	if !appendData {
+		driver.files[p] = nil
+	}
+	driver.lock.Unlock()
+	buf := make([]byte, 16)
+	var total int64
+	for {
+		n, err := data.Read(buf)
+		driver.lock.Lock()
+		driver.files[p] = append(driver.files[p], buf[:n]...)
+		driver.lock.Unlock()
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
+
+type streamingDriverFactory struct {
+	driver streamingDriver
+}
+
+func (factory streamingDriverFactory) NewDriver() (Driver, error) {
+	return factory.driver, nil
+}
+
+func TestQuotaStreamingOverwrite(t *testing.T) {
+	quota := &testQuota{limit: 100, usage: map[string]int64{}}
+	driver := streamingDriver{newTestDriverFactory().driver}
+	s, _ := newTestServer(t, &ServerOpts{Quota: quota, Factory: streamingDriverFactory{driver}})
+	c := dialTestServer(t, s)
+	login(t, c)
+	upload(t, c, "/a.txt", strings.Repeat("a", 50))
+
+	// The driver truncated the original file and kept what was allowed, so
+	// that is what is counted.
+	for i := 0; i < 3; i++ {
+		data := openPassive(t, c)
+		expect(t, c, 150, "STOR /a.txt")
+		data.Write([]byte(strings.Repeat("b", 150)))
+		data.Close()
+		if _, _, err := c.ReadResponse(552); err != nil {
+			t.Fatal(err)
+		}
+		size := int64(len(driver.testFile("/a.txt")))
+		if usage, _ := quota.GetUsage("admin"); usage != size || size > 100 {
+			t.Errorf("got usage %d with a file of %d bytes", usage, size)
+		}
+	}
+	upload(t, c, "/a.txt", strings.Repeat("c", 10))
+	if usage, _ := quota.GetUsage("admin"); usage != 10 {
+		t.Errorf("got usage %d, want 10", usage)
+	}
+}
+
+func TestQuotaAllo(t *testing.T) {
+	quota := &testQuota{limit: 100, usage: map[string]int64{"admin": 60}}
+	s, _ := newTestServer(t, &ServerOpts{Quota: quota})
+	c := dialTestServer(t, s)
+	login(t, c)
+	expect(t, c, 200, "ALLO 40")
+	expect(t, c, 552, "ALLO 41")
+
+	// Without a limit there is always room.
+	quota.limit = 0
+	expect(t, c, 200, "ALLO 1000")
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting throughput to a number of bytes per
+// second. The bucket holds at most a tenth of a second worth of tokens, so
+// transfers are throttled smoothly rather than in bursts.
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	burst := float64(bytesPerSec) / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// chunk returns the largest number of bytes that should be transferred by a
+// single call before waiting again.
+func (limiter *rateLimiter) chunk() int {
+	return int(limiter.burst)
+}
+
+// wait takes n tokens from the bucket, sleeping until they are available.
+// Concurrent callers queue up behind each other's debt, so the limiter is
+// fair and the combined rate never exceeds the limit.
+func (limiter *rateLimiter) wait(n int) {
+	limiter.lock.Lock()
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+	limiter.last = now
+	limiter.tokens -= float64(n)
+	var delay time.Duration
+	if limiter.tokens < 0 {
+		delay = time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	}
+	limiter.lock.Unlock()
+
+	time.Sleep(delay)
+}
+
+// rateLimiters is a chain of limiters that all have to grant a transfer, so
+// the effective rate is the lowest of them.
+type rateLimiters []*rateLimiter
+
+func (limiters rateLimiters) chunk() int {
+	size := 0
+	for _, limiter := range limiters {
+		if size == 0 || limiter.chunk() < size {
+			size = limiter.chunk()
+		}
+	}
+	return size
+}
+
+func (limiters rateLimiters) wait(n int) {
+	for _, limiter := range limiters {
+		limiter.wait(n)
+	}
+}
+
+// throttledSocket limits the throughput of a DataSocket. Reads and writes
+// are throttled independently by the per-connection limit, while a shared
+// limiter is drawn from by both directions of every connection.
+type throttledSocket struct {
+	DataSocket
+	reader rateLimiters
+	writer rateLimiters
+}
+
+// newThrottledSocket wraps socket so it transfers at most bytesPerSec in
+// each direction, if bytesPerSec is positive, and draws from shared, if
+// non-nil.
+func newThrottledSocket(socket DataSocket, bytesPerSec int64, shared *rateLimiter) DataSocket {
+	throttled := &throttledSocket{DataSocket: socket}
+	if bytesPerSec > 0 {
+		throttled.reader = append(throttled.reader, newRateLimiter(bytesPerSec))
+		throttled.writer = append(throttled.writer, newRateLimiter(bytesPerSec))
+	}
+	if shared != nil {
+		throttled.reader = append(throttled.reader, shared)
+		throttled.writer = append(throttled.writer, shared)
+	}
+	return throttled
+}
+
+func (socket *throttledSocket) Read(p []byte) (n int, err error) {
+	if len(p) > socket.reader.chunk() {
+		p = p[:socket.reader.chunk()]
+	}
+	n, err = socket.DataSocket.Read(p)
+	socket.reader.wait(n)
+	return n, err
+}
+
+func (socket *throttledSocket) Write(p []byte) (n int, err error) {
+	// an empty write still waits for the data connection, as for an empty
+	// listing
+	if len(p) == 0 {
+		return socket.DataSocket.Write(p)
+	}
+	for len(p) > 0 {
+		size := len(p)
+		if size > socket.writer.chunk() {
+			size = socket.writer.chunk()
+		}
+		socket.writer.wait(size)
+
+		var written int
+		written, err = socket.DataSocket.Write(p[:size])
+		n += written
+		if err != nil {
+			return n, err
+		}
+		p = p[size:]
+	}
+	return n, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bufferSocket is a DataSocket reading from and writing to memory.
+type bufferSocket struct {
+	bytes.Buffer
+}
+
+func (socket *bufferSocket) Host() string { return "" }
+func (socket *bufferSocket) Port() int    { return 0 }
+func (socket *bufferSocket) Close() error { return nil }
+
+func TestThrottledSocket(t *testing.T) {
+	const rate = 1 << 20
+	const size = rate / 4
+	payload := bytes.Repeat([]byte("x"), size)
+
+	socket := newThrottledSocket(new(bufferSocket), rate, nil)
+	start := time.Now()
+	n, err := socket.Write(payload)
+	if err != nil || n != size {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+	assertElapsed(t, "upload", time.Since(start), 250*time.Millisecond)
+
+	start = time.Now()
+	m, err := io.Copy(new(bytes.Buffer), socket)
+	if err != nil || m != size {
+		t.Fatalf("read %d bytes: %v", m, err)
+	}
+	assertElapsed(t, "download", time.Since(start), 250*time.Millisecond)
+}
+
+// assertElapsed checks that elapsed matches want, allowing for the initial
+// burst and scheduling jitter.
+func assertElapsed(t *testing.T, name string, elapsed, want time.Duration) {
+	t.Helper()
+	if elapsed < want*6/10 || elapsed > want*2 {
+		t.Errorf("%s took %v, want about %v", name, elapsed, want)
+	}
+}
+
+func TestThrottledSocketShared(t *testing.T) {
+	const rate = 1 << 20
+	const size = rate / 16
+	const transfers = 4
+	payload := bytes.Repeat([]byte("x"), size)
+
+	// The per-connection limit alone would finish each transfer in 1/16s.
+	shared := newRateLimiter(rate / 2)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < transfers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			socket := newThrottledSocket(new(bufferSocket), rate, shared)
+			if _, err := socket.Write(payload); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	assertElapsed(t, "parallel uploads", time.Since(start), 500*time.Millisecond)
+}
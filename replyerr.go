@@ -0,0 +1,25 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"os"
+)
+
+// fileErrorReply returns the reply to a file action that failed with err,
+// a driver error: 550 if the file is missing or may not be accessed, 552
+// if storage ran out, or else code and message.
+func fileErrorReply(err error, code int, message string) (int, string) {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return 550, "File not found"
+	case errors.Is(err, os.ErrPermission):
+		return 550, "Permission denied"
+	case err == ErrQuotaExceeded || isNoSpace(err):
+		return 552, "Insufficient storage space"
+	}
+	return code, message
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// failingDriver is a testDriver whose transfers of some paths fail.
+type failingDriver struct {
+	*testDriver
+	errs map[string]error
+}
+
+func (driver *failingDriver) GetFile(p string, offset int64) (int64, io.ReadCloser, error) {
+	if err := driver.errs[p]; err != nil {
+		return 0, nil, err
+	}
+	return driver.testDriver.GetFile(p, offset)
+}
+
+func (driver *failingDriver) PutFile(p string, data io.Reader, appendData bool) (int64, error) {
+	if err := driver.errs[p]; err != nil {
+		return 0, err
+	}
+	return driver.testDriver.PutFile(p, data, appendData)
+}
+
+type failingDriverFactory struct {
+	driver *failingDriver
+}
+
+func (factory failingDriverFactory) NewDriver() (Driver, error) {
+	return factory.driver, nil
+}
+
+func TestFileErrorReplies(t *testing.T) {
+	driver := &failingDriver{newTestDriverFactory().driver, map[string]error{
+		"/missing.txt": &os.PathError{Op: "open", Path: "/missing.txt", Err: syscall.ENOENT},
+		"/secret.txt":  fmt.Errorf("opening: %w", os.ErrPermission),
+		"/broken.txt":  errors.New("checksum mismatch"),
+		"/denied.txt":  os.ErrPermission,
+	}}
+	s, _ := newTestServer(t, &ServerOpts{Factory: failingDriverFactory{driver}})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	for _, tt := range []struct {
+		path string
+		code int
+	}{
+		{"/missing.txt", 550},
+		{"/secret.txt", 550},
+		{"/broken.txt", 551},
+	} {
+		data := openPassive(t, c)
+		expect(t, c, tt.code, "RETR %s", tt.path)
+		data.Close()
+	}
+
+	for _, tt := range []struct {
+		path string
+		code int
+	}{
+		{"/denied.txt", 550},
+		{"/broken.txt", 450},
+	} {
+		data := openPassive(t, c)
+		expect(t, c, 150, "STOR %s", tt.path)
+		data.Close()
+		if _, _, err := c.ReadResponse(tt.code); err != nil {
+			t.Errorf("STOR %s: %v", tt.path, err)
+		}
+	}
+}
+
+// hostPathDriver is a testDriver whose errors carry the path on the host,
+// like those of a file system.
+type hostPathDriver struct {
+	*testDriver
+}
+
+func hostPathErr(op, p string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: "/srv/ftp" + p, Err: err}
+}
+
+func (driver hostPathDriver) Stat(p string) (FileInfo, error) {
+	info, err := driver.testDriver.Stat(p)
+	return info, hostPathErr("stat", p, err)
+}
+
+func (driver hostPathDriver) ChangeDir(p string) error {
+	return hostPathErr("chdir", p, driver.testDriver.ChangeDir(p))
+}
+
+func (driver hostPathDriver) DeleteDir(p string) error {
+	return hostPathErr("rmdir", p, driver.testDriver.DeleteDir(p))
+}
+
+func (driver hostPathDriver) DeleteFile(p string) error {
+	return hostPathErr("remove", p, driver.testDriver.DeleteFile(p))
+}
+
+func (driver hostPathDriver) Rename(from, to string) error {
+	return hostPathErr("rename", to, driver.testDriver.Rename(from, to))
+}
+
+func (driver hostPathDriver) MakeDir(p string) error {
+	return hostPathErr("mkdir", p, driver.testDriver.MakeDir(p))
+}
+
+func (driver hostPathDriver) PutFile(p string, data io.Reader, appendData bool) (int64, error) {
+	if p == "/broken.txt" {
+		return 0, hostPathErr("write", p, errors.New("input/output error"))
+	}
+	n, err := driver.testDriver.PutFile(p, data, appendData)
+	return n, hostPathErr("open", p, err)
+}
+
+type hostPathDriverFactory struct {
+	driver hostPathDriver
+}
+
+func (factory hostPathDriverFactory) NewDriver() (Driver, error) {
+	return factory.driver, nil
+}
+
+func TestHostPathReplies(t *testing.T) {
+	factory := hostPathDriverFactory{hostPathDriver{newTestDriverFactory().driver}}
+	factory.driver.files["/a.txt"] = []byte("a")
+	s, _ := newTestServer(t, &ServerOpts{Factory: factory})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	noHostPath := func(cmd, msg string) {
+		t.Helper()
+		if strings.Contains(msg, "/srv/ftp") {
+			t.Errorf("%s: got %q, revealing the path on the host", cmd, msg)
+		}
+	}
+	for _, cmd := range []string{"LIST /missing", "NLST /missing", "MLSD /missing", "CWD /missing", "DELE /missing", "MKD /", "RMD /missing"} {
+		noHostPath(cmd, expect(t, c, 550, "%s", cmd))
+	}
+	expect(t, c, 350, "RNFR /a.txt")
+	noHostPath("RNTO", expect(t, c, 550, "RNTO /missing/b.txt"))
+
+	for _, tt := range []struct {
+		path string
+		code int
+	}{
+		{"/missing/a.txt", 550},
+		{"/broken.txt", 450},
+	} {
+		data := openPassive(t, c)
+		expect(t, c, 150, "STOR %s", tt.path)
+		data.Close()
+		_, msg, err := c.ReadResponse(tt.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		noHostPath("STOR "+tt.path, msg)
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isNoSpace reports whether err is from a full disk or exhausted disk quota.
+func isNoSpace(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && (errno == syscall.ENOSPC || errno == syscall.EDQUOT)
+}
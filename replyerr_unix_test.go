@@ -0,0 +1,33 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package server
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestNoSpaceReplies(t *testing.T) {
+	driver := &failingDriver{newTestDriverFactory().driver, map[string]error{
+		"/full.txt":  &os.PathError{Op: "write", Path: "/full.txt", Err: syscall.ENOSPC},
+		"/quota.txt": &os.PathError{Op: "write", Path: "/quota.txt", Err: syscall.EDQUOT},
+	}}
+	s, _ := newTestServer(t, &ServerOpts{Factory: failingDriverFactory{driver}})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	for _, p := range []string{"/full.txt", "/quota.txt"} {
+		data := openPassive(t, c)
+		expect(t, c, 150, "STOR %s", p)
+		data.Close()
+		if _, _, err := c.ReadResponse(552); err != nil {
+			t.Errorf("STOR %s: %v", p, err)
+		}
+	}
+}
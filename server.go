@@ -9,8 +9,12 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Version returns the library version
@@ -18,6 +22,29 @@ func Version() string {
 	return "0.3.0"
 }
 
+// DataConnMode restricts how data connections may be established.
+type DataConnMode int
+
+const (
+	// DataConnBoth allows passive and active data connections.
+	DataConnBoth DataConnMode = iota
+	// DataConnPassiveOnly refuses PORT and EPRT.
+	DataConnPassiveOnly
+	// DataConnActiveOnly refuses PASV and EPSV.
+	DataConnActiveOnly
+)
+
+// TransferType is the representation type files are transferred in, as set
+// with TYPE.
+type TransferType int
+
+const (
+	// TransferBinary transfers files unchanged, like TYPE I.
+	TransferBinary TransferType = iota
+	// TransferASCII translates line endings, like TYPE A.
+	TransferASCII
+)
+
 // ServerOpts contains parameters for server.NewServer()
 type ServerOpts struct {
 	// The factory that will be used to create a new FTPDriver instance for
@@ -33,16 +60,129 @@ type ServerOpts struct {
 	// "::", which means all hostnames on ipv4 and ipv6.
 	Hostname string
 
-	// Public IP of the server
+	// Public IP of the server. When set, it is advertised in PASV replies
+	// instead of the local address, which is needed when the server sits
+	// behind NAT. Passive listeners still bind locally.
 	PublicIp string
 
-	// Passive ports
+	// PublicIpFunc, if set, returns the IP advertised in PASV replies given
+	// the local and remote address of the control connection, for servers
+	// reachable through several front-end addresses. An empty result falls
+	// back to PublicIp.
+	PublicIpFunc func(local, remote net.Addr) string
+
+	// The local IP passive listeners bind to, e.g. to accept data
+	// connections on one interface only. The advertised address is still
+	// PublicIp or that of the control connection. Optional, defaults to all
+	// interfaces.
+	PassiveListenHost string
+
+	// If true, passive listeners bind to the local IP of the control
+	// connection instead of PassiveListenHost, for hosts with several
+	// addresses, e.g. anycast ones. PASV falls back to PassiveListenHost
+	// when that IP isn't IPv4.
+	PassiveBindToControlLocalIP bool
+
+	// If true, passive data connections are only accepted from the IP of
+	// the control connection. Connections from other hosts are dropped,
+	// which prevents them from hijacking transfers.
+	RequireDataConnSameHost bool
+
+	// Whether clients may open passive data connections, active ones or
+	// both. Optional, defaults to both.
+	DataConnMode DataConnMode
+
+	// The transfer type of sessions until the client sends TYPE, and after
+	// REIN. RFC 959 specifies ASCII, but most clients expect binary.
+	// Optional, defaults to binary.
+	DefaultTransferType TransferType
+
+	// Passive ports, an inclusive range such as "50000-50100". When set,
+	// passive listeners bind to the first free port in the range. Optional,
+	// defaults to any port chosen by the OS.
 	PassivePorts string
 
+	// How many more times binding a passive listener is tried after it
+	// failed, e.g. while the interface of the listen address is flapping,
+	// with a backoff doubling from 50 milliseconds. The client gets a 425
+	// once all attempts failed. Optional, defaults to no retries.
+	PassiveBindRetries int
+
+	// How long a passive listener waits for the client to connect before
+	// giving up. Optional, defaults to 60 seconds.
+	PassiveAcceptTimeout time.Duration
+
+	// If true, the 150 reply starting a transfer on a passive data
+	// connection is only sent once the client connected, for clients that
+	// expect the connection to be ready by then. Optional, defaults to
+	// replying right away.
+	DelayTransferReply bool
+
+	// How long to wait for an active data connection to the client to be
+	// established. Optional, defaults to 30 seconds.
+	ActiveDialTimeout time.Duration
+
+	// The dialer opening active data connections, e.g. through a SOCKS
+	// proxy or from a given source address. ActiveDialTimeout applies to
+	// it, while ActiveDataPort, DataDSCP and KeepAlivePeriod are up to the
+	// dialer. Optional, defaults to dialing directly.
+	ActiveDialer Dialer
+
+	// The local port active data connections originate from, usually 20
+	// (ftp-data) for strict clients and firewalls. Optional, defaults to any
+	// port chosen by the OS.
+	ActiveDataPort int
+
+	// How long a data connection may be idle before the transfer is aborted.
+	// Optional, defaults to no timeout.
+	DataConnTimeout time.Duration
+
+	// How long the control connection may be idle between commands before
+	// the session is closed with 421. Data transfers in progress keep it
+	// open. Optional, defaults to no timeout.
+	ControlIdleTimeout time.Duration
+
+	// Size in bytes of the buffer data is copied through between the driver
+	// and data connections, at least 4096. Larger buffers can help on links
+	// with a high bandwidth-delay product. Optional, defaults to 32 KiB.
+	DataBufferSize int
+
+	// ProgressCallback, if set, is called during uploads and downloads with
+	// the session ID, the path and the number of bytes of the file
+	// transferred so far. It runs in the transfer, so it should return
+	// quickly.
+	ProgressCallback func(sessionID, path string, bytes int64)
+
+	// Bytes transferred between calls to ProgressCallback. Optional,
+	// defaults to 1 MiB.
+	ProgressBytes int64
+
+	// Time after which ProgressCallback is called even if fewer than
+	// ProgressBytes bytes were transferred. Optional, defaults to a second.
+	ProgressInterval time.Duration
+
+	// ReplyHook, if set, is called with the session ID, code and message of
+	// every reply, and returns the code and message to send instead, e.g.
+	// with a translated message. Messages may have several lines, which are
+	// framed as a multi-line reply. The session ID is empty for connections
+	// rejected before their session starts.
+	ReplyHook func(sessionID string, code int, message string) (int, string)
+
 	// The port that the FTP should listen on. Optional, defaults to 3000. In
 	// a production environment you will probably want to change this to 21.
 	Port int
 
+	// Path of a Unix domain socket for ListenAndServe to listen on instead
+	// of Hostname and Port, e.g. behind a proxy on the same host. As its
+	// clients have no IP, PASV needs PublicIp or PublicIpFunc. Optional.
+	UnixSocket string
+
+	// Length of the queue of connections to ListenAndServe's listeners
+	// waiting to be accepted, raised to absorb bursts on busy servers. The
+	// system may cap it, like Linux at net.core.somaxconn. Optional,
+	// defaults to the system's maximum.
+	ListenBacklog int
+
 	// use tls, default is false
 	TLS bool
 
@@ -52,13 +192,146 @@ type ServerOpts struct {
 	// if tls used, key file is required
 	KeyFile string
 
+	// The TLS configuration of control and data connections, used instead
+	// of CertFile and KeyFile if set. SecureTLSConfig hardens it for
+	// deployments that must refuse old protocol versions and weak ciphers.
+	TLSConfig *tls.Config
+
 	// If ture TLS is used in RFC4217 mode
 	ExplicitFTPS bool
 
+	// If true, implicit FTPS connections, which are TLS from the first byte,
+	// are additionally accepted on ImplicitTLSPort. Data connections default
+	// to PROT P for these sessions. Requires TLS.
+	TLSImplicit bool
+
+	// The port implicit FTPS connections are accepted on. Optional, defaults
+	// to 990.
+	ImplicitTLSPort int
+
+	// If true, protected data connections must resume the TLS session of
+	// their own control connection, as some clients require to make sure
+	// the data connection comes from the same client.
+	StrictTLSResumption bool
+
+	// If true, clients may send CCC after logging in to continue the
+	// control connection in the clear, e.g. for firewalls inspecting it,
+	// while data connections stay protected. Optional, defaults to false,
+	// as commands and replies can then be read and forged.
+	AllowCCC bool
+
+	// The greeting sent to clients on connect, which may span several
+	// lines
 	WelcomeMessage string
 
+	// Maximum throughput of a single data connection in bytes per second,
+	// applied to uploads and downloads independently. Optional, defaults to
+	// unlimited.
+	RateLimit int64
+
+	// Maximum combined throughput of all data connections of the server in
+	// bytes per second. If RateLimit is also set, the lower of the two
+	// applies to each connection. Optional, defaults to unlimited.
+	GlobalRateLimit int64
+
+	// Maximum number of simultaneous control connections from one client IP.
+	// Further connections are rejected with 421. Optional, defaults to
+	// unlimited.
+	MaxConnsPerIP int
+
+	// Maximum number of simultaneous control connections of the server.
+	// Further connections are rejected with 421 before login. Optional,
+	// defaults to unlimited.
+	MaxConnections int
+
+	// The DSCP value, 0 to 63, data connections are marked with for QoS,
+	// e.g. 10 for AF11. It is ignored on platforms that don't support it,
+	// like Windows. Optional, defaults to 0, leaving traffic unmarked.
+	DataDSCP int
+
+	// Period between TCP keepalive probes on control and data connections,
+	// negative to disable keepalive. Optional, defaults to 15 seconds.
+	KeepAlivePeriod time.Duration
+
+	// If true, control connections must start with a PROXY protocol v1 or
+	// v2 header, as sent by load balancers like HAProxy, and the client
+	// address it gives is used for logging, IP limits and
+	// RequireDataConnSameHost. Only enable it if all connections come
+	// through the proxy, as clients could otherwise forge their address.
+	ProxyProtocol bool
+
+	// Networks allowed to connect, in CIDR notation or as single IPs.
+	// Optional, defaults to all.
+	AllowedNetworks []string
+
+	// Networks refused to connect, in CIDR notation or as single IPs, even
+	// if they are in AllowedNetworks. Connections from them are closed with
+	// 421.
+	DeniedNetworks []string
+
+	// Delay of the reply to a failed login, doubled for each further failure
+	// from the same IP within LoginFailureWindow, up to 30 seconds.
+	// Optional, defaults to no delay.
+	LoginDelay time.Duration
+
+	// Number of failed logins from one IP within LoginFailureWindow after
+	// which its logins are refused for LoginLockout. Optional, defaults to
+	// no lockout.
+	MaxLoginFailures int
+
+	// How long failed logins are remembered, defaults to 15 minutes
+	LoginFailureWindow time.Duration
+
+	// How long logins are refused after MaxLoginFailures, defaults to 15
+	// minutes
+	LoginLockout time.Duration
+
 	// A logger implementation, if nil the StdLogger is used
 	Logger Logger
+
+	// Returns the ID of each new session, which must be unique. Optional,
+	// defaults to 16 random bytes in hex.
+	SessionIDGenerator func() string
+
+	// Receives connection and transfer events, optional. It may implement
+	// PassivePortMetrics too.
+	Metrics Metrics
+
+	// Called around uploads and downloads, optional
+	Notifier Notifier
+
+	// Records logins, changes to files and clearing of the control
+	// connection with CCC, optional
+	Auditor Auditor
+
+	// Limits the storage used by each user's uploads, optional
+	Quota Quota
+
+	// The largest file in bytes a single upload may store. Larger uploads
+	// are aborted with 552, and new files removed. Optional, defaults to
+	// unlimited. UserAuth can set other limits per user.
+	MaxUploadSize int64
+
+	// The largest file in bytes a single download may send. Larger
+	// downloads are refused with 552. Optional, defaults to unlimited.
+	MaxDownloadSize int64
+
+	// If true, commands changing files or directories, like STOR and DELE,
+	// are refused.
+	ReadOnly bool
+
+	// Users allowed to run administrative SITE commands, like SITE WHO
+	// listing the connected sessions. Optional, defaults to none.
+	AdminUsers []string
+
+	// The reply code to commands the server doesn't know, 500 (syntax
+	// error) or 502 (not implemented). Optional, defaults to 500.
+	UnknownCommandCode int
+
+	// Commands refused with 502 as if not implemented, e.g. "SITE" or
+	// "PORT" and "EPRT" to only allow passive mode. They are not listed by
+	// FEAT either.
+	DisabledCommands []string
 }
 
 // Server is the root of your FTP application. You should instantiate one
@@ -67,18 +340,34 @@ type ServerOpts struct {
 // Always use the NewServer() method to create a new Server.
 type Server struct {
 	*ServerOpts
-	listenTo  string
-	logger    Logger
-	listener  net.Listener
-	tlsConfig *tls.Config
-	ctx       context.Context
-	cancel    context.CancelFunc
+	listenTo         string
+	logger           LeveledLogger
+	listener         net.Listener
+	implicitListener net.Listener
+	tlsConfig        *tls.Config
+	ctx              context.Context
+	cancel           context.CancelFunc
+	passivePorts     portRange
+	globalLimiter    *rateLimiter
+	dataSockets      socketRegistry
+	ipFilter         *ipFilter
+	conns            connCounter
+	connsPerIP       ipConnCounter
+	loginFailures    loginLimiter
+	uploads          pathReservations
+	sessions         sessionRegistry
+	disabledCommands map[string]bool
+	siteHandlers     siteHandlers
 }
 
 // ErrServerClosed is returned by ListenAndServe() or Serve() when a shutdown
 // was requested.
 var ErrServerClosed = errors.New("ftp: Server closed")
 
+// ErrShutdownTimeout is returned by GracefulShutdown() when data transfers
+// were still in progress after the timeout.
+var ErrShutdownTimeout = errors.New("ftp: shutdown timed out with transfers in progress")
+
 // serverOptsWithDefaults copies an ServerOpts struct into a new struct,
 // then adds any default values that are missing and returns the new data.
 func serverOptsWithDefaults(opts *ServerOpts) *ServerOpts {
@@ -96,6 +385,8 @@ func serverOptsWithDefaults(opts *ServerOpts) *ServerOpts {
 	} else {
 		newOpts.Port = opts.Port
 	}
+	newOpts.UnixSocket = opts.UnixSocket
+	newOpts.ListenBacklog = opts.ListenBacklog
 	newOpts.Factory = opts.Factory
 	if opts.Name == "" {
 		newOpts.Name = "Go FTP Server"
@@ -118,13 +409,118 @@ func serverOptsWithDefaults(opts *ServerOpts) *ServerOpts {
 		newOpts.Logger = opts.Logger
 	}
 
+	newOpts.SessionIDGenerator = newSessionID
+	if opts.SessionIDGenerator != nil {
+		newOpts.SessionIDGenerator = opts.SessionIDGenerator
+	}
+
 	newOpts.TLS = opts.TLS
 	newOpts.KeyFile = opts.KeyFile
 	newOpts.CertFile = opts.CertFile
+	newOpts.TLSConfig = opts.TLSConfig
 	newOpts.ExplicitFTPS = opts.ExplicitFTPS
+	newOpts.TLSImplicit = opts.TLSImplicit
+	newOpts.StrictTLSResumption = opts.StrictTLSResumption
+	newOpts.AllowCCC = opts.AllowCCC
+	if opts.ImplicitTLSPort == 0 {
+		newOpts.ImplicitTLSPort = 990
+	} else {
+		newOpts.ImplicitTLSPort = opts.ImplicitTLSPort
+	}
+
+	newOpts.RateLimit = opts.RateLimit
+	newOpts.Metrics = nopMetrics{}
+	if ports, ok := opts.Metrics.(PassivePortMetrics); ok {
+		newOpts.Metrics = &passivePortGauge{Metrics: opts.Metrics, ports: ports}
+	} else if opts.Metrics != nil {
+		newOpts.Metrics = opts.Metrics
+	}
+	newOpts.GlobalRateLimit = opts.GlobalRateLimit
+	newOpts.Notifier = nopNotifier{}
+	if opts.Notifier != nil {
+		newOpts.Notifier = opts.Notifier
+	}
+	newOpts.Auditor = nopAuditor{}
+	if opts.Auditor != nil {
+		newOpts.Auditor = opts.Auditor
+	}
+	newOpts.MaxConnsPerIP = opts.MaxConnsPerIP
+	newOpts.MaxConnections = opts.MaxConnections
+	if opts.KeepAlivePeriod == 0 {
+		newOpts.KeepAlivePeriod = defaultKeepAlivePeriod
+	} else {
+		newOpts.KeepAlivePeriod = opts.KeepAlivePeriod
+	}
+	newOpts.ProxyProtocol = opts.ProxyProtocol
+	newOpts.AllowedNetworks = opts.AllowedNetworks
+	newOpts.DeniedNetworks = opts.DeniedNetworks
+	newOpts.LoginDelay = opts.LoginDelay
+	newOpts.MaxLoginFailures = opts.MaxLoginFailures
+	if opts.LoginFailureWindow == 0 {
+		newOpts.LoginFailureWindow = defaultLoginFailureWindow
+	} else {
+		newOpts.LoginFailureWindow = opts.LoginFailureWindow
+	}
+	if opts.LoginLockout == 0 {
+		newOpts.LoginLockout = defaultLoginLockout
+	} else {
+		newOpts.LoginLockout = opts.LoginLockout
+	}
+	newOpts.Quota = opts.Quota
+	newOpts.MaxUploadSize = opts.MaxUploadSize
+	newOpts.MaxDownloadSize = opts.MaxDownloadSize
+	newOpts.ReadOnly = opts.ReadOnly
+	newOpts.AdminUsers = opts.AdminUsers
+	newOpts.DisabledCommands = opts.DisabledCommands
+	if opts.UnknownCommandCode == 0 {
+		newOpts.UnknownCommandCode = 500
+	} else {
+		newOpts.UnknownCommandCode = opts.UnknownCommandCode
+	}
 
 	newOpts.PublicIp = opts.PublicIp
+	newOpts.PublicIpFunc = opts.PublicIpFunc
+	newOpts.PassiveListenHost = opts.PassiveListenHost
+	newOpts.PassiveBindToControlLocalIP = opts.PassiveBindToControlLocalIP
+	newOpts.RequireDataConnSameHost = opts.RequireDataConnSameHost
 	newOpts.PassivePorts = opts.PassivePorts
+	newOpts.PassiveBindRetries = opts.PassiveBindRetries
+	newOpts.DataConnMode = opts.DataConnMode
+	newOpts.DefaultTransferType = opts.DefaultTransferType
+	newOpts.DataDSCP = opts.DataDSCP
+	newOpts.DataConnTimeout = opts.DataConnTimeout
+	newOpts.ControlIdleTimeout = opts.ControlIdleTimeout
+	if opts.DataBufferSize == 0 {
+		newOpts.DataBufferSize = defaultDataBufferSize
+	} else {
+		newOpts.DataBufferSize = opts.DataBufferSize
+	}
+	newOpts.ProgressCallback = opts.ProgressCallback
+	newOpts.ReplyHook = opts.ReplyHook
+	if opts.ProgressBytes == 0 {
+		newOpts.ProgressBytes = defaultProgressBytes
+	} else {
+		newOpts.ProgressBytes = opts.ProgressBytes
+	}
+	if opts.ProgressInterval == 0 {
+		newOpts.ProgressInterval = defaultProgressInterval
+	} else {
+		newOpts.ProgressInterval = opts.ProgressInterval
+	}
+	newOpts.ActiveDataPort = opts.ActiveDataPort
+	newOpts.ActiveDialer = opts.ActiveDialer
+	if opts.ActiveDialTimeout == 0 {
+		newOpts.ActiveDialTimeout = defaultActiveDialTimeout
+	} else {
+		newOpts.ActiveDialTimeout = opts.ActiveDialTimeout
+	}
+
+	if opts.PassiveAcceptTimeout == 0 {
+		newOpts.PassiveAcceptTimeout = defaultPassiveAcceptTimeout
+	} else {
+		newOpts.PassiveAcceptTimeout = opts.PassiveAcceptTimeout
+	}
+	newOpts.DelayTransferReply = opts.DelayTransferReply
 
 	return &newOpts
 }
@@ -151,7 +547,10 @@ func NewServer(opts *ServerOpts) *Server {
 	s := new(Server)
 	s.ServerOpts = opts
 	s.listenTo = net.JoinHostPort(opts.Hostname, strconv.Itoa(opts.Port))
-	s.logger = opts.Logger
+	s.logger = leveledLogger(opts.Logger)
+	if opts.GlobalRateLimit > 0 {
+		s.globalLimiter = newRateLimiter(opts.GlobalRateLimit)
+	}
 	return s
 }
 
@@ -161,16 +560,22 @@ func NewServer(opts *ServerOpts) *Server {
 // will handle all auth and persistence details.
 func (server *Server) newConn(tcpConn net.Conn, driver Driver) *Conn {
 	c := new(Conn)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 	c.namePrefix = "/"
 	c.conn = tcpConn
 	c.controlReader = bufio.NewReader(tcpConn)
 	c.controlWriter = bufio.NewWriter(tcpConn)
 	c.driver = driver
+	c.sessionDriver = driver
 	c.auth = server.Auth
 	c.server = server
-	c.sessionID = newSessionID()
+	c.sessionID = server.SessionIDGenerator()
 	c.logger = server.logger
 	c.tlsConfig = server.tlsConfig
+	if server.StrictTLSResumption && c.tlsConfig != nil {
+		c.tlsConfig = sessionTLSConfig(c.tlsConfig)
+	}
+	c.resetSessionState()
 	driver.Init(c)
 	return c
 }
@@ -190,6 +595,46 @@ func simpleTLSConfig(certFile, keyFile string) (*tls.Config, error) {
 	return config, nil
 }
 
+// secureCipherSuites are the TLS 1.2 cipher suites allowed by
+// SecureTLSConfig, all with forward secrecy and authenticated encryption.
+// TLS 1.3 suites are not configurable and all secure.
+var secureCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// SecureTLSConfig returns a copy of config that refuses TLS versions before
+// 1.2 and cipher suites without forward secrecy or authenticated
+// encryption. Set it as ServerOpts.TLSConfig, where it applies to both
+// control and data connections, including the copies made for
+// StrictTLSResumption:
+//
+//     config, err := tls.LoadX509KeyPair(certFile, keyFile)
+//     ...
+//     opts.TLS = true
+//     opts.TLSConfig = server.SecureTLSConfig(&tls.Config{
+//       Certificates: []tls.Certificate{config},
+//     })
+//
+func SecureTLSConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	config.CipherSuites = secureCipherSuites
+	if config.NextProtos == nil {
+		config.NextProtos = []string{"ftp"}
+	}
+	return config
+}
+
 // ListenAndServe asks a new Server to begin accepting client connections. It
 // accepts no arguments - all configuration is provided via the NewServer
 // function.
@@ -199,63 +644,264 @@ func simpleTLSConfig(certFile, keyFile string) (*tls.Config, error) {
 // listening on the same port.
 //
 func (server *Server) ListenAndServe() error {
+	if err := server.prepare(); err != nil {
+		return err
+	}
+
+	sessionID := ""
 	var listener net.Listener
 	var err error
-
-	if server.ServerOpts.TLS {
-		server.tlsConfig, err = simpleTLSConfig(server.CertFile, server.KeyFile)
+	if server.UnixSocket != "" {
+		if server.PublicIp == "" && server.PublicIpFunc == nil {
+			server.logger.Warnf(sessionID, "PublicIp is not set, PASV is not available over the Unix socket")
+		}
+		listener, err = server.listen("unix", server.UnixSocket)
 		if err != nil {
 			return err
 		}
-
-		if server.ServerOpts.ExplicitFTPS {
-			listener, err = net.Listen("tcp", server.listenTo)
-		} else {
-			listener, err = tls.Listen("tcp", server.listenTo, server.tlsConfig)
-		}
+		server.logger.Infof(sessionID, "%s listening on %s", server.Name, server.UnixSocket)
 	} else {
-		listener, err = net.Listen("tcp", server.listenTo)
+		listener, err = server.listen("tcp", server.listenTo)
+		if err != nil {
+			return err
+		}
+		server.logger.Infof(sessionID, "%s listening on %d", server.Name, server.Port)
 	}
-	if err != nil {
-		return err
+
+	if server.TLSImplicit {
+		implicitTo := net.JoinHostPort(server.Hostname, strconv.Itoa(server.ImplicitTLSPort))
+		implicitListener, err := server.listen("tcp", implicitTo)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		server.implicitListener = implicitListener
+		server.logger.Infof(sessionID, "%s listening for implicit FTPS on %d", server.Name, server.ImplicitTLSPort)
+
+		go func() {
+			err := server.serve(implicitListener, true)
+			if err != ErrServerClosed {
+				server.logger.Errorf(sessionID, "implicit FTPS listener stopped: %v", err)
+			}
+		}()
 	}
 
-	sessionID := ""
-	server.logger.Printf(sessionID, "%s listening on %d", server.Name, server.Port)
+	server.listener = listener
+	return server.serve(listener, server.TLS && !server.ExplicitFTPS)
+}
 
-	return server.Serve(listener)
+// listen opens a listener of ListenAndServe with the ListenBacklog.
+func (server *Server) listen(network, address string) (net.Listener, error) {
+	l, err := net.Listen(network, address)
+	if err != nil || server.ListenBacklog == 0 {
+		return l, err
+	}
+	if err := setBacklog(l, server.ListenBacklog); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
 }
 
 // Serve accepts connections on a given net.Listener and handles each
-// request in a new goroutine.
+// request in a new goroutine. It is an alternative to ListenAndServe for
+// listeners created elsewhere, e.g. by systemd socket activation, and need
+// not be TCP: for a Unix socket, set PublicIp for passive data connections.
+// The Hostname, Port and TLSImplicit options are ignored.
 //
 func (server *Server) Serve(l net.Listener) error {
+	if err := server.prepare(); err != nil {
+		l.Close()
+		return err
+	}
+	server.logger.Infof("", "%s listening on %s", server.Name, l.Addr())
 	server.listener = l
+	return server.serve(l, server.TLS && !server.ExplicitFTPS)
+}
+
+// prepare validates the options and sets up the state shared by all
+// listeners of the server.
+func (server *Server) prepare() error {
+	var err error
+	if server.TLSImplicit && !server.TLS {
+		return errors.New("ftp: TLSImplicit requires TLS")
+	}
+	if server.TLS && server.tlsConfig == nil && server.TLSConfig != nil {
+		server.tlsConfig = server.TLSConfig
+	} else if server.TLS && server.tlsConfig == nil {
+		server.tlsConfig, err = simpleTLSConfig(server.CertFile, server.KeyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	server.passivePorts, err = parsePortRange(server.PassivePorts)
+	if err != nil {
+		return err
+	}
+	if err := checkListenHost(server.PassiveListenHost); err != nil {
+		return err
+	}
+	if server.DataBufferSize < minDataBufferSize {
+		return fmt.Errorf("ftp: DataBufferSize of %d is below the minimum of %d", server.DataBufferSize, minDataBufferSize)
+	}
+	server.ipFilter, err = newIPFilter(server.AllowedNetworks, server.DeniedNetworks)
+	if err != nil {
+		return err
+	}
+	if server.DataDSCP < 0 || server.DataDSCP > maxDSCP {
+		return fmt.Errorf("ftp: invalid DataDSCP %d", server.DataDSCP)
+	}
+	if server.DataDSCP != 0 && !dscpSupported {
+		server.logger.Warnf("", "DataDSCP is not supported on this platform and ignored")
+	}
+	if server.ListenBacklog < 0 {
+		return fmt.Errorf("ftp: invalid ListenBacklog %d", server.ListenBacklog)
+	}
+	if server.ListenBacklog != 0 && !backlogSupported {
+		server.logger.Warnf("", "ListenBacklog is not supported on this platform and ignored")
+	}
+	if server.DataConnMode < DataConnBoth || server.DataConnMode > DataConnActiveOnly {
+		return fmt.Errorf("ftp: invalid DataConnMode %d", server.DataConnMode)
+	}
+	if server.DefaultTransferType != TransferBinary && server.DefaultTransferType != TransferASCII {
+		return fmt.Errorf("ftp: invalid DefaultTransferType %d", server.DefaultTransferType)
+	}
+	if server.UnknownCommandCode != 500 && server.UnknownCommandCode != 502 {
+		return fmt.Errorf("ftp: UnknownCommandCode must be 500 or 502, not %d", server.UnknownCommandCode)
+	}
+	server.disabledCommands = make(map[string]bool)
+	for _, name := range server.DisabledCommands {
+		name = strings.ToUpper(name)
+		if commands[name] == nil {
+			return fmt.Errorf("ftp: unknown command %q in DisabledCommands", name)
+		}
+		server.disabledCommands[name] = true
+	}
+
 	server.ctx, server.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+// checkListenHost makes sure passive listeners can bind to host.
+func checkListenHost(host string) error {
+	if host == "" {
+		return nil
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("ftp: invalid passive listen host %q", host)
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return fmt.Errorf("ftp: unable to listen on passive listen host %q: %v", host, err)
+	}
+	return l.Close()
+}
+
+// serve runs the accept loop of l. If implicitTLS is true, every accepted
+// connection is expected to start with a TLS handshake. Temporary accept
+// errors are retried with a backoff.
+func (server *Server) serve(l net.Listener, implicitTLS bool) error {
 	sessionID := ""
+	var backoff time.Duration
 	for {
-		tcpConn, err := server.listener.Accept()
+		tcpConn, err := l.Accept()
 		if err != nil {
 			select {
 			case <-server.ctx.Done():
 				return ErrServerClosed
 			default:
 			}
-			server.logger.Printf(sessionID, "listening error: %v", err)
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// e.g. EMFILE, which retrying right away won't fix
+				if backoff *= 2; backoff == 0 {
+					backoff = minAcceptBackoff
+				} else if backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				server.logger.Warnf(sessionID, "Accept error, retrying in %v: %v", backoff, err)
+				select {
+				case <-time.After(backoff):
+				case <-server.ctx.Done():
+					return ErrServerClosed
+				}
 				continue
 			}
+			server.logger.Errorf(sessionID, "listening error: %v", err)
 			return err
 		}
-		driver, err := server.Factory.NewDriver()
-		if err != nil {
-			server.logger.Printf(sessionID, "Error creating driver, aborting client connection: %v", err)
-			tcpConn.Close()
-		} else {
-			ftpConn := server.newConn(tcpConn, driver)
-			go ftpConn.Serve()
+		backoff = 0
+		if err := setKeepAlive(tcpConn, server.KeepAlivePeriod); err != nil {
+			server.logger.Warnf(sessionID, "Unable to set keepalive: %v", err)
+		}
+		if server.ProxyProtocol {
+			// read the header without holding up the accept loop
+			go func(tcpConn net.Conn) {
+				conn, err := readProxyHeader(tcpConn, proxyHeaderTimeout)
+				if err != nil {
+					server.logger.Warnf(sessionID, "Invalid PROXY header from %s, aborting client connection: %v", tcpConn.RemoteAddr(), err)
+					tcpConn.Close()
+					return
+				}
+				server.handle(conn, implicitTLS)
+			}(tcpConn)
+			continue
 		}
+		server.handle(tcpConn, implicitTLS)
+	}
+}
+
+// handle starts serving an accepted client connection, unless its IP is
+// refused.
+func (server *Server) handle(tcpConn net.Conn, implicitTLS bool) {
+	sessionID := ""
+	ip := remoteIP(tcpConn)
+	if !server.ipFilter.allows(net.ParseIP(ip)) {
+		server.logger.Warnf(sessionID, "Connection from %s not allowed, rejecting client connection", ip)
+		server.reject(tcpConn, 421, "Connections from your IP address are not allowed")
+		return
+	}
+	if !server.conns.acquire(server.MaxConnections) {
+		server.logger.Warnf(sessionID, "Too many connections, rejecting client connection from %s", ip)
+		server.reject(tcpConn, 421, "Too many connections")
+		return
+	}
+	if !server.connsPerIP.acquire(ip, server.MaxConnsPerIP) {
+		server.logger.Warnf(sessionID, "Too many connections from %s, rejecting client connection", ip)
+		server.conns.release()
+		server.reject(tcpConn, 421, "Too many connections from your IP address")
+		return
 	}
+	driver, err := server.Factory.NewDriver()
+	if err != nil {
+		server.logger.Errorf(sessionID, "Error creating driver, aborting client connection: %v", err)
+		server.connsPerIP.release(ip)
+		server.conns.release()
+		tcpConn.Close()
+		return
+	}
+	server.Metrics.ConnOpened()
+	ftpConn := server.newConn(tcpConn, driver)
+	ftpConn.implicitTLS = implicitTLS
+	server.sessions.add(ftpConn, tcpConn)
+	go func() {
+		defer server.conns.release()
+		defer server.connsPerIP.release(ip)
+		defer server.sessions.remove(ftpConn)
+		ftpConn.Serve()
+	}()
+}
+
+// reject replies to a client connection not being served and closes it.
+// The reply is written in the clear, so implicit FTPS clients only see the
+// connection closing.
+func (server *Server) reject(tcpConn net.Conn, code int, message string) {
+	if server.ReplyHook != nil {
+		code, message = server.ReplyHook("", code, message)
+	}
+	tcpConn.SetWriteDeadline(time.Now().Add(time.Second))
+	io.WriteString(tcpConn, formatReply(code, message))
+	tcpConn.Close()
 }
 
 // Shutdown will gracefully stop a server. Already connected clients will retain their connections
@@ -263,9 +909,26 @@ func (server *Server) Shutdown() error {
 	if server.cancel != nil {
 		server.cancel()
 	}
+	if server.implicitListener != nil {
+		server.implicitListener.Close()
+	}
 	if server.listener != nil {
 		return server.listener.Close()
 	}
 	// server wasnt even started
 	return nil
 }
+
+// GracefulShutdown stops the server like Shutdown, then waits up to timeout
+// for data transfers in progress to complete. Data connections without a
+// transfer are closed right away. Transfers still running after the timeout
+// are aborted and ErrShutdownTimeout is returned.
+func (server *Server) GracefulShutdown(timeout time.Duration) error {
+	err := server.Shutdown()
+	server.dataSockets.closeIdle()
+	if !server.dataSockets.wait(timeout) {
+		server.dataSockets.closeAll()
+		return ErrShutdownTimeout
+	}
+	return err
+}
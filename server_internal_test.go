@@ -0,0 +1,187 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServerServe(t *testing.T) {
+	// A Unix socket, as handed over by systemd socket activation.
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "ftp.sock"))
+	if err != nil {
+		t.Skip("Unix sockets not available: ", err)
+	}
+	s := NewServer(&ServerOpts{
+		Factory:  newTestDriverFactory(),
+		Auth:     &SimpleAuth{Name: "admin", Password: "admin"},
+		Logger:   new(DiscardLogger),
+		PublicIp: "127.0.0.1",
+	})
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	c, err := textproto.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	login(t, c)
+	expect(t, c, 257, "MKD /dir")
+	expect(t, c, 250, "CWD /dir")
+	upload(t, c, "a.txt", "over a Unix socket")
+	if got := download(t, c, "RETR /dir/a.txt"); got != "over a Unix socket" {
+		t.Errorf("got %q", got)
+	}
+	if got := download(t, c, "LIST"); !strings.Contains(got, "a.txt") {
+		t.Errorf("got listing %q", got)
+	}
+	expect(t, c, 221, "QUIT")
+
+	s.Shutdown()
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("got %v, want ErrServerClosed", err)
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ftp.sock")
+	s := NewServer(&ServerOpts{
+		Factory:    newTestDriverFactory(),
+		Auth:       &SimpleAuth{Name: "admin", Password: "admin"},
+		Logger:     new(DiscardLogger),
+		UnixSocket: path,
+		PublicIp:   "127.0.0.1",
+	})
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe() }()
+	defer s.Shutdown()
+
+	var c *textproto.Conn
+	deadline := time.Now().Add(time.Second)
+	for {
+		var err error
+		if c, err = textproto.Dial("unix", path); err == nil {
+			break
+		}
+		select {
+		case err := <-served:
+			t.Skip("Unix sockets not available: ", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	login(t, c)
+
+	// PASV advertises the public IP, as the control connection has none.
+	if msg := expect(t, c, 227, "PASV"); !strings.Contains(msg, "(127,0,0,1,") {
+		t.Errorf("got PASV reply %q", msg)
+	}
+	upload(t, c, "/a.txt", "over a Unix socket")
+	if got := download(t, c, "RETR /a.txt"); got != "over a Unix socket" {
+		t.Errorf("got %q", got)
+	}
+	port := epsvPort(t, expect(t, c, 229, "EPSV"))
+	data, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 150, "NLST")
+	got, _ := ioutil.ReadAll(data)
+	data.Close()
+	if string(got) != "a.txt\r\n" {
+		t.Errorf("got listing %q", got)
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 221, "QUIT")
+
+	s.Shutdown()
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("got %v, want ErrServerClosed", err)
+	}
+}
+
+// flakyListener fails its first failures calls to Accept with EMFILE.
+type flakyListener struct {
+	net.Listener
+	failures int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.failures, -1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerAcceptTemporaryError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(&ServerOpts{
+		Factory: newTestDriverFactory(),
+		Auth:    &SimpleAuth{Name: "admin", Password: "admin"},
+		Logger:  new(DiscardLogger),
+	})
+	s.listenTo = l.Addr().String()
+	served := make(chan error, 1)
+	start := time.Now()
+	go func() { served <- s.Serve(&flakyListener{Listener: l, failures: 4}) }()
+	defer s.Shutdown()
+
+	// The loop keeps accepting, backing off 5, 10, 20 and 40ms.
+	c := dialTestServer(t, s)
+	if elapsed := time.Since(start); elapsed < 75*time.Millisecond {
+		t.Errorf("accepted after %v, want a backoff", elapsed)
+	}
+	login(t, c)
+
+	s.Shutdown()
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("got %v, want ErrServerClosed", err)
+	}
+}
+
+func TestServerListenBacklog(t *testing.T) {
+	s := NewServer(&ServerOpts{Factory: newTestDriverFactory(), Logger: new(DiscardLogger), ListenBacklog: 1024})
+	l, err := s.listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	s = NewServer(&ServerOpts{Factory: newTestDriverFactory(), Logger: new(DiscardLogger), ListenBacklog: -1})
+	if err := s.prepare(); err == nil {
+		t.Error("expected an error for a negative backlog")
+	}
+}
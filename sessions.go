@@ -0,0 +1,142 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrSessionNotFound is returned by Kick() for sessions that aren't open.
+var ErrSessionNotFound = errors.New("ftp: session not found")
+
+// ConnInfo describes an open control connection.
+type ConnInfo struct {
+	SessionID  string
+	RemoteAddr string
+	// The logged in user, empty before login
+	User string
+	// The running command and its parameter, empty between commands.
+	// Passwords are hidden.
+	Command string
+	// When the client connected
+	Since time.Time
+	// The data transferred by the completed data connections of the session
+	Transfers TransferStats
+}
+
+// session is the entry of a connection in the sessionRegistry. Its fields
+// are updated by the connection and read by the registry's users.
+type session struct {
+	lock    sync.Mutex
+	conn    *Conn
+	netConn net.Conn // the TCP connection, even after AUTH TLS
+	since   time.Time
+	user    string
+	command string
+}
+
+// update records the user and the running command of the session.
+func (s *session) update(user, command, param string) {
+	param = redactParam(command, param)
+	if param != "" {
+		command += " " + param
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.user = user
+	s.command = command
+}
+
+func (s *session) info() ConnInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return ConnInfo{
+		SessionID:  s.conn.sessionID,
+		RemoteAddr: s.netConn.RemoteAddr().String(),
+		User:       s.user,
+		Command:    s.command,
+		Since:      s.since,
+		Transfers:  s.conn.Stats(),
+	}
+}
+
+// sessionRegistry keeps track of the open connections of a server.
+type sessionRegistry struct {
+	lock     sync.Mutex
+	sessions map[string]*session
+}
+
+// add registers conn, whose TCP connection is netConn.
+func (r *sessionRegistry) add(conn *Conn, netConn net.Conn) {
+	s := &session{conn: conn, netConn: netConn, since: time.Now()}
+	conn.session = s
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.sessions == nil {
+		r.sessions = make(map[string]*session)
+	}
+	r.sessions[conn.sessionID] = s
+}
+
+func (r *sessionRegistry) remove(conn *Conn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.sessions, conn.sessionID)
+}
+
+func (r *sessionRegistry) get(sessionID string) *session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sessions[sessionID]
+}
+
+func (r *sessionRegistry) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.sessions)
+}
+
+func (r *sessionRegistry) list() []*session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// ActiveConnCount returns the number of open control connections.
+func (server *Server) ActiveConnCount() int {
+	return server.sessions.count()
+}
+
+// ActiveConns returns a snapshot of the open control connections, oldest
+// first.
+func (server *Server) ActiveConns() []ConnInfo {
+	sessions := server.sessions.list()
+	infos := make([]ConnInfo, len(sessions))
+	for i, s := range sessions {
+		infos[i] = s.info()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Since.Before(infos[j].Since) })
+	return infos
+}
+
+// Kick closes the connection of the session sessionID, aborting its data
+// transfers.
+func (server *Server) Kick(sessionID string) error {
+	s := server.sessions.get(sessionID)
+	if s == nil {
+		return ErrSessionNotFound
+	}
+	server.logger.Infof(sessionID, "Kicking session")
+	s.conn.cancel()
+	return s.netConn.Close()
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a second passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestActiveConns(t *testing.T) {
+	s, _ := newTestServer(t, &ServerOpts{})
+	if n := s.ActiveConnCount(); n != 0 {
+		t.Fatalf("got %d connections, want 0", n)
+	}
+
+	anonymous := dialTestServer(t, s)
+	user := dialTestServer(t, s)
+	login(t, user)
+	upload(t, user, "/a.txt", "hello")
+
+	conns := s.ActiveConns()
+	if len(conns) != 2 || s.ActiveConnCount() != 2 {
+		t.Fatalf("got connections %+v, want 2", conns)
+	}
+	if conns[0].User != "" || conns[1].User != "admin" {
+		t.Errorf("got users %q and %q, want none and admin", conns[0].User, conns[1].User)
+	}
+	for _, conn := range conns {
+		if conn.SessionID == "" || conn.RemoteAddr == "" || conn.Since.IsZero() || conn.Command != "" {
+			t.Errorf("got %+v", conn)
+		}
+	}
+	if got := conns[1].Transfers.BytesIn; got != 5 {
+		t.Errorf("got %d bytes in, want 5", got)
+	}
+
+	// The running command is listed, without passwords.
+	data := openPassive(t, user)
+	expect(t, user, 150, "STOR /b.txt")
+	if got := s.ActiveConns()[1].Command; got != "STOR /b.txt" {
+		t.Errorf("got command %q, want STOR /b.txt", got)
+	}
+	data.Close()
+	user.ReadResponse(226)
+	expect(t, anonymous, 331, "USER admin")
+	if _, err := anonymous.Cmd("PASS secret"); err != nil {
+		t.Fatal(err)
+	}
+	anonymous.ReadResponse(530)
+	for _, conn := range s.ActiveConns() {
+		if conn.Command != "" {
+			t.Errorf("got command %q between commands", conn.Command)
+		}
+	}
+
+	// Kicking closes the session and drops it from the list.
+	if err := s.Kick(conns[1].SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := user.ReadLine(); err != io.EOF {
+		t.Errorf("got %v, want the kicked connection closed", err)
+	}
+	waitFor(t, "the kicked session to be removed", func() bool { return s.ActiveConnCount() == 1 })
+	if remaining := s.ActiveConns(); remaining[0].SessionID != conns[0].SessionID {
+		t.Errorf("got %+v, want the anonymous session left", remaining)
+	}
+	expect(t, anonymous, 200, "NOOP")
+
+	if err := s.Kick(conns[1].SessionID); err != ErrSessionNotFound {
+		t.Errorf("got %v, want ErrSessionNotFound", err)
+	}
+	anonymous.Cmd("QUIT")
+	waitFor(t, "all sessions to be removed", func() bool { return s.ActiveConnCount() == 0 })
+}
+
+func TestSessionHidesPassword(t *testing.T) {
+	s := &session{conn: &Conn{}}
+	s.update("", "pass", "secret")
+	if s.command != "pass ****" {
+		t.Errorf("got %q", s.command)
+	}
+}
+
+func TestSessionIDs(t *testing.T) {
+	logger := new(printLogger)
+	s, driver := newTestServer(t, &ServerOpts{Logger: logger})
+	driver.files["/a.txt"] = []byte("hello")
+
+	const sessions = 100
+	var wg sync.WaitGroup
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := textproto.Dial("tcp", s.listenTo)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+			if _, _, err := c.ReadResponse(220); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "all sessions to be registered", func() bool { return s.ActiveConnCount() == sessions })
+
+	seen := make(map[string]bool)
+	for _, conn := range s.ActiveConns() {
+		if _, err := hex.DecodeString(conn.SessionID); err != nil || len(conn.SessionID) != 32 {
+			t.Errorf("got session ID %q, want 16 bytes in hex", conn.SessionID)
+		}
+		if seen[conn.SessionID] {
+			t.Errorf("session ID %s used twice", conn.SessionID)
+		}
+		seen[conn.SessionID] = true
+	}
+
+	// The data connections of a session log with its ID.
+	c := dialTestServer(t, s)
+	login(t, c)
+	download(t, c, "RETR /a.txt")
+	id := driver.lastConn().SessionID()
+	if seen[id] {
+		t.Fatalf("session ID %s used twice", id)
+	}
+	var found bool
+	logger.lock.Lock()
+	for _, line := range logger.lines {
+		if strings.Contains(line, "passive data connection") {
+			found = true
+			if !strings.HasPrefix(line, id+" ") {
+				t.Errorf("got log line %q, want it tagged with %s", line, id)
+			}
+		}
+	}
+	logger.lock.Unlock()
+	if !found {
+		t.Error("no log line about the passive data connection")
+	}
+}
+
+func TestSessionIDGenerator(t *testing.T) {
+	var n int32
+	s, driver := newTestServer(t, &ServerOpts{SessionIDGenerator: func() string {
+		return fmt.Sprintf("session-%d", atomic.AddInt32(&n, 1))
+	}})
+	dialTestServer(t, s)
+	waitFor(t, "the session to be registered", func() bool { return s.ActiveConnCount() == 1 })
+	if got := s.ActiveConns()[0].SessionID; got != "session-1" {
+		t.Errorf("got session ID %q, want session-1", got)
+	}
+	if got := driver.lastConn().SessionID(); got != "session-1" {
+		t.Errorf("got session ID %q from the Conn, want session-1", got)
+	}
+}
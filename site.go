@@ -0,0 +1,85 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// SiteHandler runs a custom SITE subcommand with its arguments, the rest of
+// the command line after the subcommand name, and returns the reply to the
+// client. The message may span several lines.
+type SiteHandler func(conn *Conn, args string) (code int, message string)
+
+// siteHandlers are the SITE subcommands registered with Server.HandleSite,
+// by upper case name.
+type siteHandlers struct {
+	lock     sync.RWMutex
+	handlers map[string]SiteHandler
+}
+
+func (h *siteHandlers) get(name string) SiteHandler {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.handlers[strings.ToUpper(name)]
+}
+
+func (h *siteHandlers) set(name string, handler SiteHandler) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.handlers == nil {
+		h.handlers = make(map[string]SiteHandler)
+	}
+	if handler == nil {
+		delete(h.handlers, strings.ToUpper(name))
+	} else {
+		h.handlers[strings.ToUpper(name)] = handler
+	}
+}
+
+// HandleSite registers handler for the SITE subcommand name, e.g. "WHO" for
+// SITE WHO. Names are case insensitive, and a handler for CHMOD replaces the
+// built-in one. A nil handler unregisters name. Handlers may be registered
+// while the server is running.
+func (server *Server) HandleSite(name string, handler SiteHandler) {
+	server.siteHandlers.set(name, handler)
+}
+
+// isAdmin reports whether the logged in user is one of the AdminUsers.
+func (conn *Conn) isAdmin() bool {
+	if !conn.IsLogin() {
+		return false
+	}
+	for _, user := range conn.server.AdminUsers {
+		if user == conn.user {
+			return true
+		}
+	}
+	return false
+}
+
+// siteWho lists the connected sessions for SITE WHO, one per line with
+// their user, client address and running command.
+func (conn *Conn) siteWho() {
+	if !conn.isAdmin() {
+		conn.writeMessage(530, "Permission denied")
+		return
+	}
+	conns := conn.server.ActiveConns()
+	lines := []string{fmt.Sprintf("%d sessions connected", len(conns))}
+	for _, info := range conns {
+		user, activity := info.User, info.Command
+		if user == "" {
+			user = "-"
+		}
+		if activity == "" {
+			activity = "idle"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s %s", info.SessionID, user, info.RemoteAddr, activity))
+	}
+	conn.writeMessage(200, strings.Join(lines, "\n"))
+}
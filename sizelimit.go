@@ -0,0 +1,50 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrFileTooLarge is returned when reading an upload larger than
+// MaxUploadSize, or a download larger than MaxDownloadSize.
+var ErrFileTooLarge = errors.New("ftp: transfer size limit exceeded")
+
+// sizeLimitReader fails with ErrFileTooLarge once more than remaining bytes
+// are read.
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	// read one byte more than allowed to tell whether the transfer is larger
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.r.Read(p)
+	if int64(n) > r.remaining {
+		n = int(r.remaining)
+		r.remaining = 0
+		r.exceeded = true
+		return n, ErrFileTooLarge
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// sizeLimit returns the limit of a transfer, the one of the user if set or
+// else the one of the server, or 0 for none.
+func sizeLimit(user, server int64) int64 {
+	if user < 0 {
+		return 0
+	}
+	if user > 0 {
+		return user
+	}
+	return server
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxUploadSize(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{MaxUploadSize: 100})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	upload(t, c, "/max.txt", strings.Repeat("a", 100))
+	if got := len(driver.testFile("/max.txt")); got != 100 {
+		t.Errorf("got %d bytes, want 100", got)
+	}
+
+	// One byte more aborts and removes the new file.
+	data := openPassive(t, c)
+	expect(t, c, 150, "STOR /over.txt")
+	data.Write([]byte(strings.Repeat("b", 101)))
+	data.Close()
+	if _, _, err := c.ReadResponse(552); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.Stat("/over.txt"); err == nil {
+		t.Error("expected the partial upload to be removed")
+	}
+
+	// Appending leaves the file in place.
+	data = openPassive(t, c)
+	expect(t, c, 150, "APPE /max.txt")
+	data.Write([]byte(strings.Repeat("c", 101)))
+	data.Close()
+	if _, _, err := c.ReadResponse(552); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.Stat("/max.txt"); err != nil {
+		t.Errorf("expected the file to be kept: %v", err)
+	}
+
+	// So does overwriting it.
+	data = openPassive(t, c)
+	expect(t, c, 150, "STOR /max.txt")
+	data.Write([]byte(strings.Repeat("d", 101)))
+	data.Close()
+	if _, _, err := c.ReadResponse(552); err != nil {
+		t.Fatal(err)
+	}
+	if got := driver.testFile("/max.txt"); got != strings.Repeat("a", 100) {
+		t.Errorf("got %q after the aborted overwrite", got)
+	}
+}
+
+func TestMaxDownloadSize(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{MaxDownloadSize: 100})
+	driver.files["/max.txt"] = []byte(strings.Repeat("a", 100))
+	driver.files["/over.txt"] = []byte(strings.Repeat("b", 101))
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	if got := download(t, c, "RETR /max.txt"); len(got) != 100 {
+		t.Errorf("got %d bytes, want 100", len(got))
+	}
+	data := openPassive(t, c)
+	defer data.Close()
+	expect(t, c, 552, "RETR /over.txt")
+	// The refused transfer closes the data connection.
+	data.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := data.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %d bytes, %v from the data connection, want EOF", n, err)
+	}
+	// A restart within the limit is fine.
+	expect(t, c, 350, "REST 1")
+	if got := download(t, c, "RETR /over.txt"); len(got) != 100 {
+		t.Errorf("got %d bytes, want 100", len(got))
+	}
+}
+
+func TestMaxUploadSizePerUser(t *testing.T) {
+	auth := &MultiUserAuth{}
+	s, _ := newTestServer(t, &ServerOpts{Auth: auth, MaxUploadSize: 10})
+	for _, user := range []struct {
+		name  string
+		limit int64
+		ok    int // the largest upload, in bytes
+	}{
+		{"default", 0, 10},
+		{"larger", 20, 20},
+		{"unlimited", -1, 1000},
+	} {
+		auth.AddUser(user.name, "secret", newTestDriverFactory(), UserPermissions{MaxUploadSize: user.limit})
+		c := dialTestServer(t, s)
+		expect(t, c, 331, "USER %s", user.name)
+		expect(t, c, 230, "PASS secret")
+		upload(t, c, "/ok.txt", strings.Repeat("a", user.ok))
+		if user.limit < 0 {
+			continue
+		}
+		data := openPassive(t, c)
+		expect(t, c, 150, "STOR /over.txt")
+		data.Write([]byte(strings.Repeat("b", user.ok+1)))
+		data.Close()
+		if _, _, err := c.ReadResponse(552); err != nil {
+			t.Errorf("%s: %v", user.name, err)
+		}
+	}
+}
@@ -5,13 +5,67 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
+// ErrDataConnTimeout is returned by the Read and Write methods of a data
+// socket when the data connection was idle for longer than DataConnTimeout.
+// The connection is closed.
+var ErrDataConnTimeout = errors.New("ftp: data connection idle timeout")
+
+// ErrAborted is returned by the Read and Write methods of a data socket when
+// the transfer was aborted, e.g. by an ABOR command.
+var ErrAborted = errors.New("ftp: transfer aborted")
+
+// ErrAcceptTimeout is wrapped in the error returned by the Read and Write
+// methods of a passive data socket when the client did not connect within
+// the accept timeout. Check for it with errors.Is.
+var ErrAcceptTimeout = errors.New("ftp: passive data connection not opened in time")
+
+// ErrDataSocketClosed is returned by the Read and Write methods of a passive
+// data socket once it was closed, including when a concurrent Close
+// interrupted the call.
+var ErrDataSocketClosed = errors.New("ftp: data socket closed")
+
+// closeWriteTimeout is how long Close waits for pending writes of a passive
+// data socket to complete before closing the connection anyway.
+const closeWriteTimeout = time.Second
+
+// ErrTLSNotResumed fails the TLS handshake of a data connection that did not
+// resume the control connection's session while StrictTLSResumption is set.
+var ErrTLSNotResumed = errors.New("ftp: data connection did not resume the TLS session")
+
+// Dialer opens network connections, like net.Dialer does. It is used for
+// active data connections.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// timeoutDialer limits how long the Dialer it wraps may take to connect.
+type timeoutDialer struct {
+	Dialer
+	timeout time.Duration
+}
+
+func (d timeoutDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
 // DataSocket describes a data socket is used to send non-control data between the client and
 // server.
 type DataSocket interface {
@@ -30,36 +84,51 @@ type DataSocket interface {
 }
 
 type ftpActiveSocket struct {
-	conn   *net.TCPConn
-	host   string
-	port   int
-	logger Logger
+	ctx       context.Context
+	conn      net.Conn
+	host      string
+	port      int
+	logger    LeveledLogger
+	metrics   Metrics
+	closeOnce sync.Once
 }
 
-func newActiveSocket(remote string, port int, logger Logger, sessionID string) (DataSocket, error) {
+// newActiveSocket connects to the data port opened by the client on network,
+// tcp4 or tcp6, using dialer. When tlsConfig is non-nil the connection is secured before it is
+// returned. As required by RFC 4217 the server acts as the TLS server even
+// though it initiated the TCP connection. Cancelling ctx aborts the
+// transfer.
+func newActiveSocket(ctx context.Context, network, remote string, port int, dialer Dialer, idleTimeout time.Duration, logger LeveledLogger, sessionID string, tlsConfig *tls.Config, metrics Metrics) (DataSocket, error) {
 	connectTo := net.JoinHostPort(remote, strconv.Itoa(port))
 
-	logger.Print(sessionID, "Opening active data connection to "+connectTo)
+	logger.Debugf(sessionID, "Opening active data connection to %s", connectTo)
 
-	raddr, err := net.ResolveTCPAddr("tcp", connectTo)
+	tcpConn, err := dialer.DialContext(ctx, network, connectTo)
 
 	if err != nil {
-		logger.Print(sessionID, err)
+		logger.Errorf(sessionID, "%v", err)
 		return nil, err
 	}
 
-	tcpConn, err := net.DialTCP("tcp", nil, raddr)
-
-	if err != nil {
-		logger.Print(sessionID, err)
-		return nil, err
+	var conn net.Conn = newDeadlineConn(ctx, tcpConn, idleTimeout)
+	if tlsConfig != nil {
+		tlsConn := tls.Server(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Warnf(sessionID, "TLS handshake on active data connection failed: %v", err)
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
 	}
 
 	socket := new(ftpActiveSocket)
-	socket.conn = tcpConn
+	socket.ctx = ctx
+	socket.conn = conn
 	socket.host = remote
 	socket.port = port
 	socket.logger = logger
+	socket.metrics = metrics
+	metrics.DataConnOpened()
 
 	return socket, nil
 }
@@ -73,36 +142,133 @@ func (socket *ftpActiveSocket) Port() int {
 }
 
 func (socket *ftpActiveSocket) Read(p []byte) (n int, err error) {
-	return socket.conn.Read(p)
+	n, err = socket.conn.Read(p)
+	return n, abortedErr(socket.ctx, err)
 }
 
 func (socket *ftpActiveSocket) Write(p []byte) (n int, err error) {
-	return socket.conn.Write(p)
+	n, err = socket.conn.Write(p)
+	return n, abortedErr(socket.ctx, err)
 }
 
 func (socket *ftpActiveSocket) Close() error {
+	socket.closeOnce.Do(socket.metrics.DataConnClosed)
 	return socket.conn.Close()
 }
 
+// portRange is an inclusive range of ports a passive listener may bind to.
+// The zero value lets the OS choose any free port.
+type portRange struct {
+	min int
+	max int
+}
+
+// parsePortRange parses a range in the form "50000-50100". An empty string
+// yields the zero portRange.
+func parsePortRange(s string) (portRange, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return portRange{}, nil
+	}
+
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return portRange{}, fmt.Errorf("ftp: invalid passive port range %q", s)
+	}
+
+	minPort, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return portRange{}, fmt.Errorf("ftp: invalid passive port range %q", s)
+	}
+	maxPort, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return portRange{}, fmt.Errorf("ftp: invalid passive port range %q", s)
+	}
+	if minPort < 1 || maxPort > 65535 || minPort > maxPort {
+		return portRange{}, fmt.Errorf("ftp: invalid passive port range %q", s)
+	}
+	return portRange{min: minPort, max: maxPort}, nil
+}
+
+// ports returns the candidate ports in the order they should be tried.
+func (r portRange) ports() []int {
+	if r.min == 0 {
+		return []int{0}
+	}
+	ports := make([]int, 0, r.max-r.min+1)
+	for port := r.min; port <= r.max; port++ {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// passiveBindBackoff is the delay before retrying to bind a passive
+// listener, doubled for each further attempt up to maxPassiveBindBackoff.
+const (
+	passiveBindBackoff    = 50 * time.Millisecond
+	maxPassiveBindBackoff = time.Second
+)
+
+// listenPassive opens the listener of a passive socket. Tests replace it to
+// make binding fail.
+// No SO_REUSEADDR is set: on Windows it would let two sessions bind one
+// port, while elsewhere Go sets it on listeners already.
+var listenPassive = func(ctx context.Context, network, address string) (net.Listener, error) {
+	var config net.ListenConfig
+	return config.Listen(ctx, network, address)
+}
+
 type ftpPassiveSocket struct {
-	conn       net.Conn
-	port       int
-	host       string
-	ingress    chan []byte
-	egress     chan []byte
-	logger     Logger
-	lock       sync.Mutex
-	err        error
-	tlsConfing *tls.Config
-}
-
-func newPassiveSocket(host string, port int, logger Logger, sessionID string, tlsConfing *tls.Config) (DataSocket, error) {
+	ctx           context.Context
+	conn          net.Conn
+	listener      net.Listener
+	port          int
+	localAddr     *net.TCPAddr
+	ports         portRange
+	network       string
+	host          string
+	listenHost    string
+	peerIP        net.IP
+	ingress       chan []byte
+	egress        chan []byte
+	logger        LeveledLogger
+	lock          sync.Mutex
+	accepted      chan struct{} // closed once Accept has returned
+	err           error
+	tlsConfing    *tls.Config
+	acceptTimeout time.Duration
+	idleTimeout   time.Duration
+	keepAlive     time.Duration
+	dscp          int
+	bindRetries   int
+	metrics       Metrics
+	closed        bool
+	writes        sync.WaitGroup // pending Write calls, waited for by Close
+}
+
+// newPassiveSocket opens a listener on listenHost, or all interfaces of the
+// network ("tcp4" or "tcp6") if empty, for the client to connect to. host is
+// the address advertised to the client. If peerIP is set, connections from
+// other addresses are dropped. Cancelling ctx closes a pending listener and
+// aborts the transfer.
+func newPassiveSocket(ctx context.Context, network, host, listenHost string, peerIP net.IP, ports portRange, acceptTimeout, idleTimeout, keepAlive time.Duration, dscp, bindRetries int, logger LeveledLogger, sessionID string, tlsConfing *tls.Config, metrics Metrics) (DataSocket, error) {
 	socket := new(ftpPassiveSocket)
+	socket.ctx = ctx
 	socket.ingress = make(chan []byte)
 	socket.egress = make(chan []byte)
 	socket.logger = logger
+	socket.network = network
 	socket.host = host
-	socket.port = port
+	socket.listenHost = listenHost
+	socket.peerIP = peerIP
+	socket.ports = ports
+	socket.acceptTimeout = acceptTimeout
+	socket.keepAlive = keepAlive
+	socket.dscp = dscp
+	socket.bindRetries = bindRetries
+	socket.idleTimeout = idleTimeout
+	socket.tlsConfing = tlsConfing
+	socket.metrics = metrics
+	socket.accepted = make(chan struct{})
 	if err := socket.GoListenAndServe(sessionID); err != nil {
 		return nil, err
 	}
@@ -117,70 +283,246 @@ func (socket *ftpPassiveSocket) Port() int {
 	return socket.port
 }
 
+// LocalAddr returns the address the listener is bound to, which may differ
+// from the advertised Host.
+func (socket *ftpPassiveSocket) LocalAddr() net.Addr {
+	return socket.localAddr
+}
+
 func (socket *ftpPassiveSocket) Read(p []byte) (n int, err error) {
-	if err := socket.waitForOpenSocket(); err != nil {
+	conn, err := socket.openConn(nil)
+	if err != nil {
 		return 0, err
 	}
-	return socket.conn.Read(p)
+	n, err = conn.Read(p)
+	return n, socket.ioErr(err)
 }
 
 func (socket *ftpPassiveSocket) Write(p []byte) (n int, err error) {
-	if err := socket.waitForOpenSocket(); err != nil {
+	conn, err := socket.openConn(&socket.writes)
+	if err != nil {
 		return 0, err
 	}
-	return socket.conn.Write(p)
+	defer socket.writes.Done()
+	n, err = conn.Write(p)
+	return n, socket.ioErr(err)
+}
+
+// openConn waits for the data connection and returns it, unless the socket
+// was closed. A non-nil pending is incremented while the socket is locked,
+// so Close can't miss the call.
+func (socket *ftpPassiveSocket) openConn(pending *sync.WaitGroup) (net.Conn, error) {
+	if err := socket.waitForOpenSocket(); err != nil {
+		return nil, err
+	}
+	socket.lock.Lock()
+	defer socket.lock.Unlock()
+	if socket.closed {
+		return nil, ErrDataSocketClosed
+	}
+	if pending != nil {
+		pending.Add(1)
+	}
+	return socket.conn, nil
 }
 
+// ioErr translates the error of a Read or Write on the data connection.
+func (socket *ftpPassiveSocket) ioErr(err error) error {
+	err = abortedErr(socket.ctx, err)
+	if err == nil || err == ErrAborted {
+		return err
+	}
+	socket.lock.Lock()
+	defer socket.lock.Unlock()
+	if socket.closed {
+		return ErrDataSocketClosed
+	}
+	return err
+}
+
+// Close closes the data connection and the listener, if still open. Pending
+// writes get up to closeWriteTimeout to complete first; later calls to Read
+// and Write fail with ErrDataSocketClosed. It is safe to call Close more
+// than once, and concurrently with Read and Write.
 func (socket *ftpPassiveSocket) Close() error {
-	if socket.conn != nil {
-		return socket.conn.Close()
+	// closing the listener unblocks a pending Accept
+	if socket.listener != nil {
+		socket.listener.Close()
+		<-socket.accepted
 	}
-	return nil
+
+	socket.lock.Lock()
+	if socket.closed {
+		socket.lock.Unlock()
+		return nil
+	}
+	socket.closed = true
+	conn := socket.conn
+	socket.lock.Unlock()
+	if conn == nil {
+		return nil
+	}
+	socket.metrics.DataConnClosed()
+
+	written := make(chan struct{})
+	go func() {
+		socket.writes.Wait()
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(closeWriteTimeout):
+	}
+	return conn.Close()
 }
 
-func (socket *ftpPassiveSocket) GoListenAndServe(sessionID string) (err error) {
-	laddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort("", strconv.Itoa(socket.port)))
-	if err != nil {
-		socket.logger.Print(sessionID, err)
-		return
+// listen binds to the first free port of the socket's port range. Ports in
+// use are skipped.
+func (socket *ftpPassiveSocket) listen(sessionID string) (*net.TCPListener, error) {
+	// a configured listen host determines the network itself
+	network := socket.network
+	if socket.listenHost != "" {
+		network = "tcp"
 	}
+	var lastErr error
+	for _, port := range socket.ports.ports() {
+		listener, err := listenPassive(socket.ctx, network, net.JoinHostPort(socket.listenHost, strconv.Itoa(port)))
+		if err == nil {
+			return listener.(*net.TCPListener), nil
+		}
+		if !isAddrInUse(err) {
+			return nil, err
+		}
+		socket.logger.Debugf(sessionID, "Passive port %d in use, trying the next one", port)
+		lastErr = err
+	}
+	if socket.ports.min == 0 {
+		return nil, lastErr
+	}
+	if metrics, ok := socket.metrics.(PassivePortMetrics); ok {
+		metrics.PassivePortsExhausted()
+	}
+	return nil, fmt.Errorf("ftp: no free passive port in range %d-%d: %v", socket.ports.min, socket.ports.max, lastErr)
+}
 
-	var listener net.Listener
-	listener, err = net.ListenTCP("tcp", laddr)
-	if err != nil {
-		socket.logger.Print(sessionID, err)
-		return
+// listenRetrying calls listen until it succeeds, up to bindRetries more
+// times, backing off between attempts.
+func (socket *ftpPassiveSocket) listenRetrying(sessionID string) (*net.TCPListener, error) {
+	backoff := passiveBindBackoff
+	for attempt := 0; ; attempt++ {
+		listener, err := socket.listen(sessionID)
+		if err == nil || attempt >= socket.bindRetries {
+			return listener, err
+		}
+		socket.logger.Warnf(sessionID, "Binding passive listener failed, retrying in %v: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-socket.ctx.Done():
+			return nil, err
+		}
+		if backoff *= 2; backoff > maxPassiveBindBackoff {
+			backoff = maxPassiveBindBackoff
+		}
 	}
+}
 
-	add := listener.Addr()
-	parts := strings.Split(add.String(), ":")
-	port, err := strconv.Atoi(parts[len(parts)-1])
+func (socket *ftpPassiveSocket) GoListenAndServe(sessionID string) (err error) {
+	// the error is logged by the command, with its context
+	tcpListener, err := socket.listenRetrying(sessionID)
 	if err != nil {
-		socket.logger.Print(sessionID, err)
 		return
 	}
+	if socket.acceptTimeout > 0 {
+		tcpListener.SetDeadline(time.Now().Add(socket.acceptTimeout))
+	}
+
+	var listener net.Listener = keepAliveListener{tcpListener, socket.keepAlive}
+	listener = dscpListener{listener, socket.dscp}
+	listener = newMetricsListener(listener, socket.metrics)
+	socket.localAddr = tcpListener.Addr().(*net.TCPAddr)
+	socket.port = socket.localAddr.Port
+	socket.logger.Debugf(sessionID, "Listening for passive data connection on %s", socket.localAddr)
 
-	socket.port = port
 	if socket.tlsConfing != nil {
 		listener = tls.NewListener(listener, socket.tlsConfing)
 	}
+	socket.listener = listener
 
 	go func() {
-		socket.lock.Lock()
-		defer socket.lock.Unlock()
-
-		conn, err := listener.Accept()
+		defer close(socket.accepted)
+
+		// an aborted transfer closes the listener to unblock Accept
+		acceptDone := make(chan struct{})
+		go func() {
+			select {
+			case <-socket.ctx.Done():
+				listener.Close()
+			case <-acceptDone:
+			}
+		}()
+
+		conn, err := socket.accept(listener, sessionID)
+		close(acceptDone)
+		// only one connection is accepted, release the port right away
+		listener.Close()
 		if err != nil {
-			socket.err = err
-			return
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				socket.logger.Warnf(sessionID, "Passive data connection timed out")
+				err = ErrAcceptTimeout
+			}
+			err = abortedErr(socket.ctx, err)
+			if err != ErrAborted {
+				err = &acceptError{sessionID: sessionID, port: socket.port, err: err}
+			}
+		} else {
+			conn = newDeadlineConn(socket.ctx, conn, socket.idleTimeout)
+			socket.metrics.DataConnOpened()
 		}
-		socket.err = nil
+
+		socket.lock.Lock()
+		defer socket.lock.Unlock()
+		socket.err = err
 		socket.conn = conn
 	}()
 	return nil
 }
 
+// accept waits for the client's data connection, dropping connections from
+// other hosts if the socket has a peerIP.
+func (socket *ftpPassiveSocket) accept(listener net.Listener, sessionID string) (net.Conn, error) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil || socket.peerIP == nil {
+			return conn, err
+		}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.Equal(socket.peerIP) {
+			return conn, nil
+		}
+		socket.logger.Warnf(sessionID, "Rejected passive data connection from %s", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// acceptError is returned by the Read and Write methods of a passive data
+// socket whose data connection could not be accepted.
+type acceptError struct {
+	sessionID string
+	port      int
+	err       error
+}
+
+func (e *acceptError) Error() string {
+	return fmt.Sprintf("ftp: session %s: accepting data connection on port %d: %v", e.sessionID, e.port, e.err)
+}
+
+func (e *acceptError) Unwrap() error {
+	return e.err
+}
+
+// waitForOpenSocket blocks until the client connected or accepting the
+// connection failed, in which case the error is returned to every caller.
 func (socket *ftpPassiveSocket) waitForOpenSocket() error {
+	<-socket.accepted
 	socket.lock.Lock()
 	defer socket.lock.Unlock()
 	if socket.conn != nil {
@@ -188,3 +530,103 @@ func (socket *ftpPassiveSocket) waitForOpenSocket() error {
 	}
 	return socket.err
 }
+
+// aLongTimeAgo is a deadline in the past, making pending and future calls
+// on a connection fail immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// deadlineConn manages the deadlines of a data connection. It closes the
+// connection once no Read or Write completed within the timeout, if
+// positive, and makes pending calls fail as soon as ctx is done.
+type deadlineConn struct {
+	net.Conn
+	ctx      context.Context
+	timeout  time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newDeadlineConn(ctx context.Context, conn net.Conn, timeout time.Duration) *deadlineConn {
+	c := &deadlineConn{
+		Conn:    conn,
+		ctx:     ctx,
+		timeout: timeout,
+		stop:    make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-c.stop:
+		}
+	}()
+	return c
+}
+
+func (conn *deadlineConn) Read(p []byte) (n int, err error) {
+	if err := conn.refresh(); err != nil {
+		return 0, err
+	}
+	n, err = conn.Conn.Read(p)
+	return n, conn.checkErr(err)
+}
+
+func (conn *deadlineConn) Write(p []byte) (n int, err error) {
+	if err := conn.refresh(); err != nil {
+		return 0, err
+	}
+	n, err = conn.Conn.Write(p)
+	return n, conn.checkErr(err)
+}
+
+func (conn *deadlineConn) Close() error {
+	conn.stopOnce.Do(func() { close(conn.stop) })
+	return conn.Conn.Close()
+}
+
+// refresh extends the idle deadline. It must be called before checking ctx,
+// so a cancellation can't be overwritten by the new deadline.
+func (conn *deadlineConn) refresh() error {
+	if conn.timeout > 0 {
+		conn.Conn.SetDeadline(time.Now().Add(conn.timeout))
+	}
+	if conn.ctx.Err() != nil {
+		return ErrAborted
+	}
+	return nil
+}
+
+func (conn *deadlineConn) checkErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if conn.ctx.Err() != nil {
+		return ErrAborted
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		conn.Close()
+		return ErrDataConnTimeout
+	}
+	return err
+}
+
+// abortedErr returns ErrAborted in place of err if ctx is done, since the
+// error is then a consequence of the cancellation.
+func abortedErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ErrAborted
+	}
+	return err
+}
+
+// errno returns the system error underlying a net error, or 0.
+func errno(err error) syscall.Errno {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	errno, _ := err.(syscall.Errno)
+	return errno
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// On Linux, all of 127.0.0.0/8 is on the loopback interface.
+func TestPassiveBindToControlLocalIP(t *testing.T) {
+	for _, bind := range []bool{false, true} {
+		s, _ := newTestServer(t, &ServerOpts{Hostname: "0.0.0.0", PassiveBindToControlLocalIP: bind})
+		_, port, _ := net.SplitHostPort(s.listenTo)
+		c, err := textproto.Dial("tcp", net.JoinHostPort("127.0.0.2", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		login(t, c)
+
+		for _, cmd := range []string{"EPSV", "PASV"} {
+			var dataPort int
+			if cmd == "EPSV" {
+				dataPort = epsvPort(t, expect(t, c, 229, "%s", cmd))
+			} else {
+				msg := expect(t, c, 227, "%s", cmd)
+				var h1, h2, h3, h4, p1, p2 int
+				fmt.Sscanf(msg[strings.Index(msg, "("):], "(%d,%d,%d,%d,%d,%d)", &h1, &h2, &h3, &h4, &p1, &p2)
+				dataPort = p1*256 + p2
+			}
+			// Another address of the host only reaches the listener if it
+			// binds to all of them.
+			other, err := net.Dial("tcp", net.JoinHostPort("127.0.0.3", strconv.Itoa(dataPort)))
+			if err == nil {
+				other.Close()
+			}
+			if (err == nil) == bind {
+				t.Errorf("%s with PassiveBindToControlLocalIP %v: dialing 127.0.0.3 got %v", cmd, bind, err)
+			}
+			if bind {
+				data, err := net.Dial("tcp", net.JoinHostPort("127.0.0.2", strconv.Itoa(dataPort)))
+				if err != nil {
+					t.Fatalf("%s: %v", cmd, err)
+				}
+				data.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,696 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParsePortRange(t *testing.T) {
+	var rangeTests = []struct {
+		in  string
+		out portRange
+		err bool
+	}{
+		{"", portRange{}, false},
+		{"50000-50100", portRange{50000, 50100}, false},
+		{" 50000 - 50000 ", portRange{50000, 50000}, false},
+		{"50000", portRange{}, true},
+		{"50100-50000", portRange{}, true},
+		{"0-100", portRange{}, true},
+		{"65000-70000", portRange{}, true},
+		{"a-b", portRange{}, true},
+	}
+	for _, tt := range rangeTests {
+		t.Run(tt.in, func(t *testing.T) {
+			r, err := parsePortRange(tt.in)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if r != tt.out {
+				t.Errorf("got %v, want %v", r, tt.out)
+			}
+		})
+	}
+}
+
+func TestPassiveSocketPortRange(t *testing.T) {
+	// Occupy a port so the range contains at least one busy entry.
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	busyPort := busy.Addr().(*net.TCPAddr).Port
+
+	_, err = newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{busyPort, busyPort}, 0, 0, 0, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err == nil {
+		t.Fatal("expected an error for an exhausted port range")
+	}
+
+	if busyPort == 65535 {
+		t.Skip("no room above the busy port")
+	}
+	socket, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{busyPort, busyPort + 1}, 0, 0, 0, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err != nil {
+		t.Skip("neighbouring port not available: ", err)
+	}
+	defer socket.Close()
+	if socket.Port() != busyPort+1 {
+		t.Errorf("got port %d, want %d", socket.Port(), busyPort+1)
+	}
+
+	// The advertised port must be the one actually listening.
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.Port())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestPassiveSocketPortReuse(t *testing.T) {
+	// Find a free port to use as a range of two.
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	if port == 65535 {
+		t.Skip("no room above the free port")
+	}
+
+	s, driver := newTestServer(t, &ServerOpts{PassivePorts: fmt.Sprintf("%d-%d", port, port+1)})
+	driver.files["/f.txt"] = []byte("again")
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	// Each transfer leaves its port in TIME_WAIT for the next bind.
+	for i := 0; i < 20; i++ {
+		if got := download(t, c, "RETR /f.txt"); got != "again" {
+			t.Fatalf("transfer %d: got %q", i, got)
+		}
+	}
+}
+
+func TestPassiveSocketPortInUse(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	if port == 65535 {
+		t.Skip("no room above the free port")
+	}
+
+	// A port bound by one passive socket is skipped by the next.
+	printer := new(printLogger)
+	logger := leveledLogger(printer)
+	first, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{port, port + 1}, time.Second, 0, 0, 0, 0, logger, "test", nil, nopMetrics{})
+	if err != nil {
+		t.Skip("port not available: ", err)
+	}
+	defer first.Close()
+	second, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{port, port + 1}, time.Second, 0, 0, 0, 0, logger, "test", nil, nopMetrics{})
+	if err != nil {
+		t.Skip("neighbouring port not available: ", err)
+	}
+	defer second.Close()
+	if first.Port() != port || second.Port() != port+1 {
+		t.Errorf("got ports %d and %d, want %d and %d", first.Port(), second.Port(), port, port+1)
+	}
+	printer.lock.Lock()
+	log := strings.Join(printer.lines, "\n")
+	printer.lock.Unlock()
+	if want := fmt.Sprintf("Passive port %d in use", port); !strings.Contains(log, want) {
+		t.Errorf("log %q lacks %q", log, want)
+	}
+}
+
+func TestPassiveSocketBindRetries(t *testing.T) {
+	// fail the first binds like an address missing from its interface
+	var attempts int
+	failures := 2
+	listen := listenPassive
+	defer func() { listenPassive = listen }()
+	listenPassive = func(ctx context.Context, network, address string) (net.Listener, error) {
+		attempts++
+		if attempts <= failures {
+			return nil, &net.OpError{Op: "listen", Net: network, Err: syscall.EADDRNOTAVAIL}
+		}
+		return listen(ctx, network, address)
+	}
+
+	socket, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{}, time.Second, 0, 0, 0, 2, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err != nil {
+		t.Fatalf("got %v after %d attempts, want the third to succeed", err, attempts)
+	}
+	socket.Close()
+
+	attempts, failures = 0, 3
+	if _, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{}, time.Second, 0, 0, 0, 2, new(DiscardLogger), "test", nil, nopMetrics{}); err == nil {
+		t.Error("expected an error once the retries are used up")
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+
+	// PASV fails with 425 the same way.
+	attempts, failures = 0, 100
+	s, _ := newTestServer(t, &ServerOpts{PassiveBindRetries: 1})
+	c := dialTestServer(t, s)
+	login(t, c)
+	expect(t, c, 425, "PASV")
+}
+
+func TestIsAddrInUse(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, err = net.Listen("tcp4", l.Addr().String())
+	if !isAddrInUse(err) {
+		t.Errorf("isAddrInUse(%v) = false", err)
+	}
+	if isAddrInUse(errors.New("other")) {
+		t.Error("isAddrInUse reported an unrelated error")
+	}
+}
+
+func TestPassiveSocketAcceptTimeout(t *testing.T) {
+	socket, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{}, 50*time.Millisecond, 0, 0, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read blocks until the accept goroutine gives up.
+	done := make(chan error)
+	go func() {
+		_, err := socket.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrAcceptTimeout) {
+			t.Errorf("got error %v, want %v", err, ErrAcceptTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("accept goroutine did not exit")
+	}
+
+	// The listener is released once the accept timed out.
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.Port())))
+	if err == nil {
+		t.Error("expected the listener to be closed")
+	}
+
+	if err := socket.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := socket.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPassiveSocketAcceptError(t *testing.T) {
+	socket, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{}, time.Second, 0, 0, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	passive := socket.(*ftpPassiveSocket)
+
+	// Pending calls are unblocked once Accept fails.
+	done := make(chan error, 2)
+	go func() {
+		_, err := socket.Read(make([]byte, 1))
+		done <- err
+	}()
+	go func() {
+		_, err := socket.Write([]byte("x"))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	passive.listener.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			var acceptErr *acceptError
+			if !errors.As(err, &acceptErr) || !errors.Is(err, net.ErrClosed) {
+				t.Fatalf("got error %v, want the Accept error", err)
+			}
+			if acceptErr.sessionID != "test" || acceptErr.port != socket.Port() {
+				t.Errorf("got session %q and port %d, want test and %d", acceptErr.sessionID, acceptErr.port, socket.Port())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Read or Write still blocked after Accept failed")
+		}
+	}
+
+	// Later calls fail the same way.
+	if _, err := socket.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got error %v, want the Accept error", err)
+	}
+	if _, err := socket.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got error %v, want the Accept error", err)
+	}
+}
+
+func TestPassiveSocketConcurrentOpen(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			socket, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{}, time.Second, 0, 0, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer socket.Close()
+
+			// Write before the client connected must block rather than fail.
+			written := make(chan error, 1)
+			go func() {
+				_, err := socket.Write([]byte("x"))
+				written <- err
+			}()
+
+			c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.Port())))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+
+			if err := <-written; err != nil {
+				t.Error(err)
+				return
+			}
+			buf := make([]byte, 1)
+			if _, err := c.Read(buf); err != nil || buf[0] != 'x' {
+				t.Errorf("got %q, %v", buf, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// testCertFiles writes a freshly generated self-signed certificate for
+// 127.0.0.1 and its key to PEM files.
+func testCertFiles(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// testTLSConfig returns a server config using a certificate from
+// testCertFiles.
+func testTLSConfig(t *testing.T) *tls.Config {
+	config, err := simpleTLSConfig(testCertFiles(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestPassiveSocketTLS(t *testing.T) {
+	socket, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{}, time.Second, 0, 0, 0, 0, new(DiscardLogger), "test", testTLSConfig(t), nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	read := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 5)
+		n, _ := socket.Read(buf)
+		read <- string(buf[:n])
+	}()
+
+	c, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.Port())), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-read; got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestActiveSocketDialTimeout(t *testing.T) {
+	// 192.0.2.0/24 is reserved for documentation and never answers.
+	dialer := &net.Dialer{Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	_, err := newActiveSocket(context.Background(), "tcp4", "192.0.2.1", 2121, dialer, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial took %v, want it to give up after the timeout", elapsed)
+	}
+}
+
+func TestActiveSocketTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The FTP client accepts the data connection and acts as TLS client.
+	read := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			read <- err.Error()
+			return
+		}
+		defer c.Close()
+		tlsConn := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+		buf := make([]byte, 5)
+		n, err := io.ReadFull(tlsConn, buf)
+		if err != nil {
+			read <- err.Error()
+			return
+		}
+		read <- string(buf[:n])
+	}()
+
+	socket, err := newActiveSocket(context.Background(), "tcp4", "127.0.0.1", l.Addr().(*net.TCPAddr).Port, new(net.Dialer), 0, new(DiscardLogger), "test", testTLSConfig(t), nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	if _, ok := socket.(*ftpActiveSocket).conn.(*tls.Conn); !ok {
+		t.Fatal("expected a TLS data connection")
+	}
+	if _, err := socket.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-read; got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestPassiveSocketIdleTimeout(t *testing.T) {
+	socket, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{}, time.Second, 50*time.Millisecond, 0, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.Port())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The client sends a byte and then stalls.
+	c.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if _, err := socket.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := socket.Read(buf); err != ErrDataConnTimeout {
+		t.Fatalf("got error %v, want %v", err, ErrDataConnTimeout)
+	}
+
+	// The server closed its end of the connection.
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(buf); err != io.EOF {
+		t.Errorf("got error %v, want %v", err, io.EOF)
+	}
+}
+
+func TestPassiveSocketLocalAddr(t *testing.T) {
+	socket, err := newPassiveSocket(context.Background(), "tcp4", "203.0.113.1", "127.0.0.1", nil, portRange{}, time.Second, 0, 0, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	addr, ok := socket.(*ftpPassiveSocket).LocalAddr().(*net.TCPAddr)
+	if !ok || !addr.IP.Equal(net.ParseIP("127.0.0.1")) || addr.Port == 0 || addr.Port != socket.Port() {
+		t.Fatalf("got local address %v, want 127.0.0.1:%d", addr, socket.Port())
+	}
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestPassiveSocketAbort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	socket, err := newPassiveSocket(ctx, "tcp4", "127.0.0.1", "", nil, portRange{}, time.Second, 0, 0, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.Port())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The client never reads, so the transfer blocks once buffers are full.
+	done := make(chan error, 1)
+	go func() {
+		chunk := make([]byte, 64*1024)
+		for {
+			if _, err := socket.Write(chunk); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != ErrAborted {
+			t.Errorf("got error %v, want %v", err, ErrAborted)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("transfer was not aborted")
+	}
+}
+
+func TestPassiveSocketCloseDuringWrite(t *testing.T) {
+	socket, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{}, time.Second, 0, 0, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.Port())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, c)
+		received <- n
+	}()
+
+	type result struct {
+		written int64
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var written int64
+		chunk := make([]byte, 32*1024)
+		for {
+			n, err := socket.Write(chunk)
+			written += int64(n)
+			if err != nil {
+				done <- result{written, err}
+				return
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := socket.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	res := <-done
+	if res.err != ErrDataSocketClosed {
+		t.Errorf("got error %v, want %v", res.err, ErrDataSocketClosed)
+	}
+	// Every byte Write reported as written reached the client.
+	if n := <-received; n != res.written {
+		t.Errorf("client received %d bytes, want %d", n, res.written)
+	}
+	if _, err := socket.Read(make([]byte, 1)); err != ErrDataSocketClosed {
+		t.Errorf("got error %v after Close, want %v", err, ErrDataSocketClosed)
+	}
+}
+
+func TestPassiveSocketListenHost(t *testing.T) {
+	socket, err := newPassiveSocket(context.Background(), "tcp4", "203.0.113.1", "127.0.0.1", nil, portRange{}, time.Second, 0, 0, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	if socket.Host() != "203.0.113.1" {
+		t.Errorf("got advertised host %q, want %q", socket.Host(), "203.0.113.1")
+	}
+
+	// 127.0.0.2 is a different loopback address, only reachable if the
+	// listener bound to all interfaces.
+	port := strconv.Itoa(socket.Port())
+	if c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.2", port)); err == nil {
+		c.Close()
+		t.Error("expected connections to other interfaces to be refused")
+	}
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestCheckListenHost(t *testing.T) {
+	for _, host := range []string{"", "127.0.0.1"} {
+		if err := checkListenHost(host); err != nil {
+			t.Errorf("%q: %v", host, err)
+		}
+	}
+	// 192.0.2.1 is reserved for documentation and not assigned locally.
+	for _, host := range []string{"localhost", "192.0.2.1"} {
+		if err := checkListenHost(host); err == nil {
+			t.Errorf("%q: expected an error", host)
+		}
+	}
+}
+
+func TestPassiveSocketReleasesPort(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		socket, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", nil, portRange{}, time.Second, 0, 0, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.Port()))
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := socket.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+
+		// The port is free while the transfer is still in progress.
+		if extra, err := net.Dial("tcp", addr); err == nil {
+			extra.Close()
+			t.Fatalf("transfer %d: listener still open after accept", i)
+		}
+		c.Close()
+		socket.Close()
+	}
+}
+
+func TestPassiveSocketPeerIP(t *testing.T) {
+	socket, err := newPassiveSocket(context.Background(), "tcp4", "127.0.0.1", "", net.ParseIP("127.0.0.1"), portRange{}, time.Second, 0, 0, 0, 0, new(DiscardLogger), "test", nil, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(socket.Port()))
+
+	// A foreign host connecting first is dropped.
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+	foreign, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer foreign.Close()
+	foreign.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := foreign.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got error %v, want the foreign connection closed", err)
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := socket.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if _, err := c.Read(buf); err != nil || buf[0] != 'x' {
+		t.Errorf("got %q, %v", buf, err)
+	}
+}
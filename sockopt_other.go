@@ -0,0 +1,25 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!windows
+
+package server
+
+import "syscall"
+
+// reuseAddr does nothing, as this platform has no SO_REUSEADDR.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// isAddrInUse reports false, as this platform's errors can't be told apart.
+func isAddrInUse(err error) bool {
+	return false
+}
+
+// isConnReset reports false, as this platform's errors can't be told apart.
+func isConnReset(err error) bool {
+	return false
+}
@@ -0,0 +1,36 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package server
+
+import "syscall"
+
+// reuseAddr is a net.Dialer and net.ListenConfig Control function setting
+// SO_REUSEADDR, so a fixed local port can be bound again while previous
+// connections are still in TIME_WAIT.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// isAddrInUse reports whether err is from binding an address already in use.
+func isAddrInUse(err error) bool {
+	return errno(err) == syscall.EADDRINUSE
+}
+
+// isConnReset reports whether err is from the peer resetting or closing a
+// connection being written to.
+func isConnReset(err error) bool {
+	errno := errno(err)
+	return errno == syscall.ECONNRESET || errno == syscall.EPIPE
+}
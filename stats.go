@@ -0,0 +1,135 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransferStats describes the data sent over data connections.
+type TransferStats struct {
+	// Bytes received from the client, e.g. by uploads
+	BytesIn int64
+	// Bytes sent to the client, e.g. by downloads and listings
+	BytesOut int64
+	// Time from the first byte transferred until the connection was closed
+	Duration time.Duration
+}
+
+// sessionStats accumulates the TransferStats of a session.
+type sessionStats struct {
+	lock  sync.Mutex
+	last  TransferStats
+	total TransferStats
+	open  *countingSocket // the data connection in use, if any
+}
+
+// track returns socket, counting its transfers into stats.
+func (stats *sessionStats) track(socket DataSocket) *countingSocket {
+	var counting *countingSocket
+	counting = newCountingSocket(socket, func(transfer TransferStats) {
+		stats.lock.Lock()
+		if stats.open == counting {
+			stats.open = nil
+		}
+		stats.lock.Unlock()
+		stats.add(transfer)
+	})
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.open = counting
+	return counting
+}
+
+// current returns the bytes transferred so far over the data connection in
+// use, if any.
+func (stats *sessionStats) current() (transfer TransferStats, ok bool) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	if stats.open == nil {
+		return TransferStats{}, false
+	}
+	return TransferStats{
+		BytesIn:  atomic.LoadInt64(&stats.open.bytesIn),
+		BytesOut: atomic.LoadInt64(&stats.open.bytesOut),
+	}, true
+}
+
+func (stats *sessionStats) add(transfer TransferStats) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.last = transfer
+	stats.total.BytesIn += transfer.BytesIn
+	stats.total.BytesOut += transfer.BytesOut
+	stats.total.Duration += transfer.Duration
+}
+
+// LastTransfer returns the statistics of the most recently closed data
+// connection of the session, including aborted and failed transfers.
+func (conn *Conn) LastTransfer() TransferStats {
+	conn.stats.lock.Lock()
+	defer conn.stats.lock.Unlock()
+	return conn.stats.last
+}
+
+// Stats returns the statistics of all data connections of the session.
+func (conn *Conn) Stats() TransferStats {
+	conn.stats.lock.Lock()
+	defer conn.stats.lock.Unlock()
+	return conn.stats.total
+}
+
+// countingSocket counts the bytes transferred over a DataSocket and reports
+// them when it is closed.
+type countingSocket struct {
+	DataSocket
+	bytesIn  int64
+	bytesOut int64
+	start    int64 // unix nanoseconds of the first transfer
+	report   func(TransferStats)
+	once     sync.Once
+}
+
+func newCountingSocket(socket DataSocket, report func(TransferStats)) *countingSocket {
+	return &countingSocket{DataSocket: socket, report: report}
+}
+
+func (socket *countingSocket) Read(p []byte) (n int, err error) {
+	socket.started()
+	n, err = socket.DataSocket.Read(p)
+	atomic.AddInt64(&socket.bytesIn, int64(n))
+	return n, err
+}
+
+func (socket *countingSocket) Write(p []byte) (n int, err error) {
+	socket.started()
+	n, err = socket.DataSocket.Write(p)
+	atomic.AddInt64(&socket.bytesOut, int64(n))
+	return n, err
+}
+
+func (socket *countingSocket) Close() error {
+	err := socket.DataSocket.Close()
+	socket.once.Do(func() {
+		var duration time.Duration
+		if start := atomic.LoadInt64(&socket.start); start != 0 {
+			duration = time.Since(time.Unix(0, start))
+		}
+		socket.report(TransferStats{
+			BytesIn:  atomic.LoadInt64(&socket.bytesIn),
+			BytesOut: atomic.LoadInt64(&socket.bytesOut),
+			Duration: duration,
+		})
+	})
+	return err
+}
+
+func (socket *countingSocket) started() {
+	if atomic.LoadInt64(&socket.start) == 0 {
+		atomic.CompareAndSwapInt64(&socket.start, 0, time.Now().UnixNano())
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestStatsTransfers(t *testing.T) {
+	s, driver := newTestServer(t, &ServerOpts{})
+	c := dialTestServer(t, s)
+	login(t, c)
+
+	upload(t, c, "/stats.txt", "0123456789")
+	if got := driver.lastConn().LastTransfer(); got.BytesIn != 10 || got.BytesOut != 0 {
+		t.Errorf("got upload stats %+v, want 10 bytes in", got)
+	}
+
+	download(t, c, "RETR /stats.txt")
+	expect(t, c, 200, "NOOP")
+	if got := driver.lastConn().LastTransfer(); got.BytesIn != 0 || got.BytesOut != 10 {
+		t.Errorf("got download stats %+v, want 10 bytes out", got)
+	}
+	if got := driver.lastConn().Stats(); got.BytesIn != 10 || got.BytesOut != 10 {
+		t.Errorf("got session stats %+v, want 10 bytes each way", got)
+	}
+}
+
+func TestCountingSocket(t *testing.T) {
+	conn := new(Conn)
+	buf := new(bufferSocket)
+	buf.WriteString("uploaded")
+
+	socket := newCountingSocket(buf, conn.stats.add)
+	if _, err := ioutil.ReadAll(socket); err != nil {
+		t.Fatal(err)
+	}
+	socket.Write([]byte("downloaded"))
+	socket.Close()
+	socket.Close()
+
+	want := TransferStats{BytesIn: 8, BytesOut: 10}
+	if got := conn.LastTransfer(); got.BytesIn != want.BytesIn || got.BytesOut != want.BytesOut {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A second, failed transfer only reports what was actually sent.
+	socket = newCountingSocket(new(bufferSocket), conn.stats.add)
+	socket.Read(make([]byte, 4))
+	socket.Close()
+	if got := conn.LastTransfer(); got.BytesIn != 0 || got.BytesOut != 0 {
+		t.Errorf("got %+v, want no bytes", got)
+	}
+	if got := conn.Stats(); got.BytesIn != 8 || got.BytesOut != 10 {
+		t.Errorf("got totals %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"path"
+	"strconv"
+	"sync"
+)
+
+// maxUniqueAttempts is how many names STOU tries before giving up.
+const maxUniqueAttempts = 100
+
+var errNoUniqueName = errors.New("ftp: no unique file name available")
+
+// pathReservations are the paths of uploads in progress under names chosen
+// by the server, so concurrent STOU commands never pick the same one.
+type pathReservations struct {
+	lock  sync.Mutex
+	paths map[string]struct{}
+}
+
+// reserve claims p, unless it already is.
+func (r *pathReservations) reserve(p string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.paths[p]; ok {
+		return false
+	}
+	if r.paths == nil {
+		r.paths = make(map[string]struct{})
+	}
+	r.paths[p] = struct{}{}
+	return true
+}
+
+// release frees a path claimed by reserve.
+func (r *pathReservations) release(p string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.paths, p)
+}
+
+// uniquePath reserves a path that neither exists nor is being uploaded by
+// another STOU. The name is based on base, such as base, base.1, base.2,
+// or random if base is empty. The caller releases the reservation on
+// conn.server.uploads.
+func (conn *Conn) uniquePath(base string) (string, error) {
+	dir := conn.buildPath("")
+	if base != "" {
+		p := conn.buildPath(base)
+		dir, base = path.Dir(p), path.Base(p)
+	}
+	for i := 0; i < maxUniqueAttempts; i++ {
+		var name string
+		switch {
+		case base == "":
+			name = randomName()
+		case i == 0:
+			name = base
+		default:
+			name = base + "." + strconv.Itoa(i)
+		}
+
+		p := path.Join(dir, name)
+		if !conn.server.uploads.reserve(p) {
+			continue
+		}
+		if _, err := conn.driver.Stat(p); err == nil {
+			conn.server.uploads.release(p)
+			continue
+		}
+		return p, nil
+	}
+	return "", errNoUniqueName
+}
+
+// randomName returns a file name unlikely to exist already.
+func randomName() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "ftp" + hex.EncodeToString(b)
+}